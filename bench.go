@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/criteo/http-proxy-exporter/bench"
+	"github.com/criteo/http-proxy-exporter/exporter"
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runBench load tests a proxy with the arguments of the bench subcommand
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	configFile := fs.String("config_file", "", "Path to configuration file, for its auth methods. Without it, the requests are not authenticated.")
+	authName := fs.String("auth", "basic", "Auth method of the configuration file to use, with -config_file.")
+	target := fs.String("target", "", "URL requested through the proxy.")
+	proxy := fs.String("proxy", "", "URL of the proxy.")
+	insecure := fs.Bool("insecure", false, "Skip the verification of TLS certificates.")
+	keepAlive := fs.Bool("keepalive", false, "Reuse the connections between requests.")
+	count := fs.Int("n", 200, "Number of requests, unlimited when 0.")
+	concurrency := fs.Int("c", 10, "Number of requests in flight.")
+	duration := fs.Duration("duration", 0, "Duration of the benchmark, unlimited when 0.")
+	timeout := fs.Duration("timeout", 10*time.Second, "Timeout of each request.")
+	output := fs.String("output", "text", "Output format, text or json.")
+	fs.Parse(args)
+
+	if *target == "" || *proxy == "" {
+		fmt.Fprintln(os.Stderr, "both -target and -proxy are required")
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *output != "text" && *output != "json" {
+		log.Fatalf("unknown output format %q", *output)
+	}
+
+	auth := &proxyclient.AuthMethod{}
+	if *configFile != "" {
+		config, err := exporter.LoadConfig(*configFile, exporter.Config{})
+		if err != nil {
+			log.Fatalf("error while loading config: %s", err)
+		}
+		a, ok := config.AuthMethods[*authName]
+		if !ok && (len(config.AuthMethods) > 0 || flagSet(fs, "auth")) {
+			log.Fatalf("unknown auth method %q", *authName)
+		}
+		if ok {
+			auth = a
+		}
+	} else if flagSet(fs, "auth") {
+		log.Fatal("-auth requires -config_file")
+	}
+
+	prober := proxyclient.NewProber()
+	defer prober.CloseIdleConnections()
+	report, err := bench.Run(context.Background(), prober, bench.Config{
+		Spec: proxyclient.ProbeSpec{RequestConfig: proxyclient.RequestConfig{
+			Target:    *target,
+			Proxy:     *proxy,
+			Auth:      auth,
+			Insecure:  *insecure,
+			Timeout:   *timeout,
+			KeepAlive: *keepAlive,
+		}},
+		Count:       *count,
+		Concurrency: *concurrency,
+		Duration:    *duration,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *output == "json" {
+		err = report.WriteJSON(os.Stdout)
+	} else {
+		err = report.WriteText(os.Stdout)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// flagSet reports whether a flag was given on the command line
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
@@ -0,0 +1,256 @@
+// Package bench load tests a proxy with the probes of proxyclient
+package bench
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+)
+
+// Percentiles are the percentiles of the latency distribution of a report
+var Percentiles = []float64{10, 25, 50, 75, 90, 95, 99}
+
+// causeNone is the cause of the requests which did not fail
+const causeNone = "none"
+
+// Config describes a benchmark
+type Config struct {
+	Spec proxyclient.ProbeSpec
+	// Count is the number of requests sent, unlimited when 0
+	Count int
+	// Concurrency is the number of requests in flight
+	Concurrency int
+	// Duration stops the benchmark, unlimited when 0
+	Duration time.Duration
+}
+
+// Verify ensures that the benchmark ends and has workers
+func (c Config) Verify() error {
+	if c.Count < 0 || c.Duration < 0 {
+		return errors.New("count and duration must not be negative")
+	}
+	if c.Count == 0 && c.Duration == 0 {
+		return errors.New("either a count or a duration must be set")
+	}
+	if c.Concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+	return nil
+}
+
+// Latency is the distribution of the durations of the successful requests
+type Latency struct {
+	Min  time.Duration `json:"min"`
+	Mean time.Duration `json:"mean"`
+	Max  time.Duration `json:"max"`
+	// Percentiles are indexed by the percentile, e.g. "p95"
+	Percentiles map[string]time.Duration `json:"percentiles"`
+}
+
+// Report is the outcome of a benchmark, durations are in nanoseconds in JSON
+type Report struct {
+	Target   string        `json:"target"`
+	Proxy    string        `json:"proxy"`
+	Requests int           `json:"requests"`
+	Duration time.Duration `json:"duration"`
+	// Throughput is the number of requests completed per second
+	Throughput float64 `json:"throughput"`
+	Latency    Latency `json:"latency"`
+	// Causes counts the requests by error kind, "none" for the successful ones
+	Causes      map[string]int `json:"causes"`
+	StatusCodes map[int]int    `json:"status_codes"`
+}
+
+// Run sends the requests of the benchmark with the prober, until the count
+// is reached, the duration has elapsed or the context is done
+func Run(ctx context.Context, prober *proxyclient.Prober, c Config) (*Report, error) {
+	if err := c.Verify(); err != nil {
+		return nil, err
+	}
+	if c.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Duration)
+		defer cancel()
+	}
+
+	// the tokens of the requests left to send, closed when the count is reached
+	tokens := make(chan struct{})
+	go func() {
+		defer close(tokens)
+		for i := 0; c.Count == 0 || i < c.Count; i++ {
+			select {
+			case tokens <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var (
+		mu      sync.Mutex
+		results []*proxyclient.Result
+		wg      sync.WaitGroup
+		prepErr error
+	)
+	start := time.Now()
+	for i := 0; i < c.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range tokens {
+				res, err := prober.Probe(ctx, c.Spec)
+				mu.Lock()
+				if err != nil {
+					prepErr = err
+				} else if ctx.Err() == nil || res.ErrorKind == proxyclient.ErrorKindNone {
+					// the requests interrupted by the end of the benchmark are not counted
+					results = append(results, res)
+				}
+				mu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if prepErr != nil {
+		return nil, prepErr
+	}
+
+	return newReport(c, results, time.Since(start)), nil
+}
+
+func newReport(c Config, results []*proxyclient.Result, elapsed time.Duration) *Report {
+	r := &Report{
+		Target:      c.Spec.Target,
+		Proxy:       redactURL(c.Spec.Proxy),
+		Requests:    len(results),
+		Duration:    elapsed,
+		Causes:      make(map[string]int),
+		StatusCodes: make(map[int]int),
+	}
+	if elapsed > 0 {
+		r.Throughput = float64(len(results)) / elapsed.Seconds()
+	}
+
+	var durations []time.Duration
+	for _, res := range results {
+		cause := string(res.ErrorKind)
+		if res.ErrorKind == proxyclient.ErrorKindNone {
+			cause = causeNone
+			durations = append(durations, res.Timings.Total)
+		}
+		r.Causes[cause]++
+		if res.StatusCode != 0 {
+			r.StatusCodes[res.StatusCode]++
+		}
+	}
+	r.Latency = newLatency(durations)
+	return r
+}
+
+func newLatency(durations []time.Duration) Latency {
+	l := Latency{Percentiles: make(map[string]time.Duration)}
+	if len(durations) == 0 {
+		return l
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+	var total time.Duration
+	for _, d := range durations {
+		total += d
+	}
+	l.Min = durations[0]
+	l.Max = durations[len(durations)-1]
+	l.Mean = total / time.Duration(len(durations))
+	for _, p := range Percentiles {
+		// nearest-rank percentile
+		rank := int(math.Ceil(p / 100 * float64(len(durations))))
+		l.Percentiles[percentileName(p)] = durations[rank-1]
+	}
+	return l
+}
+
+func percentileName(p float64) string {
+	return fmt.Sprintf("p%g", p)
+}
+
+// WriteJSON writes the report as JSON
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteText writes the report for humans
+func (r *Report) WriteText(w io.Writer) error {
+	ew := &errWriter{w: w}
+	ew.printf("Target:     %s\n", r.Target)
+	ew.printf("Proxy:      %s\n", r.Proxy)
+	ew.printf("Requests:   %d\n", r.Requests)
+	ew.printf("Duration:   %s\n", r.Duration.Round(time.Millisecond))
+	ew.printf("Throughput: %.2f req/s\n", r.Throughput)
+
+	ew.printf("\nLatency:\n")
+	ew.printf("  min   %s\n", r.Latency.Min)
+	ew.printf("  mean  %s\n", r.Latency.Mean)
+	ew.printf("  max   %s\n", r.Latency.Max)
+	ew.printf("\nLatency distribution:\n")
+	for _, p := range Percentiles {
+		name := percentileName(p)
+		ew.printf("  %-5s %s\n", name, r.Latency.Percentiles[name])
+	}
+
+	ew.printf("\nCauses:\n")
+	causes := make([]string, 0, len(r.Causes))
+	for cause := range r.Causes {
+		causes = append(causes, cause)
+	}
+	sort.Strings(causes)
+	for _, cause := range causes {
+		ew.printf("  %-14s %d\n", cause, r.Causes[cause])
+	}
+
+	ew.printf("\nStatus codes:\n")
+	codes := make([]int, 0, len(r.StatusCodes))
+	for code := range r.StatusCodes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		ew.printf("  %-14d %d\n", code, r.StatusCodes[code])
+	}
+	return ew.err
+}
+
+// errWriter keeps the first error of a sequence of writes
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...interface{}) {
+	if ew.err == nil {
+		_, ew.err = fmt.Fprintf(ew.w, format, args...)
+	}
+}
+
+// redactURL removes the credentials of a URL, e.g. of the proxy, from the reports
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "<invalid>"
+	}
+	u.User = nil
+	return u.String()
+}
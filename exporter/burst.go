@@ -0,0 +1,96 @@
+package exporter
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	burstStatMin = "min"
+	burstStatMax = "max"
+	burstStatP95 = "p95"
+)
+
+// burstStats returns the min, max and 95th percentile of durations
+func burstStats(durations []time.Duration) (min, max, p95 time.Duration) {
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	// nearest-rank percentile
+	rank := int(math.Ceil(0.95 * float64(len(sorted))))
+	return sorted[0], sorted[len(sorted)-1], sorted[rank-1]
+}
+
+// measureBurst fires target.Concurrency simultaneous requests to a target through a proxy, and
+// compares their durations with the one of the single request of the baseline outcome.
+// The requests of the burst are not counted by the other metrics.
+func (e *Exporter) measureBurst(proxy string, target Target, auth *proxyclient.AuthMethod, baseline probeOutcome) {
+	if proxy == systemProxy {
+		var err error
+		proxy, err = systemProxyFor(target.URL)
+		if err != nil {
+			// already reported by the baseline
+			return
+		}
+	}
+	proxyURL, insecure, _, err := resolveProxy(proxy)
+	if err != nil {
+		return
+	}
+	// as the baseline, for their durations to compare
+	spec := e.probeSpec(proxyURL, insecure, target, auth)
+
+	results := make([]*proxyclient.Result, target.Concurrency)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := e.prober.Probe(context.Background(), spec)
+			if err != nil {
+				log.Errorf("error while preparing request: %s", err)
+				return
+			}
+			results[i] = res
+		}(i)
+	}
+	wg.Wait()
+
+	failures := 0
+	var durations []time.Duration
+	for _, res := range results {
+		if res == nil || res.ErrorKind != proxyclient.ErrorKindNone {
+			failures++
+			continue
+		}
+		durations = append(durations, res.Timings.Total)
+	}
+
+	proxyURLForMetrics := baseline.ProxyURL
+	log.Debugf("burst of %d req to %q via %q: %d failures", target.Concurrency, target.URL, proxyURLForMetrics, failures)
+	e.metrics.proxyBurstFailures.WithLabelValues(proxyURLForMetrics, target.URL).Set(float64(failures))
+	if len(durations) == 0 {
+		// the stats of the previous burst would show a saturated proxy as healthy
+		for _, stat := range []string{burstStatMin, burstStatMax, burstStatP95} {
+			e.metrics.proxyBurstDurations.DeleteLabelValues(proxyURLForMetrics, target.URL, stat)
+		}
+		e.metrics.proxyBurstDegradation.DeleteLabelValues(proxyURLForMetrics, target.URL)
+		return
+	}
+
+	min, max, p95 := burstStats(durations)
+	e.metrics.proxyBurstDurations.WithLabelValues(proxyURLForMetrics, target.URL, burstStatMin).Set(min.Seconds())
+	e.metrics.proxyBurstDurations.WithLabelValues(proxyURLForMetrics, target.URL, burstStatMax).Set(max.Seconds())
+	e.metrics.proxyBurstDurations.WithLabelValues(proxyURLForMetrics, target.URL, burstStatP95).Set(p95.Seconds())
+	if baseline.RequestSuccess && baseline.Duration > 0 {
+		e.metrics.proxyBurstDegradation.WithLabelValues(proxyURLForMetrics, target.URL).Set(p95.Seconds() / baseline.Duration.Seconds())
+	} else {
+		e.metrics.proxyBurstDegradation.DeleteLabelValues(proxyURLForMetrics, target.URL)
+	}
+}
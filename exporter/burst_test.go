@@ -0,0 +1,86 @@
+package exporter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBurstStats(t *testing.T) {
+	var durations []time.Duration
+	for i := 20; i > 0; i-- {
+		durations = append(durations, time.Duration(i)*time.Millisecond)
+	}
+	min, max, p95 := burstStats(durations)
+	require.Equal(t, time.Millisecond, min)
+	require.Equal(t, 20*time.Millisecond, max)
+	require.Equal(t, 19*time.Millisecond, p95)
+	require.Equal(t, 20*time.Millisecond, durations[0])
+
+	min, max, p95 = burstStats([]time.Duration{time.Second})
+	require.Equal(t, time.Second, min)
+	require.Equal(t, time.Second, max)
+	require.Equal(t, time.Second, p95)
+}
+
+func TestMeasureBurst(t *testing.T) {
+	testDoMatrix(t, func(t *testing.T, proxy, origin srvFunc) {
+		e := newTestExporter(t, Config{})
+
+		proxyURL, done := proxy(t, 200)
+		defer done()
+
+		originURL, done := origin(t, 200)
+		defer done()
+
+		target := Target{URL: originURL, Insecure: true, Concurrency: 5}
+		auth := &proxyclient.AuthMethod{}
+		e.measureBurst(proxyURL, target, auth, e.measureOne(proxyURL, target, auth))
+
+		require.Equal(t, 0.0, testutil.ToFloat64(e.metrics.proxyBurstFailures.WithLabelValues(proxyURL, originURL)))
+		min := testutil.ToFloat64(e.metrics.proxyBurstDurations.WithLabelValues(proxyURL, originURL, burstStatMin))
+		max := testutil.ToFloat64(e.metrics.proxyBurstDurations.WithLabelValues(proxyURL, originURL, burstStatMax))
+		p95 := testutil.ToFloat64(e.metrics.proxyBurstDurations.WithLabelValues(proxyURL, originURL, burstStatP95))
+		require.True(t, min > 0 && min <= p95 && p95 <= max)
+		require.True(t, testutil.ToFloat64(e.metrics.proxyBurstDegradation.WithLabelValues(proxyURL, originURL)) > 0)
+	})
+
+	e := newTestExporter(t, Config{})
+
+	proxyURL, done := runProxy(t, 502)
+	defer done()
+
+	originURL, done := runOrigin(t, 200)
+	defer done()
+
+	target := Target{URL: originURL, Concurrency: 3}
+	auth := &proxyclient.AuthMethod{}
+	e.measureBurst(proxyURL, target, auth, e.measureOne(proxyURL, target, auth))
+
+	require.Equal(t, 3.0, testutil.ToFloat64(e.metrics.proxyBurstFailures.WithLabelValues(proxyURL, originURL)))
+	require.Equal(t, 0, testutil.CollectAndCount(e.metrics.proxyBurstDegradation))
+}
+
+func TestMeasureBurstSaturated(t *testing.T) {
+	e := newTestExporter(t, Config{})
+
+	proxyURL, done := runProxy(t, 200)
+	originURL, doneOrigin := runOrigin(t, 200)
+	defer doneOrigin()
+
+	target := Target{URL: originURL, Concurrency: 3}
+	auth := &proxyclient.AuthMethod{}
+	e.measureBurst(proxyURL, target, auth, e.measureOne(proxyURL, target, auth))
+	require.Equal(t, 3, testutil.CollectAndCount(e.metrics.proxyBurstDurations))
+	require.Equal(t, 1, testutil.CollectAndCount(e.metrics.proxyBurstDegradation))
+
+	// every request of the next burst fails
+	done()
+	e.measureBurst(proxyURL, target, auth, e.measureOne(proxyURL, target, auth))
+	require.Equal(t, 3.0, testutil.ToFloat64(e.metrics.proxyBurstFailures.WithLabelValues(proxyURL, originURL)))
+	require.Equal(t, 0, testutil.CollectAndCount(e.metrics.proxyBurstDurations))
+	require.Equal(t, 0, testutil.CollectAndCount(e.metrics.proxyBurstDegradation))
+}
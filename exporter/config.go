@@ -0,0 +1,250 @@
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config is a configuration file
+type Config struct {
+	AuthMethods        map[string]*proxyclient.AuthMethod `yaml:"auth_methods,omitempty"`
+	Proxies            []Proxy                            `yaml:"proxies"`
+	Targets            []Target                           `yaml:"targets"`
+	SourceAddress      string                             `yaml:"source_address,omitempty"`
+	ListenPort         int                                `yaml:"listen_port,omitempty"`
+	Interval           int                                `yaml:"interval,omitempty"`
+	Debug              bool                               `yaml:"debug,omitempty"`
+	Windows            []string                           `yaml:"windows,omitempty"`
+	Health             HealthConfig                       `yaml:"health,omitempty"`
+	Webhooks           []WebhookConfig                    `yaml:"webhooks,omitempty"`
+	ProxyGroups        []ProxyGroup                       `yaml:"proxy_groups,omitempty"`
+	PACURL             string                             `yaml:"pac_url,omitempty"`
+	PACFile            string                             `yaml:"pac_file,omitempty"`
+	PACRefresh         string                             `yaml:"pac_refresh,omitempty"`
+	HeaderRules        []HeaderRule                       `yaml:"header_rules,omitempty"`
+	Reflector          ReflectorConfig                    `yaml:"reflector,omitempty"`
+	MetricsNamespace   string                             `yaml:"metrics_namespace,omitempty"`
+	MetricsConstLabels map[string]string                  `yaml:"metrics_const_labels,omitempty"`
+	DebugProbes        int                                `yaml:"debug_probes,omitempty"`
+	HAR                HARConfig                          `yaml:"har,omitempty"`
+	LogFormat          string                             `yaml:"log_format,omitempty"`
+	LogRepeatInterval  string                             `yaml:"log_repeat_interval,omitempty"`
+	Sinks              []SinkConfig                       `yaml:"sinks,omitempty"`
+	OTLP               OTLPConfig                         `yaml:"otlp,omitempty"`
+	Tracing            OTLPConfig                         `yaml:"tracing,omitempty"`
+}
+
+// Proxy is a proxy that will be probed, configured either with its URL alone
+// or with its URL and options
+type Proxy struct {
+	URL string `yaml:"url"`
+	// ExpectedEgressIPs are the addresses the proxy is expected to leave through
+	ExpectedEgressIPs []string `yaml:"expected_egress_ips,omitempty"`
+}
+
+// UnmarshalYAML allows proxies to be configured by their URL alone
+func (p *Proxy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&p.URL); err == nil {
+		return nil
+	}
+	type plain Proxy
+	return unmarshal((*plain)(p))
+}
+
+// ReflectorConfig configures the built-in test origin
+type ReflectorConfig struct {
+	// Listen is the address of the reflector, which is disabled when empty
+	Listen      string `yaml:"listen,omitempty"`
+	TLSCertFile string `yaml:"tls_cert_file,omitempty"`
+	TLSKeyFile  string `yaml:"tls_key_file,omitempty"`
+}
+
+// Target is a HTTP(S) service that will be probed
+type Target struct {
+	URL      string `yaml:"url"`
+	Insecure bool   `yaml:"insecure,omitempty"`
+	// ExpectBypass is whether the target is expected to bypass the system proxy (NO_PROXY)
+	ExpectBypass *bool `yaml:"expect_bypass,omitempty"`
+	// Expect is whether the proxy is expected to block or allow the target
+	Expect    string     `yaml:"expect,omitempty"`
+	BlockPage *BlockPage `yaml:"block_page,omitempty"`
+	// Mode is the kind of check performed on the response, e.g. egress_ip
+	Mode string `yaml:"mode,omitempty"`
+	// EgressIPHeader is the response header carrying the client IP in egress_ip mode, the body is used otherwise
+	EgressIPHeader string `yaml:"egress_ip_header,omitempty"`
+	// KeepAlive is whether the connections to the target are kept alive between probes
+	KeepAlive bool `yaml:"keepalive,omitempty"`
+	// Concurrency is the number of simultaneous requests of the burst following each probe, none when below 2
+	Concurrency int `yaml:"concurrency,omitempty"`
+}
+
+// LoadConfig loads a configuration file over the defaults and returns the corresponding struct pointer
+func LoadConfig(filename string, defaults Config) (*Config, error) {
+	config := defaults
+	file, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return &config, fmt.Errorf("could not open config file: %s", err)
+	}
+	err = yaml.Unmarshal(file, &config)
+	if err != nil {
+		return &config, fmt.Errorf("could not parse config file: %s", err)
+	}
+	// fill the type of AuthMethod using the key in configuration
+	for authName := range config.AuthMethods {
+		config.AuthMethods[authName].Type = authName
+	}
+	return &config, nil
+}
+
+// VerifyConfig ensure that the provided configuration is valid
+func VerifyConfig(config *Config) []error {
+	var errs []error
+
+	if len(config.Proxies) < 1 && config.PACURL == "" && config.PACFile == "" {
+		errs = append(errs, errors.New("at least one proxy or a PAC file must be provided"))
+	}
+	if config.PACURL != "" && config.PACFile != "" {
+		errs = append(errs, errors.New("pac_url and pac_file are mutually exclusive"))
+	}
+	if _, err := parseDurationOr(config.PACRefresh, 0); err != nil {
+		errs = append(errs, fmt.Errorf("invalid pac_refresh: %s", err))
+	}
+	if config.LogFormat != "" && config.LogFormat != LogFormatText && config.LogFormat != LogFormatJSON {
+		errs = append(errs, fmt.Errorf("invalid log_format %q, must be %q or %q", config.LogFormat, LogFormatText, LogFormatJSON))
+	}
+	if _, err := parseDurationOr(config.LogRepeatInterval, 0); err != nil {
+		errs = append(errs, fmt.Errorf("invalid log_repeat_interval: %s", err))
+	}
+	if len(config.Targets) < 1 {
+		errs = append(errs, errors.New("at least one target must be provided"))
+	}
+	if config.Health.DegradedAfter < 0 || config.Health.DownAfter < 0 || config.Health.UpAfter < 0 {
+		errs = append(errs, errors.New("health thresholds must not be negative"))
+	} else if health := config.Health.withDefaults(); health.DegradedAfter > health.DownAfter {
+		errs = append(errs, fmt.Errorf("health degraded_after (%d) must not be greater than down_after (%d)", health.DegradedAfter, health.DownAfter))
+	}
+	if _, err := parseWindows(config.Windows); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, verifyProxyURLs(config.Proxies)...)
+	for _, proxy := range config.Proxies {
+		for _, ip := range proxy.ExpectedEgressIPs {
+			if net.ParseIP(ip) == nil {
+				errs = append(errs, fmt.Errorf("invalid expected egress IP %q", ip))
+			}
+		}
+	}
+	for _, target := range config.Targets {
+		errs = append(errs, verifyPolicy(target)...)
+		errs = append(errs, verifyTargetMode(target)...)
+		if target.Concurrency < 0 {
+			errs = append(errs, fmt.Errorf("target %q: concurrency must not be negative", target.URL))
+		}
+	}
+	for _, r := range config.HeaderRules {
+		if err := verifyHeaderRule(r); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, g := range config.ProxyGroups {
+		errs = append(errs, verifyProxyGroup(g, config.proxyURLs())...)
+	}
+	for _, w := range config.Webhooks {
+		if _, err := parseWebhook(w); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	errs = append(errs, verifySinks(config.Sinks)...)
+	if config.OTLP.Endpoint != "" {
+		if _, err := newOTLPPusher(config.OTLP, nil, nil, ""); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if config.Tracing.Endpoint != "" {
+		if _, err := newProbeTracer(config.Tracing, nil, ""); err != nil {
+			errs = append(errs, fmt.Errorf("tracing: %s", err))
+		}
+	}
+	if (config.Reflector.TLSCertFile == "") != (config.Reflector.TLSKeyFile == "") {
+		errs = append(errs, errors.New("reflector: tls_cert_file and tls_key_file must be provided together"))
+	}
+	return errs
+}
+
+// verifyTargetMode ensures that the mode of a target is known
+func verifyTargetMode(target Target) []error {
+	switch target.Mode {
+	case "", targetModeEgressIP, targetModeReflector:
+		return nil
+	}
+	return []error{fmt.Errorf("target %q: unknown mode %q", target.URL, target.Mode)}
+}
+
+// verifyProxyURLs ensures that the proxies are "system", empty for direct
+// connections, or HTTP(S) URLs. The errors do not include the URLs, which
+// may hold credentials.
+func verifyProxyURLs(proxies []Proxy) []error {
+	var errs []error
+	for i, p := range proxies {
+		if p.URL == "" || p.URL == systemProxy {
+			continue
+		}
+		u, err := url.Parse(p.URL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("proxies[%d]: could not parse the proxy URL", i))
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("proxies[%d]: the proxy URL must be http:// or https:// with a host", i))
+		}
+	}
+	return errs
+}
+
+// proxyURLs returns the URLs of the configured proxies
+func (c *Config) proxyURLs() []string {
+	urls := make([]string, 0, len(c.Proxies))
+	for _, p := range c.Proxies {
+		urls = append(urls, p.URL)
+	}
+	return urls
+}
+
+// proxy returns the configuration of a proxy by URL
+func (c *Config) proxy(proxyURL string) (Proxy, bool) {
+	for _, p := range c.Proxies {
+		if p.URL == proxyURL {
+			return p, true
+		}
+	}
+	return Proxy{}, false
+}
+
+// parseDurationOr parses a duration, returning the default value if it is empty
+func parseDurationOr(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// parseWindows parses the sliding windows durations (e.g. "5m", "1h", "24h")
+func parseWindows(windows []string) ([]time.Duration, error) {
+	var durations []time.Duration
+	for _, w := range windows {
+		d, err := time.ParseDuration(w)
+		if err != nil {
+			return nil, fmt.Errorf("invalid window %q: %s", w, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid window %q: must be positive", w)
+		}
+		durations = append(durations, d)
+	}
+	return durations, nil
+}
@@ -0,0 +1,105 @@
+package exporter
+
+import (
+	"testing"
+
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestLoadConfig(t *testing.T) {
+	var err error
+
+	_, err = LoadConfig("../config.example.yml", Config{})
+	assert.Nil(t, err, "LoadConfig is expected to work on example file, got : %s", err)
+
+	_, err = LoadConfig("idontexist.yml", Config{})
+	assert.NotNil(t, err, "LoadConfig should have returned an error")
+}
+
+func TestProxyUnmarshalYAML(t *testing.T) {
+	var c Config
+	err := yaml.Unmarshal([]byte(`
+proxies:
+  - "http://proxy/"
+  - url: "https://securedproxy/"
+    expected_egress_ips:
+      - "203.0.113.10"
+`), &c)
+	require.NoError(t, err)
+	require.Equal(t, []Proxy{
+		{URL: "http://proxy/"},
+		{URL: "https://securedproxy/", ExpectedEgressIPs: []string{"203.0.113.10"}},
+	}, c.Proxies)
+}
+
+func TestVerifyConfig(t *testing.T) {
+	var targets []Target
+	var errs []error
+
+	proxies := []Proxy{
+		{URL: "http://proxy/"},
+		{URL: "https://securedproxy/"},
+	}
+
+	auth := &proxyclient.AuthMethod{
+		Type: "basic",
+		Params: map[string]string{
+			"Username": "janedoe",
+			"Password": "Who am I ?",
+		},
+	}
+
+	target := Target{
+		URL: "https://www.example.com/",
+	}
+
+	targets = append(targets, target)
+
+	config := Config{
+		AuthMethods: map[string]*proxyclient.AuthMethod{
+			"basic": auth,
+		},
+		Proxies: proxies,
+		Targets: targets,
+	}
+
+	errs = VerifyConfig(&config)
+	assert.Len(t, errs, 0)
+
+	noProxies := config
+	noProxies.Proxies = []Proxy{}
+	errs = VerifyConfig(&noProxies)
+	assert.Len(t, errs, 1)
+
+	noTargets := config
+	noTargets.Targets = []Target{}
+	errs = VerifyConfig(&noTargets)
+	assert.Len(t, errs, 1)
+
+	errs = VerifyConfig(&Config{})
+	assert.Len(t, errs, 2)
+
+	downFirst := config
+	downFirst.Health = HealthConfig{DegradedAfter: 5}
+	errs = VerifyConfig(&downFirst)
+	assert.Len(t, errs, 1)
+
+	badProxies := config
+	badProxies.Proxies = []Proxy{{URL: "proxy:3128"}, {URL: "http://user:secret@[::1"}, {URL: ""}, {URL: systemProxy}}
+	errs = VerifyConfig(&badProxies)
+	assert.Len(t, errs, 2)
+	for _, err := range errs {
+		assert.NotContains(t, err.Error(), "secret")
+	}
+	_, err := New(&badProxies, Options{Registerer: prometheus.NewRegistry()})
+	assert.Error(t, err)
+
+	downAtOnce := config
+	downAtOnce.Health = HealthConfig{DownAfter: 1}
+	errs = VerifyConfig(&downAtOnce)
+	assert.Len(t, errs, 0)
+}
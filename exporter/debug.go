@@ -0,0 +1,138 @@
+package exporter
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+)
+
+// defaultDebugProbes is the number of probes kept per (proxy, target) pair when not configured
+const defaultDebugProbes = 10
+
+// urlCredentials matches the credentials of the URLs in a text
+var urlCredentials = regexp.MustCompile(`(\w+://)[^/@\s]+@`)
+
+// probeRecord is the detailed log of a probe, without credentials
+type probeRecord struct {
+	// ProbeID is the identifier of the probe in the logs
+	ProbeID   string    `json:"probe_id,omitempty"`
+	Time      time.Time `json:"time"`
+	ProxyURL  string    `json:"proxy_url"`
+	TargetURL string    `json:"target_url"`
+	// ResolvedProxy is the address of the proxy resolved by the exporter
+	ResolvedProxy   string              `json:"resolved_proxy,omitempty"`
+	Events          []proxyclient.Event `json:"events,omitempty"`
+	Timings         map[string]float64  `json:"timings_seconds,omitempty"`
+	RequestHeaders  http.Header         `json:"request_headers,omitempty"`
+	StatusCode      int                 `json:"status_code,omitempty"`
+	ResponseHeaders http.Header         `json:"response_headers,omitempty"`
+	ErrorKind       string              `json:"error_kind,omitempty"`
+	// Errors is the chain of errors, from the outermost one
+	Errors []string `json:"errors,omitempty"`
+}
+
+func newProbeRecord(id, proxyURL, targetURL, resolvedProxy string, res *proxyclient.Result, err error) *probeRecord {
+	r := &probeRecord{
+		ProbeID:       id,
+		Time:          time.Now(),
+		ProxyURL:      proxyURL,
+		TargetURL:     targetURL,
+		ResolvedProxy: resolvedProxy,
+	}
+	if res != nil {
+		r.Time = res.Start
+		for _, e := range res.Events {
+			e.Detail = redactURLs(e.Detail)
+			r.Events = append(r.Events, e)
+		}
+		r.Timings = map[string]float64{
+			"dns":           res.Timings.DNS.Seconds(),
+			"connect":       res.Timings.Connect.Seconds(),
+			"tls_handshake": res.Timings.TLSHandshake.Seconds(),
+			"first_byte":    res.Timings.FirstByte.Seconds(),
+			"total":         res.Timings.Total.Seconds(),
+		}
+		if res.Request != nil {
+			r.RequestHeaders = proxyclient.RedactHeader(res.Request.Header)
+		}
+		if res.Response != nil {
+			r.StatusCode = res.StatusCode
+			r.ResponseHeaders = proxyclient.RedactHeader(res.Response.Header)
+		}
+		r.ErrorKind = string(res.ErrorKind)
+		err = res.Err
+	}
+	for ; err != nil; err = errors.Unwrap(err) {
+		r.Errors = append(r.Errors, redactURLs(err.Error()))
+	}
+	return r
+}
+
+// redactURLs removes the credentials of the URLs in a text
+func redactURLs(s string) string {
+	return urlCredentials.ReplaceAllString(s, "${1}***@")
+}
+
+// debugLog keeps the records of the last probes of each (proxy, target) pair
+type debugLog struct {
+	size int
+
+	mu      sync.Mutex
+	records map[pairKey][]*probeRecord
+}
+
+func newDebugLog(size int) *debugLog {
+	if size <= 0 {
+		size = defaultDebugProbes
+	}
+	return &debugLog{size: size, records: make(map[pairKey][]*probeRecord)}
+}
+
+func (l *debugLog) record(r *probeRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := pairKey{r.ProxyURL, r.TargetURL}
+	records := append(l.records[key], r)
+	if len(records) > l.size {
+		records = records[len(records)-l.size:]
+	}
+	l.records[key] = records
+}
+
+// last returns the records of a pair, from the most recent one
+func (l *debugLog) last(proxyURL, targetURL string) ([]*probeRecord, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	records, ok := l.records[pairKey{proxyURL, targetURL}]
+	last := make([]*probeRecord, len(records))
+	for i, r := range records {
+		last[len(records)-1-i] = r
+	}
+	return last, ok
+}
+
+// DebugHandler serves the records of the last probes of the pair given by the
+// proxy and target parameters, with the URLs as in the labels of the metrics
+func (e *Exporter) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if _, ok := query["proxy"]; !ok || query.Get("target") == "" {
+			http.Error(w, "the proxy and target parameters are required", http.StatusBadRequest)
+			return
+		}
+		records, ok := e.debug.last(query.Get("proxy"), query.Get("target"))
+		if !ok {
+			http.Error(w, "no probe of this proxy and target", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(records)
+	})
+}
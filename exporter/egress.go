@@ -0,0 +1,85 @@
+package exporter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// targetModeEgressIP fetches an IP echo endpoint to find the address a proxy leaves through
+const targetModeEgressIP = "egress_ip"
+
+// egressIP extracts the client IP echoed by the origin, either from a header
+// or from the body, which may be the bare IP or a JSON document
+func egressIP(resp *http.Response, body []byte, header string) (net.IP, error) {
+	var raw string
+	if header != "" {
+		raw = resp.Header.Get(header)
+		if raw == "" {
+			return nil, fmt.Errorf("header %q not found", header)
+		}
+		// keep the first address of lists such as X-Forwarded-For
+		raw = strings.Split(raw, ",")[0]
+	} else {
+		raw = strings.TrimSpace(string(body))
+		var doc map[string]interface{}
+		if json.Unmarshal(body, &doc) == nil {
+			raw = ""
+			for _, key := range []string{"ip", "client_ip", "origin"} {
+				if v, ok := doc[key].(string); ok {
+					raw = strings.Split(v, ",")[0]
+					break
+				}
+			}
+		}
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(raw))
+	if ip == nil {
+		return nil, errors.New("no IP address found in response")
+	}
+	return ip, nil
+}
+
+// onEgressIPCheck exposes the egress IP observed through the proxy and
+// whether it is one of the expected ones
+func (e *Exporter) onEgressIPCheck(proxyURL string, target Target, resp *http.Response, body []byte, expected []string) {
+	ip, err := egressIP(resp, body, target.EgressIPHeader)
+	if err != nil {
+		log.Warnf("req to %q via %q: could not read egress IP: %s", target.URL, proxyURL, err)
+		if len(expected) > 0 {
+			e.metrics.proxyEgressIPMatch.WithLabelValues(proxyURL, target.URL).Set(0)
+		}
+		return
+	}
+
+	key := pairKey{proxyURL, target.URL}
+	e.egressIPsMu.Lock()
+	if last, ok := e.egressIPs[key]; ok && last != ip.String() {
+		e.metrics.proxyEgressIPInfo.DeleteLabelValues(proxyURL, target.URL, last)
+	}
+	e.egressIPs[key] = ip.String()
+	e.egressIPsMu.Unlock()
+
+	e.metrics.proxyEgressIPInfo.WithLabelValues(proxyURL, target.URL, ip.String()).Set(1)
+
+	if len(expected) == 0 {
+		return
+	}
+	match := false
+	for _, e := range expected {
+		if ip.Equal(net.ParseIP(e)) {
+			match = true
+			break
+		}
+	}
+	if !match {
+		log.Warnf("req to %q via %q: unexpected egress IP %s", target.URL, proxyURL, ip)
+	}
+	e.metrics.proxyEgressIPMatch.WithLabelValues(proxyURL, target.URL).Set(boolToFloat(match))
+}
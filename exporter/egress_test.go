@@ -0,0 +1,60 @@
+package exporter
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEgressIP(t *testing.T) {
+	header := http.Header{"X-Forwarded-For": []string{"203.0.113.10, 10.0.0.1"}}
+
+	for _, tc := range []struct {
+		body     string
+		header   string
+		expected string
+	}{
+		{body: "203.0.113.10\n", expected: "203.0.113.10"},
+		{body: `{"ip": "2001:db8::1"}`, expected: "2001:db8::1"},
+		{body: `{"origin": "203.0.113.10, 10.0.0.1"}`, expected: "203.0.113.10"},
+		{header: "X-Forwarded-For", expected: "203.0.113.10"},
+	} {
+		ip, err := egressIP(&http.Response{Header: header}, []byte(tc.body), tc.header)
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, ip.String())
+	}
+
+	_, err := egressIP(&http.Response{Header: header}, []byte("<html>Hello</html>"), "")
+	require.Error(t, err)
+	_, err = egressIP(&http.Response{Header: header}, nil, "X-Client-IP")
+	require.Error(t, err)
+}
+
+func TestProxyEgressIP(t *testing.T) {
+	proxyURL, done := runProxy(t, 200)
+	defer done()
+
+	otherProxyURL, done := runProxy(t, 200)
+	defer done()
+
+	reflectorURL, done := runReflector(t, false)
+	defer done()
+	originURL := reflectorURL + "/ip"
+
+	e := newTestExporter(t, Config{Proxies: []Proxy{
+		{URL: proxyURL, ExpectedEgressIPs: []string{"127.0.0.1"}},
+		{URL: otherProxyURL, ExpectedEgressIPs: []string{"203.0.113.10"}},
+	}})
+
+	target := Target{URL: originURL, Mode: targetModeEgressIP}
+	e.measureOne(proxyURL, target, &proxyclient.AuthMethod{})
+	e.measureOne(otherProxyURL, Target{URL: originURL, Mode: targetModeEgressIP, EgressIPHeader: "X-Client-IP"}, &proxyclient.AuthMethod{})
+
+	require.Equal(t, 1.0, testutil.ToFloat64(e.metrics.proxyEgressIPMatch.WithLabelValues(proxyURL, originURL)))
+	require.Equal(t, 1.0, testutil.ToFloat64(e.metrics.proxyEgressIPInfo.WithLabelValues(proxyURL, originURL, "127.0.0.1")))
+	require.Equal(t, 0.0, testutil.ToFloat64(e.metrics.proxyEgressIPMatch.WithLabelValues(otherProxyURL, originURL)))
+	require.Equal(t, 1.0, testutil.ToFloat64(e.metrics.proxyEgressIPInfo.WithLabelValues(otherProxyURL, originURL, "127.0.0.1")))
+}
@@ -0,0 +1,568 @@
+// Package exporter probes HTTP(S) targets through proxies and exposes the
+// outcomes as Prometheus metrics.
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// responseBodyLimit is the maximum number of bytes of the response body kept for inspection
+const responseBodyLimit = 64 * 1024
+
+// invalidProxy labels the probes through a proxy URL which could not be
+// parsed, e.g. picked by a PAC file, as the URL may hold credentials
+const invalidProxy = "invalid"
+
+// Options configures how an exporter exposes its metrics
+type Options struct {
+	// Registerer registers the collectors of the exporter, the default
+	// registerer is used when nil
+	Registerer prometheus.Registerer
+	// Namespace prefixes the names of the metrics, e.g. "edge" exports
+	// edge_proxy_requests_total
+	Namespace string
+	// ConstLabels are added to all the metrics
+	ConstLabels prometheus.Labels
+	// Version is the version of the exporter, written in the HAR files
+	Version string
+}
+
+// Exporter probes the targets of a configuration through its proxies, and
+// owns the collectors of the outcomes
+type Exporter struct {
+	config  *Config
+	auth    *proxyclient.AuthMethod
+	prober  *proxyclient.Prober
+	metrics *metrics
+
+	windows  *slidingWindows
+	health   *healthTracker
+	groups   *proxyGroups
+	notifier *webhookNotifier
+	pacs     *pacProber
+	debug    *debugLog
+	status   *statusBoard
+	har      *harWriter
+	probeLog *probeLogger
+	sinks    *resultSinks
+	otlp     *otlpPusher
+	tracer   *probeTracer
+
+	egressIPsMu sync.Mutex
+	egressIPs   map[pairKey]string
+
+	headerAuditsMu sync.Mutex
+	headerAudits   map[pairKey]headerAuditSeries
+
+	systemSelectionsMu sync.Mutex
+	systemSelections   map[string]string
+}
+
+// New creates an exporter for the configuration and registers its collectors
+func New(config *Config, opts Options) (*Exporter, error) {
+	if errs := verifyProxyURLs(config.Proxies); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	e := &Exporter{
+		config:           config,
+		auth:             &proxyclient.AuthMethod{},
+		prober:           proxyclient.NewProber(),
+		metrics:          newMetrics(),
+		health:           newHealthTracker(config.Health),
+		debug:            newDebugLog(config.DebugProbes),
+		status:           newStatusBoard(config.proxyURLs(), config.Targets),
+		egressIPs:        make(map[pairKey]string),
+		headerAudits:     make(map[pairKey]headerAuditSeries),
+		systemSelections: make(map[string]string),
+	}
+	collectors := e.metrics.collectors()
+
+	// FIXME: find a better way to handle multiple auth methods (once they exist)
+	if len(config.AuthMethods) > 0 {
+		e.auth = config.AuthMethods["basic"]
+	}
+
+	windows, err := parseWindows(config.Windows)
+	if err != nil {
+		return nil, err
+	}
+	if len(windows) > 0 {
+		e.windows = newSlidingWindows(windows)
+		collectors = append(collectors, e.windows)
+	}
+
+	if len(config.ProxyGroups) > 0 {
+		e.groups, err = newProxyGroups(config.ProxyGroups, config.Targets)
+		if err != nil {
+			return nil, err
+		}
+		collectors = append(collectors, e.groups)
+	}
+
+	if len(config.Webhooks) > 0 {
+		e.notifier, err = newWebhookNotifier(config.Webhooks, e.metrics.webhookNotifications)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	logRepeatInterval, err := parseDurationOr(config.LogRepeatInterval, defaultLogRepeatInterval)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log_repeat_interval: %s", err)
+	}
+	e.probeLog = newProbeLogger(config.LogFormat, logRepeatInterval)
+
+	if len(config.Sinks) > 0 {
+		e.sinks, err = newResultSinks(config.Sinks, e.metrics)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Tracing.Endpoint != "" {
+		e.tracer, err = newProbeTracer(config.Tracing, e.metrics, opts.Version)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.HAR.Dir != "" {
+		e.har, err = newHARWriter(config.HAR, opts.Version)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.PACURL != "" || config.PACFile != "" {
+		e.pacs, err = newPACProber(e)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reg := opts.Registerer
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	if err := registerCollectors(reg, opts, collectors); err != nil {
+		return nil, err
+	}
+
+	if config.OTLP.Endpoint != "" {
+		// the same collectors are gathered for the collector, with their names and labels of /metrics
+		gatherer := prometheus.NewRegistry()
+		if err := registerCollectors(gatherer, opts, collectors); err != nil {
+			return nil, err
+		}
+		e.otlp, err = newOTLPPusher(config.OTLP, gatherer, e.metrics.otlpPushes, opts.Version)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := e.initMetrics(config.proxyURLs(), config.Targets); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// registerCollectors registers the collectors with the namespace and constant labels of the options
+func registerCollectors(reg prometheus.Registerer, opts Options, collectors []prometheus.Collector) error {
+	if len(opts.ConstLabels) > 0 {
+		reg = prometheus.WrapRegistererWith(opts.ConstLabels, reg)
+	}
+	if opts.Namespace != "" {
+		reg = prometheus.WrapRegistererWithPrefix(opts.Namespace+"_", reg)
+	}
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return fmt.Errorf("could not register metrics: %s", err)
+		}
+	}
+	return nil
+}
+
+// Run probes the targets every interval, until the context is done
+func (e *Exporter) Run(ctx context.Context) {
+	if e.sinks != nil {
+		// write the buffered results once stopped
+		defer e.sinks.close()
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	if e.otlp != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.otlp.run(ctx)
+		}()
+	}
+	if e.tracer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.tracer.run(ctx)
+		}()
+	}
+
+	interval := time.Duration(e.config.Interval) * time.Second
+	if interval <= 0 {
+		<-ctx.Done()
+		return
+	}
+
+	every := func(probe func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					probe()
+				}
+			}
+		}()
+	}
+
+	for _, target := range e.config.Targets {
+		target := target
+		if e.pacs != nil {
+			// create 1 measurement goroutine by target, probing the proxies picked by the PAC file
+			every(func() { e.pacs.measure(target, e.auth) })
+		}
+		for _, proxy := range e.config.proxyURLs() {
+			proxy := proxy
+			// create 1 measurement goroutine by (target, proxy) tuple
+			every(func() {
+				baseline := e.measureOne(proxy, target, e.auth)
+				if target.Concurrency > 1 {
+					e.measureBurst(proxy, target, e.auth, baseline)
+				}
+			})
+		}
+	}
+}
+
+// measureOne probes a target through a proxy, records and returns the outcome
+func (e *Exporter) measureOne(proxy string, target Target, auth *proxyclient.AuthMethod) probeOutcome {
+	proxyConfig, _ := e.config.proxy(proxy)
+
+	details := probeDetails{ID: newProbeID()}
+	system := proxy == systemProxy
+	if system {
+		// probe through the proxy actually picked by the environment
+		var err error
+		proxy, err = systemProxyFor(target.URL)
+		if err != nil {
+			e.debug.record(newProbeRecord(details.ID, systemProxy, target.URL, "", nil, err))
+			return e.publish(e.onSetupFailure(systemProxy, target.URL, proxyConnectionErrorCauseSystem, err), details)
+		}
+	}
+
+	proxyURLForMetrics, err := metricsProxyURL(proxy)
+	if err != nil {
+		// do not expose the faulty url in case it contains a password
+		err = errors.New("could not parse proxy URL")
+		e.debug.record(newProbeRecord(details.ID, invalidProxy, target.URL, "", nil, err))
+		return e.publish(e.onSetupFailure(invalidProxy, target.URL, proxyConnectionErrorCauseLookup, err), details)
+	}
+	if system {
+		proxyURLForMetrics = systemProxyLabel(proxyURLForMetrics)
+		e.onSystemProxySelection(target, proxyURLForMetrics)
+	}
+
+	if e.tracer != nil {
+		details.Trace = newTraceContext()
+	}
+	proxyURL, insecure, lookup, err := resolveProxy(proxy)
+
+	if err != nil {
+		details.Events = lookup
+		e.debug.record(newProbeRecord(details.ID, proxyURLForMetrics, target.URL, "", nil, err))
+		return e.publish(e.onSetupFailure(proxyURLForMetrics, target.URL, proxyConnectionErrorCauseLookup, err), details)
+	}
+
+	spec := e.probeSpec(proxyURL, insecure, target, auth)
+	if details.Trace != nil {
+		spec.Header = details.Trace.header()
+	}
+	res, err := e.prober.Probe(context.Background(), spec)
+	if res != nil && len(lookup) > 0 {
+		// the proxy was resolved before the probe, which dials its address
+		res.Events = append(lookup, res.Events...)
+		res.Timings.DNS += lookup[len(lookup)-1].Time.Sub(lookup[0].Time)
+	}
+	e.debug.record(newProbeRecord(details.ID, proxyURLForMetrics, target.URL, proxyURL.Host, res, err))
+	if err != nil {
+		return e.publish(e.onSetupFailure(proxyURLForMetrics, target.URL, proxyConnectionErrorCausePrepare, err), details)
+	}
+
+	if e.har != nil && res.ErrorKind != proxyclient.ErrorKindNone {
+		if path, err := e.har.write(proxyURLForMetrics, proxyURL.Host, target.URL, res); err != nil {
+			log.Errorf("could not write HAR file: %s", err)
+		} else {
+			log.Debugf("wrote HAR file %s", path)
+		}
+	}
+
+	if target.Expect != "" && !res.ConnectionFailure() {
+		e.onPolicyCheck(proxyURLForMetrics, target, isBlocked(target.BlockPage, res.Response, res.ConnectStatusCode, res.Body), !res.OriginFailure())
+	}
+
+	if res.ErrorKind == proxyclient.ErrorKindNone {
+		switch target.Mode {
+		case targetModeEgressIP:
+			e.onEgressIPCheck(proxyURLForMetrics, target, res.Response, res.Body, proxyConfig.ExpectedEgressIPs)
+		case targetModeReflector:
+			e.onHeaderAudit(proxyURLForMetrics, target, res.Request, res.Body, e.config.HeaderRules)
+		}
+		if target.KeepAlive {
+			connection := keepAliveConnectionCold
+			if res.Reused {
+				connection = keepAliveConnectionWarm
+			}
+			e.metrics.proxyKeepAliveDurations.WithLabelValues(proxyURLForMetrics, target.URL, connection).Observe(res.Timings.Total.Seconds())
+		}
+	}
+
+	var o probeOutcome
+	if res.ConnectionFailure() {
+		o = e.onConnectionFailure(proxyURLForMetrics, target.URL, res.ErrorKind, res.Err, res.Timings.Total)
+	} else if res.OriginFailure() {
+		o = e.onConnectionSuccessWithOriginFailure(proxyURLForMetrics, target.URL, res.ErrorKind, res.Err, res.Timings.Total)
+	} else {
+		o = e.onConnectionSuccessWithOriginSuccess(
+			proxyURLForMetrics,
+			target.URL,
+			res.StatusCode,
+			res.Timings.Total,
+		)
+	}
+	details.ResolvedProxy = proxyURL.Host
+	details.StatusCode = res.StatusCode
+	details.ErrorKind = res.ErrorKind
+	details.Events = res.Events
+	details.Connection = probeConnection{
+		proxied:  proxyURL.Host != "",
+		proxyTLS: proxyURL.Scheme == "https",
+		tunnel:   proxyURL.Host != "" && strings.HasPrefix(target.URL, "https://"),
+	}
+	return e.publish(o, details)
+}
+
+// publish logs the outcome of a probe, sends its result to the sinks and its
+// trace to the collector, and returns it
+func (e *Exporter) publish(o probeOutcome, d probeDetails) probeOutcome {
+	e.probeLog.log(o, d)
+	if e.sinks != nil {
+		e.sinks.send(newProbeResult(o, d))
+	}
+	if e.tracer != nil && d.Trace != nil {
+		e.tracer.send(newProbeTrace(o, d))
+	}
+	return o
+}
+
+// probeSpec returns the spec of the probes of a target through a resolved proxy
+func (e *Exporter) probeSpec(proxyURL *url.URL, insecure bool, target Target, auth *proxyclient.AuthMethod) proxyclient.ProbeSpec {
+	spec := proxyclient.ProbeSpec{RequestConfig: e.requestConfig(proxyURL, insecure, target, auth)}
+	if target.Expect != "" || target.Mode != "" || e.har != nil {
+		// the body is only needed to recognize block pages, for the checks of target modes and in HAR files
+		spec.BodyLimit = responseBodyLimit
+	}
+	return spec
+}
+
+// Probe probes a target through a proxy as the exporter does, without
+// recording the outcome. The resolution of the proxy and a verbose trace of
+// the probe are written to trace when it is not nil.
+func (e *Exporter) Probe(ctx context.Context, proxy string, target Target, trace io.Writer) (*proxyclient.Result, error) {
+	if trace == nil {
+		trace = ioutil.Discard
+	}
+	if proxy == systemProxy {
+		var err error
+		proxy, err = systemProxyFor(target.URL)
+		if err != nil {
+			return nil, fmt.Errorf("could not pick system proxy: %s", err)
+		}
+		fmt.Fprintf(trace, "* System proxy: %q\n", proxy)
+	}
+
+	proxyURL, insecure, _, err := resolveProxy(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("error while resolving proxy address: %s", err)
+	}
+	if proxy != proxyURL.String() {
+		fmt.Fprintf(trace, "* Proxy resolved to %s\n", proxyURL.Host)
+	}
+
+	spec := e.probeSpec(proxyURL, insecure, target, e.auth)
+	spec.Trace = trace
+	return e.prober.Probe(ctx, spec)
+}
+
+// requestConfig returns the configuration of the requests to a target through a resolved proxy
+func (e *Exporter) requestConfig(proxyURL *url.URL, insecure bool, target Target, auth *proxyclient.AuthMethod) proxyclient.RequestConfig {
+	return proxyclient.RequestConfig{
+		Target:     target.URL,
+		Proxy:      proxyURL.String(),
+		Auth:       auth,
+		SourceAddr: e.config.SourceAddress,
+		Insecure:   target.Insecure || insecure,
+		Timeout:    time.Duration(e.config.Interval) * time.Second,
+		KeepAlive:  target.KeepAlive,
+	}
+}
+
+// onSetupFailure records a probe which failed before connecting, because the
+// proxy could not be resolved or picked or the request could not be prepared
+func (e *Exporter) onSetupFailure(proxyURL string, targetURL string, cause string, err error) probeOutcome {
+	e.metrics.proxyConnectionTentatives.WithLabelValues(proxyURL, targetURL).Inc()
+	e.metrics.proxyConnectionErrors.WithLabelValues(proxyURL, cause, targetURL).Inc()
+
+	return e.recordOutcome(probeOutcome{
+		Time:      time.Now(),
+		ProxyURL:  proxyURL,
+		TargetURL: targetURL,
+		Cause:     cause,
+		Error:     err.Error(),
+	})
+}
+
+func (e *Exporter) onConnectionFailure(proxyURL, targetURL string, kind proxyclient.ErrorKind, err error, duration time.Duration) probeOutcome {
+	e.metrics.proxyConnectionTentatives.WithLabelValues(proxyURL, targetURL).Inc()
+	e.metrics.proxyConnectionErrors.WithLabelValues(proxyURL, proxyConnectionErrorCauseProxy, targetURL).Inc()
+
+	return e.recordOutcome(probeOutcome{
+		Time:      time.Now(),
+		ProxyURL:  proxyURL,
+		TargetURL: targetURL,
+		Duration:  duration,
+		Cause:     proxyConnectionErrorCauseProxy,
+		ErrorKind: kind,
+		Error:     err.Error(),
+	})
+}
+
+func (e *Exporter) onConnectionSuccessWithOriginFailure(proxyURL, targetURL string, kind proxyclient.ErrorKind, err error, duration time.Duration) probeOutcome {
+	e.metrics.proxyConnectionTentatives.WithLabelValues(proxyURL, targetURL).Inc()
+
+	e.metrics.proxyConnectionSuccesses.WithLabelValues(proxyURL, targetURL).Inc()
+
+	e.metrics.proxyRequestTotal.WithLabelValues(proxyURL, targetURL).Inc()
+	e.metrics.proxyRequestsFailures.WithLabelValues(proxyURL, targetURL).Inc()
+
+	return e.recordOutcome(probeOutcome{
+		Time:              time.Now(),
+		ProxyURL:          proxyURL,
+		TargetURL:         targetURL,
+		ConnectionSuccess: true,
+		Duration:          duration,
+		ErrorKind:         kind,
+		Error:             err.Error(),
+	})
+}
+
+func (e *Exporter) onConnectionSuccessWithOriginSuccess(proxyURL, targetURL string, statusCode int, duration time.Duration) probeOutcome {
+	e.metrics.proxyConnectionTentatives.WithLabelValues(proxyURL, targetURL).Inc()
+	e.metrics.proxyConnectionSuccesses.WithLabelValues(proxyURL, targetURL).Inc()
+
+	e.metrics.proxyRequestTotal.WithLabelValues(proxyURL, targetURL).Inc()
+	e.metrics.proxyRequestsSuccesses.WithLabelValues(proxyURL, targetURL, fmt.Sprint(statusCode)).Inc()
+
+	e.metrics.proxyRequestsDurations.WithLabelValues(proxyURL, targetURL).Observe(duration.Seconds())
+
+	return e.recordOutcome(probeOutcome{
+		Time:              time.Now(),
+		ProxyURL:          proxyURL,
+		TargetURL:         targetURL,
+		ConnectionSuccess: true,
+		RequestSuccess:    true,
+		Duration:          duration,
+	})
+}
+
+// recordOutcome feeds a probe outcome to the in-process aggregations and returns it
+func (e *Exporter) recordOutcome(o probeOutcome) probeOutcome {
+	e.status.record(o)
+	if e.windows != nil {
+		e.windows.record(o)
+	}
+	if e.groups != nil {
+		e.groups.record(o)
+	}
+	if e.health != nil {
+		if t := e.health.record(o); t != nil {
+			e.onHealthTransition(t)
+		}
+	}
+	return o
+}
+
+// resolveProxy parses the URL of a proxy and resolves its host, it returns the
+// dns_start and dns_done events of the lookup when there was one
+func resolveProxy(proxy string) (*url.URL, bool, []proxyclient.Event, error) {
+	if proxy == "" {
+		return &url.URL{}, false, nil, nil
+	}
+
+	// parse the url to extract host
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		// the error would hold the url, and its password
+		return nil, false, nil, errors.New("could not parse proxy URL")
+	}
+	hostPort := proxyURL.Host
+
+	// parse ip:port if there is a port
+	host, port, err := net.SplitHostPort(hostPort)
+	if err == nil {
+		hostPort = host
+	}
+
+	// if the host is an IP, do not attempt to resolve
+	ip := net.ParseIP(hostPort)
+	if ip != nil {
+		return proxyURL, false, nil, nil
+	}
+
+	events := []proxyclient.Event{{Time: time.Now(), Name: "dns_start", Detail: hostPort}}
+	addrs, err := net.LookupHost(hostPort)
+	done := proxyclient.Event{Time: time.Now(), Name: "dns_done", Detail: fmt.Sprint(addrs)}
+	if err != nil {
+		done.Detail, done.Failed = err.Error(), true
+	}
+	events = append(events, done)
+	if err != nil {
+		return proxyURL, false, events, err
+	}
+
+	outHost := addrs[0]
+	if port != "" {
+		outHost = net.JoinHostPort(addrs[0], port)
+	}
+
+	proxyURL.Host = outHost
+
+	return proxyURL, proxyURL.Scheme == "https", events, nil
+}
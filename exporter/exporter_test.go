@@ -0,0 +1,82 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExporterRegistry(t *testing.T) {
+	proxyURL, done := runProxy(t, 200)
+	defer done()
+
+	originURL, done := runOrigin(t, 200)
+	defer done()
+
+	config := Config{
+		Proxies: []Proxy{{URL: proxyURL}},
+		Targets: []Target{{URL: originURL}},
+		Windows: []string{"5m"},
+	}
+
+	// two exporters coexist in a registry when their namespaces differ
+	reg := prometheus.NewPedanticRegistry()
+	edge, err := New(&config, Options{
+		Registerer:  reg,
+		Namespace:   "edge",
+		ConstLabels: prometheus.Labels{"site": "par"},
+	})
+	require.NoError(t, err)
+	_, err = New(&config, Options{Registerer: reg, Namespace: "core"})
+	require.NoError(t, err)
+
+	_, err = New(&config, Options{Registerer: reg, Namespace: "core"})
+	require.Error(t, err)
+
+	edge.measureOne(proxyURL, config.Targets[0], &proxyclient.AuthMethod{})
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	labels := prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL}
+	m := findMetric(t, families, "edge_proxy_requests_total", labels)
+	require.NotNil(t, m)
+	require.Equal(t, 1.0, m.GetCounter().GetValue())
+	constLabel := false
+	for _, lp := range m.GetLabel() {
+		constLabel = constLabel || lp.GetName() == "site" && lp.GetValue() == "par"
+	}
+	require.True(t, constLabel)
+
+	m = findMetric(t, families, "core_proxy_connection_tentatives_total", labels)
+	require.NotNil(t, m)
+	require.Equal(t, 0.0, m.GetCounter().GetValue())
+	require.Nil(t, findMetric(t, families, "proxy_requests_total", labels))
+	require.NotNil(t, findMetric(t, families, "edge_proxy_window_success_ratio", prometheus.Labels{"site": "par"}))
+}
+
+func TestExporterProbe(t *testing.T) {
+	proxyURL, done := runProxy(t, 200)
+	defer done()
+
+	originURL, done := runOrigin(t, 200)
+	defer done()
+
+	config := Config{Proxies: []Proxy{{URL: proxyURL}}, Targets: []Target{{URL: originURL}}}
+	e := newTestExporter(t, config)
+
+	var trace bytes.Buffer
+	res, err := e.Probe(context.Background(), strings.Replace(proxyURL, "127.0.0.1", "localhost", 1), config.Targets[0], &trace)
+	require.NoError(t, err)
+	require.Equal(t, proxyclient.ErrorKindNone, res.ErrorKind)
+	require.Contains(t, trace.String(), "* Proxy resolved to ")
+	require.Contains(t, trace.String(), "< HTTP/1.1 200 OK\n")
+
+	// the outcome is not recorded
+	requireCounter(t, e.metrics.proxyRequestTotal, prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL}, 0)
+}
@@ -0,0 +1,178 @@
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// proxyGroupModeAny considers a group available when any of its proxies works
+	proxyGroupModeAny = "any"
+	// proxyGroupModeFailover considers a group from the point of view of a client
+	// trying its proxies in order until one works
+	proxyGroupModeFailover = "failover"
+)
+
+var (
+	proxyGroupAvailableDesc = prometheus.NewDesc(
+		"proxy_group_available",
+		"Whether the target is reachable through at least one proxy of the group (1) or not (0).",
+		[]string{"group", "resource_url"}, nil,
+	)
+	proxyGroupEffectiveRTTDesc = prometheus.NewDesc(
+		"proxy_group_effective_rtt_seconds",
+		"Duration of the last request as seen by a client of the group.",
+		[]string{"group", "resource_url"}, nil,
+	)
+	proxyGroupActiveProxyDesc = prometheus.NewDesc(
+		"proxy_group_active_proxy",
+		"Proxy of the group a client would use to reach the target.",
+		[]string{"group", "resource_url", "proxy_url"}, nil,
+	)
+)
+
+// ProxyGroup is a named and ordered list of proxies used together by clients
+type ProxyGroup struct {
+	Name    string   `yaml:"name"`
+	Mode    string   `yaml:"mode,omitempty"`
+	Proxies []string `yaml:"proxies"`
+}
+
+// verifyProxyGroup ensures that a group is valid and only contains known proxies
+func verifyProxyGroup(group ProxyGroup, proxies []string) []error {
+	var errs []error
+
+	if group.Name == "" {
+		errs = append(errs, errors.New("proxy group name must be provided"))
+	}
+	switch group.Mode {
+	case "", proxyGroupModeAny, proxyGroupModeFailover:
+	default:
+		errs = append(errs, fmt.Errorf("proxy group %q: unknown mode %q", group.Name, group.Mode))
+	}
+	if len(group.Proxies) < 1 {
+		errs = append(errs, fmt.Errorf("proxy group %q: at least one proxy must be provided", group.Name))
+	}
+	for _, p := range group.Proxies {
+		found := false
+		for _, known := range proxies {
+			if p == known {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Errorf("proxy group %q: proxy %q is not in the proxies list", group.Name, p))
+		}
+	}
+	return errs
+}
+
+// proxyGroups exports the availability of groups of proxies, computed from
+// the last outcome of each (proxy, target) pair
+type proxyGroups struct {
+	mu      sync.Mutex
+	groups  []ProxyGroup
+	targets []Target
+	last    map[pairKey]probeOutcome
+}
+
+func newProxyGroups(groups []ProxyGroup, targets []Target) (*proxyGroups, error) {
+	pg := &proxyGroups{
+		targets: targets,
+		last:    make(map[pairKey]probeOutcome),
+	}
+	for _, g := range groups {
+		// reference the proxies as they appear in the metrics
+		members := make([]string, 0, len(g.Proxies))
+		for _, p := range g.Proxies {
+			proxyURL, err := metricsProxyURL(p)
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, proxyURL)
+		}
+		g.Proxies = members
+		if g.Mode == "" {
+			g.Mode = proxyGroupModeAny
+		}
+		pg.groups = append(pg.groups, g)
+	}
+	return pg, nil
+}
+
+func (pg *proxyGroups) record(o probeOutcome) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	pg.last[pairKey{o.ProxyURL, o.TargetURL}] = o
+}
+
+// Describe implements prometheus.Collector
+func (pg *proxyGroups) Describe(ch chan<- *prometheus.Desc) {
+	ch <- proxyGroupAvailableDesc
+	ch <- proxyGroupEffectiveRTTDesc
+	ch <- proxyGroupActiveProxyDesc
+}
+
+// Collect implements prometheus.Collector
+func (pg *proxyGroups) Collect(ch chan<- prometheus.Metric) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	for _, g := range pg.groups {
+		for _, target := range pg.targets {
+			available, active, rtt, ok := pg.evaluate(g, target.URL)
+			if !ok {
+				continue
+			}
+			value := 0.0
+			if available {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(proxyGroupAvailableDesc, prometheus.GaugeValue,
+				value, g.Name, target.URL)
+			if available {
+				ch <- prometheus.MustNewConstMetric(proxyGroupEffectiveRTTDesc, prometheus.GaugeValue,
+					rtt.Seconds(), g.Name, target.URL)
+				ch <- prometheus.MustNewConstMetric(proxyGroupActiveProxyDesc, prometheus.GaugeValue,
+					1, g.Name, target.URL, active)
+			}
+		}
+	}
+}
+
+// evaluate computes the availability of a target through a group, the proxy a
+// client would use and the duration it would experience. ok is false when no
+// proxy of the group has been probed yet.
+func (pg *proxyGroups) evaluate(g ProxyGroup, targetURL string) (available bool, active string, rtt time.Duration, ok bool) {
+	// time spent by a failover client on the proxies failing before the working one
+	var lost time.Duration
+
+	for _, proxyURL := range g.Proxies {
+		o, found := pg.last[pairKey{proxyURL, targetURL}]
+		if !found {
+			continue
+		}
+		ok = true
+
+		if !o.RequestSuccess {
+			lost += o.Duration
+			continue
+		}
+
+		switch g.Mode {
+		case proxyGroupModeFailover:
+			return true, proxyURL, lost + o.Duration, true
+		default:
+			if !available || o.Duration < rtt {
+				available, active, rtt = true, proxyURL, o.Duration
+			}
+		}
+	}
+	return available, active, rtt, ok
+}
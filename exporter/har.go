@@ -0,0 +1,303 @@
+package exporter
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+)
+
+const (
+	defaultHARMaxFiles = 100
+	defaultHARMaxBytes = 50 * 1024 * 1024
+	harSuffix          = ".har"
+)
+
+// harUnsafe matches the characters replaced in the names of the HAR files
+var harUnsafe = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// HARConfig configures the HAR files written for the failed probes
+type HARConfig struct {
+	// Dir is the directory of the files, none are written when empty
+	Dir string `yaml:"dir,omitempty"`
+	// MaxFiles and MaxBytes cap the number and the total size of the files,
+	// the oldest ones are removed first
+	MaxFiles int   `yaml:"max_files,omitempty"`
+	MaxBytes int64 `yaml:"max_bytes,omitempty"`
+}
+
+// har is a HAR 1.2 document
+type har struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Comment         string      `json:"comment,omitempty"`
+	// custom fields are prefixed by an underscore
+	Proxy     harProxy `json:"_proxy"`
+	ErrorKind string   `json:"_errorKind,omitempty"`
+}
+
+type harProxy struct {
+	URL      string `json:"url"`
+	Resolved string `json:"resolved,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// harTimings are in milliseconds, -1 when they do not apply
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	headers := []harNameValue{}
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			headers = append(headers, harNameValue{Name: k, Value: v})
+		}
+	}
+	return headers
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// msOrNone returns the duration in milliseconds, -1 when the phase did not happen
+func msOrNone(d time.Duration) float64 {
+	if d == 0 {
+		return -1
+	}
+	return ms(d)
+}
+
+// newHAR returns the HAR document of a probe, without credentials
+func newHAR(version, proxyURL, resolvedProxy string, res *proxyclient.Result, bodyLimit int64) *har {
+	t := res.Timings
+	entry := harEntry{
+		StartedDateTime: res.Start.UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		Time:            ms(t.Total),
+		Request: harRequest{
+			Method:      res.Request.Method,
+			URL:         redactURLs(res.Request.URL.String()),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(proxyclient.RedactHeader(res.Request.Header)),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+		},
+		Response: harResponse{
+			Cookies:     []harNameValue{},
+			Headers:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Timings: harTimings{
+			Blocked: -1,
+			DNS:     msOrNone(t.DNS),
+			// the connect time includes the TLS handshakes in HAR
+			Connect: msOrNone(t.Connect + t.TLSHandshake),
+			SSL:     msOrNone(t.TLSHandshake),
+			// send is not measured but required, it is left to 0
+			Wait:    -1,
+			Receive: -1,
+		},
+		Proxy:     harProxy{URL: proxyURL, Resolved: resolvedProxy},
+		ErrorKind: string(res.ErrorKind),
+	}
+	if host, _, err := net.SplitHostPort(resolvedProxy); err == nil {
+		entry.ServerIPAddress = host
+	}
+	if res.Err != nil {
+		entry.Comment = redactURLs(res.Err.Error())
+	}
+
+	if t.FirstByte > 0 {
+		wait := t.FirstByte - t.DNS - t.Connect - t.TLSHandshake
+		if wait < 0 {
+			wait = 0
+		}
+		entry.Timings.Wait = ms(wait)
+		entry.Timings.Receive = ms(t.Total - t.FirstByte)
+	}
+	if resp := res.Response; resp != nil {
+		entry.Response.Status = resp.StatusCode
+		entry.Response.StatusText = strings.TrimSpace(strings.TrimPrefix(resp.Status, fmt.Sprint(resp.StatusCode)))
+		entry.Response.HTTPVersion = resp.Proto
+		entry.Response.Headers = harHeaders(proxyclient.RedactHeader(resp.Header))
+		entry.Response.RedirectURL = resp.Header.Get("Location")
+
+		content := harContent{Size: resp.ContentLength, MimeType: resp.Header.Get("Content-Type")}
+		if content.Size < 0 {
+			content.Size = int64(len(res.Body))
+		}
+		if utf8.Valid(res.Body) {
+			content.Text = string(res.Body)
+		} else {
+			content.Text = base64.StdEncoding.EncodeToString(res.Body)
+			content.Encoding = "base64"
+		}
+		if n := int64(len(res.Body)); n >= bodyLimit && (resp.ContentLength < 0 || resp.ContentLength > n) {
+			content.Comment = fmt.Sprintf("truncated to %d bytes", len(res.Body))
+		}
+		entry.Response.Content = content
+		entry.Response.BodySize = content.Size
+	}
+
+	return &har{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "http-proxy-exporter", Version: version},
+		Entries: []harEntry{entry},
+	}}
+}
+
+// harWriter writes the HAR files of failed probes to a directory, within its caps
+type harWriter struct {
+	dir      string
+	maxFiles int
+	maxBytes int64
+	version  string
+
+	mu sync.Mutex
+}
+
+func newHARWriter(c HARConfig, version string) (*harWriter, error) {
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create HAR directory: %s", err)
+	}
+	w := &harWriter{dir: c.Dir, maxFiles: c.MaxFiles, maxBytes: c.MaxBytes, version: version}
+	if w.maxFiles <= 0 {
+		w.maxFiles = defaultHARMaxFiles
+	}
+	if w.maxBytes <= 0 {
+		w.maxBytes = defaultHARMaxBytes
+	}
+	return w, nil
+}
+
+// write writes the HAR file of a probe and removes the oldest files over the caps
+func (w *harWriter) write(proxyURL, resolvedProxy, targetURL string, res *proxyclient.Result) (string, error) {
+	data, err := json.MarshalIndent(newHAR(w.version, proxyURL, resolvedProxy, res, responseBodyLimit), "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	name := strings.Join([]string{
+		res.Start.UTC().Format("20060102T150405.000Z"),
+		harUnsafe.ReplaceAllString(redactURLs(proxyURL), "_"),
+		harUnsafe.ReplaceAllString(redactURLs(targetURL), "_"),
+	}, "-")
+	if len(name) > 200 {
+		name = name[:200]
+	}
+	path := filepath.Join(w.dir, name+harSuffix)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return "", err
+	}
+	return path, w.prune()
+}
+
+// prune removes the oldest files while the caps are exceeded
+func (w *harWriter) prune() error {
+	infos, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return err
+	}
+	var files []os.FileInfo
+	var total int64
+	for _, info := range infos {
+		if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), harSuffix) {
+			files = append(files, info)
+			total += info.Size()
+		}
+	}
+	// the names start with the time of the probe
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	for len(files) > 0 && (len(files) > w.maxFiles || total > w.maxBytes) {
+		if err := os.Remove(filepath.Join(w.dir, files[0].Name())); err != nil {
+			return err
+		}
+		total -= files[0].Size()
+		files = files[1:]
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+	"github.com/criteo/http-proxy-exporter/proxytest"
+	"github.com/stretchr/testify/require"
+)
+
+func readHARs(t *testing.T, dir string) []*har {
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var hars []*har
+	for _, info := range infos {
+		data, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		require.NoError(t, err)
+		require.NotContains(t, string(data), "secret")
+		h := &har{}
+		require.NoError(t, json.Unmarshal(data, h))
+		hars = append(hars, h)
+	}
+	return hars
+}
+
+func TestHARExport(t *testing.T) {
+	proxyURL, done := runFakeProxy(t, false, proxytest.Config{StatusCode: 502})
+	defer done()
+
+	originURL, done := runOrigin(t, 200)
+	defer done()
+
+	dir, err := ioutil.TempDir("", "har")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	e := newTestExporter(t, Config{HAR: HARConfig{Dir: dir, MaxFiles: 2}})
+	auth := &proxyclient.AuthMethod{Type: "basic", Params: map[string]string{"username": "user", "password": "secret"}}
+	e.measureOne(proxyURL, Target{URL: originURL}, auth)
+
+	hars := readHARs(t, dir)
+	require.Len(t, hars, 1)
+	require.Equal(t, "1.2", hars[0].Log.Version)
+	entry := hars[0].Log.Entries[0]
+	require.Equal(t, originURL, entry.Request.URL)
+	require.Contains(t, entry.Request.Headers, harNameValue{Name: "Proxy-Authorization", Value: "Basic ***"})
+	require.Equal(t, 502, entry.Response.Status)
+	require.Equal(t, "Bad Gateway", entry.Response.StatusText)
+	require.Equal(t, string(proxyclient.ErrorKindBadGateway), entry.ErrorKind)
+	require.Equal(t, "127.0.0.1", entry.ServerIPAddress)
+	require.Equal(t, proxyURL, entry.Proxy.URL)
+	require.True(t, entry.Time > 0)
+	require.True(t, entry.Timings.Wait >= 0)
+
+	// the successful probes are not exported, the oldest files are removed
+	goodProxyURL, done := runProxy(t, 200)
+	defer done()
+	e.measureOne(goodProxyURL, Target{URL: originURL}, auth)
+	require.Len(t, readHARs(t, dir), 1)
+	for i := 0; i < 3; i++ {
+		e.measureOne("http://127.0.0.1:1", Target{URL: originURL}, auth)
+	}
+	hars = readHARs(t, dir)
+	require.Len(t, hars, 2)
+	for _, h := range hars {
+		require.Equal(t, string(proxyclient.ErrorKindProxyConnect), h.Log.Entries[0].ErrorKind)
+		require.Equal(t, 0, h.Log.Entries[0].Response.Status)
+	}
+}
+
+func TestHARTruncatedBody(t *testing.T) {
+	originURL, done := runReflector(t, false)
+	defer done()
+
+	res, err := proxyclient.NewProber().Probe(context.Background(), proxyclient.ProbeSpec{
+		RequestConfig: proxyclient.RequestConfig{Target: originURL + "/bytes/100", Auth: &proxyclient.AuthMethod{}},
+		BodyLimit:     10,
+	})
+	require.NoError(t, err)
+
+	content := newHAR("1.0", "", "", res, 10).Log.Entries[0].Response.Content
+	require.Equal(t, int64(100), content.Size)
+	require.Equal(t, "truncated to 10 bytes", content.Comment)
+	require.True(t, content.Encoding == "base64" || len(content.Text) == 10)
+}
@@ -0,0 +1,242 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// targetModeReflector fetches an origin echoing back the request headers it received
+const targetModeReflector = "reflector"
+
+const (
+	headerRuleAbsent    = "absent"
+	headerRulePresent   = "present"
+	headerRuleUnchanged = "unchanged"
+	headerRuleMatch     = "match"
+	headerRuleNotMatch  = "not_match"
+
+	headerChangeAdded    = "added"
+	headerChangeStripped = "stripped"
+	headerChangeModified = "modified"
+)
+
+// auditIgnoredHeaders are hop-by-hop headers, which proxies are expected to
+// consume, and the W3C trace context headers of the traced probes, which the
+// proxies taking part in the traces rewrite
+var auditIgnoredHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Traceparent":         true,
+	"Tracestate":          true,
+}
+
+// HeaderRule is an expectation on a header received by the origin
+type HeaderRule struct {
+	Header string `yaml:"header"`
+	// Rule is one of absent, present, unchanged, match and not_match
+	Rule string `yaml:"rule"`
+	// Pattern is the regex of the match and not_match rules
+	Pattern string `yaml:"pattern,omitempty"`
+}
+
+// verifyHeaderRule ensures that a header rule is valid
+func verifyHeaderRule(r HeaderRule) error {
+	if r.Header == "" {
+		return fmt.Errorf("header rule: header must be provided")
+	}
+	switch r.Rule {
+	case headerRuleAbsent, headerRulePresent, headerRuleUnchanged:
+	case headerRuleMatch, headerRuleNotMatch:
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			return fmt.Errorf("header rule %q: invalid pattern: %s", r.Header, err)
+		}
+	default:
+		return fmt.Errorf("header rule %q: unknown rule %q", r.Header, r.Rule)
+	}
+	return nil
+}
+
+// check reports whether the headers received by the origin satisfy the rule
+func (r HeaderRule) check(sent, received http.Header) bool {
+	name := http.CanonicalHeaderKey(r.Header)
+	values, present := received[name]
+	switch r.Rule {
+	case headerRuleAbsent:
+		return !present
+	case headerRulePresent:
+		return present
+	case headerRuleUnchanged:
+		return strings.Join(values, ", ") == strings.Join(sent[name], ", ")
+	case headerRuleMatch, headerRuleNotMatch:
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return false
+		}
+		matched := false
+		for _, v := range values {
+			if re.MatchString(v) {
+				matched = true
+				break
+			}
+		}
+		return matched == (r.Rule == headerRuleMatch)
+	}
+	return false
+}
+
+// reflectedHeaders parses the headers echoed back by the origin, as a JSON
+// document with a "headers" object of strings or lists of strings
+func reflectedHeaders(body []byte) (http.Header, error) {
+	var doc struct {
+		Headers map[string]interface{} `json:"headers"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("could not parse reflected headers: %s", err)
+	}
+	if doc.Headers == nil {
+		return nil, fmt.Errorf("no headers found in reflected response")
+	}
+
+	h := http.Header{}
+	for name, v := range doc.Headers {
+		switch value := v.(type) {
+		case string:
+			// some reflectors join repeated headers
+			h.Add(name, value)
+		case []interface{}:
+			for _, item := range value {
+				h.Add(name, fmt.Sprint(item))
+			}
+		}
+	}
+	return h, nil
+}
+
+// sentHeaders returns the headers of the request as put on the wire,
+// including the ones added by the transport
+func sentHeaders(req *http.Request) http.Header {
+	h := req.Header.Clone()
+	if h.Get("User-Agent") == "" {
+		h.Set("User-Agent", "Go-http-client/1.1")
+	}
+	if h.Get("Accept-Encoding") == "" {
+		h.Set("Accept-Encoding", "gzip")
+	}
+	return h
+}
+
+// headerChanges lists the headers added, stripped or modified between the request and the origin
+func headerChanges(sent, received http.Header) map[string]string {
+	changes := make(map[string]string)
+	for name, values := range received {
+		if auditIgnoredHeaders[name] {
+			continue
+		}
+		sentValues, ok := sent[name]
+		if !ok {
+			changes[name] = headerChangeAdded
+		} else if strings.Join(values, ", ") != strings.Join(sentValues, ", ") {
+			changes[name] = headerChangeModified
+		}
+	}
+	for name := range sent {
+		if auditIgnoredHeaders[name] {
+			continue
+		}
+		if _, ok := received[name]; !ok {
+			changes[name] = headerChangeStripped
+		}
+	}
+	return changes
+}
+
+// headerAuditSeries are the label values exported by the last audit of a (proxy, target) pair
+type headerAuditSeries struct {
+	present    [][]string
+	changes    [][]string
+	violations [][]string
+}
+
+// onHeaderAudit exposes the headers the proxy added, stripped or modified and
+// the header rules it violated
+func (e *Exporter) onHeaderAudit(proxyURL string, target Target, req *http.Request, body []byte, rules []HeaderRule) {
+	received, err := reflectedHeaders(body)
+	if err != nil {
+		log.Warnf("req to %q via %q: %s", target.URL, proxyURL, err)
+		return
+	}
+	sent := sentHeaders(req)
+	changes := headerChanges(sent, received)
+
+	var series headerAuditSeries
+
+	// presence of the headers under audit: the ones with rules and the ones which changed
+	audited := make(map[string]bool)
+	for _, r := range rules {
+		audited[http.CanonicalHeaderKey(r.Header)] = true
+	}
+	for name := range changes {
+		audited[name] = true
+	}
+	names := make([]string, 0, len(audited))
+	for name := range audited {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		_, present := received[name]
+		labels := []string{proxyURL, target.URL, name}
+		e.metrics.proxyHeaderPresent.WithLabelValues(labels...).Set(boolToFloat(present))
+		series.present = append(series.present, labels)
+	}
+
+	for name, change := range changes {
+		labels := []string{proxyURL, target.URL, name, change}
+		e.metrics.proxyHeaderChange.WithLabelValues(labels...).Set(1)
+		series.changes = append(series.changes, labels)
+	}
+
+	for _, r := range rules {
+		ok := r.check(sent, received)
+		if !ok {
+			log.Warnf("req to %q via %q: header %q violates rule %q", target.URL, proxyURL, r.Header, r.Rule)
+		}
+		labels := []string{proxyURL, target.URL, http.CanonicalHeaderKey(r.Header), r.Rule}
+		e.metrics.proxyHeaderRuleViolation.WithLabelValues(labels...).Set(boolToFloat(!ok))
+		series.violations = append(series.violations, labels)
+	}
+
+	// remove the series of the previous audit which are not exported anymore
+	key := pairKey{proxyURL, target.URL}
+	e.headerAuditsMu.Lock()
+	defer e.headerAuditsMu.Unlock()
+	last := e.headerAudits[key]
+	deleteStaleSeries(e.metrics.proxyHeaderPresent.DeleteLabelValues, last.present, series.present)
+	deleteStaleSeries(e.metrics.proxyHeaderChange.DeleteLabelValues, last.changes, series.changes)
+	deleteStaleSeries(e.metrics.proxyHeaderRuleViolation.DeleteLabelValues, last.violations, series.violations)
+	e.headerAudits[key] = series
+}
+
+func deleteStaleSeries(del func(...string) bool, last, current [][]string) {
+	kept := make(map[string]bool, len(current))
+	for _, labels := range current {
+		kept[strings.Join(labels, "\x00")] = true
+	}
+	for _, labels := range last {
+		if !kept[strings.Join(labels, "\x00")] {
+			del(labels...)
+		}
+	}
+}
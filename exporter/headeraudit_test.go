@@ -0,0 +1,103 @@
+package exporter
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+	"github.com/criteo/http-proxy-exporter/proxytest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderRules(t *testing.T) {
+	sent := http.Header{"User-Agent": []string{"Go-http-client/1.1"}}
+	received := http.Header{
+		"User-Agent":      []string{"Go-http-client/1.1"},
+		"X-Forwarded-For": []string{"10.1.2.3"},
+	}
+
+	for _, tc := range []struct {
+		rule HeaderRule
+		ok   bool
+	}{
+		{HeaderRule{Header: "via", Rule: headerRuleAbsent}, true},
+		{HeaderRule{Header: "x-forwarded-for", Rule: headerRuleAbsent}, false},
+		{HeaderRule{Header: "X-Forwarded-For", Rule: headerRulePresent}, true},
+		{HeaderRule{Header: "User-Agent", Rule: headerRuleUnchanged}, true},
+		{HeaderRule{Header: "X-Forwarded-For", Rule: headerRuleUnchanged}, false},
+		{HeaderRule{Header: "X-Forwarded-For", Rule: headerRuleNotMatch, Pattern: `^10\.`}, false},
+		{HeaderRule{Header: "X-Forwarded-For", Rule: headerRuleMatch, Pattern: `^10\.`}, true},
+	} {
+		require.NoError(t, verifyHeaderRule(tc.rule))
+		require.Equal(t, tc.ok, tc.rule.check(sent, received), "%+v", tc.rule)
+	}
+
+	require.Error(t, verifyHeaderRule(HeaderRule{Header: "Via", Rule: "forbidden"}))
+	require.Error(t, verifyHeaderRule(HeaderRule{Header: "Via", Rule: headerRuleMatch, Pattern: "("}))
+	require.Error(t, verifyHeaderRule(HeaderRule{Rule: headerRuleAbsent}))
+}
+
+func TestReflectedHeaders(t *testing.T) {
+	h, err := reflectedHeaders([]byte(`{"headers": {"Via": "1.1 squid", "X-Multi": ["a", "b"]}}`))
+	require.NoError(t, err)
+	require.Equal(t, "1.1 squid", h.Get("Via"))
+	require.Equal(t, []string{"a", "b"}, h.Values("X-Multi"))
+
+	_, err = reflectedHeaders([]byte(`<html></html>`))
+	require.Error(t, err)
+	_, err = reflectedHeaders([]byte(`{"ip": "127.0.0.1"}`))
+	require.Error(t, err)
+}
+
+func TestProxyHeaderAudit(t *testing.T) {
+	proxyURL, done := runFakeProxy(t, false, proxytest.Config{SetHeaders: map[string]string{
+		"Via":             "1.1 proxy",
+		"X-Forwarded-For": "10.1.2.3",
+	}})
+	defer done()
+
+	reflectorURL, done := runReflector(t, false)
+	defer done()
+	originURL := reflectorURL + "/headers"
+
+	e := newTestExporter(t, Config{HeaderRules: []HeaderRule{
+		{Header: "Via", Rule: headerRuleAbsent},
+		{Header: "X-Forwarded-For", Rule: headerRuleNotMatch, Pattern: `^10\.`},
+		{Header: "User-Agent", Rule: headerRuleUnchanged},
+	}})
+
+	e.measureOne(proxyURL, Target{URL: originURL, Mode: targetModeReflector}, &proxyclient.AuthMethod{})
+
+	require.Equal(t, 1.0, testutil.ToFloat64(e.metrics.proxyHeaderPresent.WithLabelValues(proxyURL, originURL, "Via")))
+	require.Equal(t, 1.0, testutil.ToFloat64(e.metrics.proxyHeaderPresent.WithLabelValues(proxyURL, originURL, "User-Agent")))
+	require.Equal(t, 1.0, testutil.ToFloat64(e.metrics.proxyHeaderChange.WithLabelValues(proxyURL, originURL, "Via", headerChangeAdded)))
+	require.Equal(t, 1.0, testutil.ToFloat64(e.metrics.proxyHeaderChange.WithLabelValues(proxyURL, originURL, "X-Forwarded-For", headerChangeAdded)))
+
+	require.Equal(t, 1.0, testutil.ToFloat64(e.metrics.proxyHeaderRuleViolation.WithLabelValues(proxyURL, originURL, "Via", headerRuleAbsent)))
+	require.Equal(t, 1.0, testutil.ToFloat64(e.metrics.proxyHeaderRuleViolation.WithLabelValues(proxyURL, originURL, "X-Forwarded-For", headerRuleNotMatch)))
+	require.Equal(t, 0.0, testutil.ToFloat64(e.metrics.proxyHeaderRuleViolation.WithLabelValues(proxyURL, originURL, "User-Agent", headerRuleUnchanged)))
+}
+
+func TestProxyHeaderAuditTracing(t *testing.T) {
+	// the proxy joins the traces, with its own span as the parent
+	proxyURL, done := runFakeProxy(t, false, proxytest.Config{SetHeaders: map[string]string{
+		"Traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"Tracestate":  "proxy=00f067aa0ba902b7",
+	}})
+	defer done()
+
+	reflectorURL, done := runReflector(t, false)
+	defer done()
+	originURL := reflectorURL + "/headers"
+
+	_, endpoint, done := runOTLPCollector(t, false, "0")
+	defer done()
+
+	e := newTestExporter(t, Config{Tracing: OTLPConfig{Endpoint: endpoint, Interval: "1h"}})
+	e.measureOne(proxyURL, Target{URL: originURL, Mode: targetModeReflector}, &proxyclient.AuthMethod{})
+
+	records, _ := e.debug.last(proxyURL, originURL)
+	require.NotEmpty(t, records[0].RequestHeaders.Get("Traceparent"))
+	require.Equal(t, 0, testutil.CollectAndCount(e.metrics.proxyHeaderChange))
+}
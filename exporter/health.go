@@ -0,0 +1,186 @@
+package exporter
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	healthStateUp       = "up"
+	healthStateDegraded = "degraded"
+	healthStateDown     = "down"
+)
+
+var healthStates = []string{healthStateUp, healthStateDegraded, healthStateDown}
+
+// HealthConfig holds the thresholds driving the proxy health state machine
+type HealthConfig struct {
+	// DegradedAfter is the number of consecutive connection failures after which an up proxy is degraded
+	DegradedAfter int `yaml:"degraded_after,omitempty"`
+	// DownAfter is the number of consecutive connection failures after which a proxy is down
+	DownAfter int `yaml:"down_after,omitempty"`
+	// UpAfter is the number of consecutive connection successes after which a proxy is up again
+	UpAfter int `yaml:"up_after,omitempty"`
+}
+
+// withDefaults returns a copy of the configuration with unset thresholds replaced by defaults
+func (c HealthConfig) withDefaults() HealthConfig {
+	if c.DegradedAfter <= 0 {
+		c.DegradedAfter = 1
+	}
+	if c.DownAfter <= 0 {
+		c.DownAfter = 3
+	}
+	if c.UpAfter <= 0 {
+		c.UpAfter = 2
+	}
+	return c
+}
+
+// proxyHealth is the health state of a single proxy
+type proxyHealth struct {
+	state                string
+	consecutiveFailures  int
+	consecutiveSuccesses int
+	lastSuccess          time.Time
+	// wasDown is whether the proxy went down since it was last up
+	wasDown bool
+	// failingTargets holds the last connection failure of each target currently failing
+	failingTargets map[string]probeOutcome
+}
+
+// healthTransition describes a change of state of a proxy
+type healthTransition struct {
+	ProxyURL             string
+	From                 string
+	To                   string
+	Time                 time.Time
+	ConsecutiveFailures  int
+	ConsecutiveSuccesses int
+	LastSuccess          time.Time
+	FailingTargets       []probeOutcome
+	// Recovered is whether the proxy is up again after being down, possibly
+	// degraded in between
+	Recovered bool
+}
+
+// healthTracker derives the state of each proxy from its probe outcomes across all targets
+type healthTracker struct {
+	mu      sync.Mutex
+	config  HealthConfig
+	proxies map[string]*proxyHealth
+}
+
+func newHealthTracker(config HealthConfig) *healthTracker {
+	return &healthTracker{
+		config:  config.withDefaults(),
+		proxies: make(map[string]*proxyHealth),
+	}
+}
+
+// record updates the state of the proxy of the outcome and returns the
+// resulting transition, if any. Origin failures do not affect the proxy health.
+// A proxy is only up again once the last probe of each target connected.
+func (h *healthTracker) record(o probeOutcome) *healthTransition {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	p, ok := h.proxies[o.ProxyURL]
+	if !ok {
+		p = &proxyHealth{state: healthStateUp, failingTargets: make(map[string]probeOutcome)}
+		h.proxies[o.ProxyURL] = p
+	}
+
+	next := p.state
+	if o.ConnectionSuccess {
+		p.lastSuccess = o.Time
+		delete(p.failingTargets, o.TargetURL)
+		p.consecutiveFailures = 0
+		p.consecutiveSuccesses++
+		if p.state != healthStateUp && p.consecutiveSuccesses >= h.config.UpAfter {
+			// the proxy is not up while some targets still fail through it,
+			// which would otherwise flip its state on every interval
+			if len(p.failingTargets) == 0 {
+				next = healthStateUp
+			} else if p.state == healthStateDown {
+				next = healthStateDegraded
+			}
+		}
+	} else {
+		p.failingTargets[o.TargetURL] = o
+		p.consecutiveSuccesses = 0
+		p.consecutiveFailures++
+		if p.consecutiveFailures >= h.config.DownAfter {
+			next = healthStateDown
+		} else if p.state == healthStateUp && p.consecutiveFailures >= h.config.DegradedAfter {
+			next = healthStateDegraded
+		}
+	}
+
+	if next == p.state {
+		return nil
+	}
+
+	t := &healthTransition{
+		ProxyURL:             o.ProxyURL,
+		From:                 p.state,
+		To:                   next,
+		Time:                 o.Time,
+		ConsecutiveFailures:  p.consecutiveFailures,
+		ConsecutiveSuccesses: p.consecutiveSuccesses,
+		LastSuccess:          p.lastSuccess,
+		Recovered:            next == healthStateUp && p.wasDown,
+	}
+	for _, f := range p.failingTargets {
+		t.FailingTargets = append(t.FailingTargets, f)
+	}
+	sort.Slice(t.FailingTargets, func(i, j int) bool {
+		return t.FailingTargets[i].TargetURL < t.FailingTargets[j].TargetURL
+	})
+	p.state = next
+	switch next {
+	case healthStateDown:
+		p.wasDown = true
+	case healthStateUp:
+		p.wasDown = false
+	}
+	return t
+}
+
+// onHealthTransition exposes and logs a change of state of a proxy
+func (e *Exporter) onHealthTransition(t *healthTransition) {
+	e.setHealthState(t.ProxyURL, t.To)
+	e.metrics.proxyHealthTransitions.WithLabelValues(t.ProxyURL, t.From, t.To).Inc()
+
+	entry := log.WithFields(log.Fields{
+		"event":                 "proxy_state_change",
+		"proxy_url":             t.ProxyURL,
+		"from":                  t.From,
+		"to":                    t.To,
+		"consecutive_failures":  t.ConsecutiveFailures,
+		"consecutive_successes": t.ConsecutiveSuccesses,
+	})
+	if t.To == healthStateUp {
+		entry.Info("proxy health state changed")
+	} else {
+		entry.Warn("proxy health state changed")
+	}
+
+	if e.notifier != nil {
+		e.notifier.notify(t)
+	}
+}
+
+// setHealthState sets the state gauge of a proxy so that exactly one state is active
+func (e *Exporter) setHealthState(proxyURL, state string) {
+	for _, s := range healthStates {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		e.metrics.proxyHealthState.WithLabelValues(proxyURL, s).Set(value)
+	}
+}
@@ -0,0 +1,112 @@
+package exporter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthTrackerHysteresis(t *testing.T) {
+	proxyURL := "http://proxy:8080"
+	h := newHealthTracker(HealthConfig{DownAfter: 3, UpAfter: 2})
+
+	success := probeOutcome{Time: time.Now(), ProxyURL: proxyURL, ConnectionSuccess: true}
+	failure := probeOutcome{Time: time.Now(), ProxyURL: proxyURL}
+	originFailure := probeOutcome{Time: time.Now(), ProxyURL: proxyURL, ConnectionSuccess: true, RequestSuccess: false}
+
+	require.Nil(t, h.record(success))
+	require.Nil(t, h.record(originFailure))
+
+	tr := h.record(failure)
+	require.NotNil(t, tr)
+	require.Equal(t, healthStateUp, tr.From)
+	require.Equal(t, healthStateDegraded, tr.To)
+
+	require.Nil(t, h.record(failure))
+
+	tr = h.record(failure)
+	require.NotNil(t, tr)
+	require.Equal(t, healthStateDegraded, tr.From)
+	require.Equal(t, healthStateDown, tr.To)
+	require.Equal(t, 3, tr.ConsecutiveFailures)
+
+	// a single success is not enough to come back up
+	require.Nil(t, h.record(success))
+	require.Nil(t, h.record(failure))
+	require.Nil(t, h.record(success))
+
+	tr = h.record(success)
+	require.NotNil(t, tr)
+	require.Equal(t, healthStateDown, tr.From)
+	require.Equal(t, healthStateUp, tr.To)
+	require.True(t, tr.Recovered)
+}
+
+func TestHealthTrackerFailingTarget(t *testing.T) {
+	proxyURL := "http://proxy:8080"
+	h := newHealthTracker(HealthConfig{})
+
+	outcome := func(target string, success bool) probeOutcome {
+		return probeOutcome{Time: time.Now(), ProxyURL: proxyURL, TargetURL: target, ConnectionSuccess: success}
+	}
+
+	// one target keeps failing through the proxy while the others succeed
+	var transitions []*healthTransition
+	for i := 0; i < 10; i++ {
+		for _, o := range []probeOutcome{outcome("https://a/", true), outcome("https://b/", true), outcome("https://c/", false)} {
+			if tr := h.record(o); tr != nil {
+				transitions = append(transitions, tr)
+			}
+		}
+	}
+	require.Len(t, transitions, 1)
+	require.Equal(t, healthStateDegraded, transitions[0].To)
+
+	// the proxy is up once the failing target connects again
+	require.Nil(t, h.record(outcome("https://c/", true)))
+	tr := h.record(outcome("https://a/", true))
+	require.NotNil(t, tr)
+	require.Equal(t, healthStateUp, tr.To)
+	require.False(t, tr.Recovered)
+
+	// a down proxy working for some targets only is degraded
+	for i := 0; i < 3; i++ {
+		h.record(outcome("https://c/", false))
+	}
+	require.Nil(t, h.record(outcome("https://a/", true)))
+	tr = h.record(outcome("https://b/", true))
+	require.NotNil(t, tr)
+	require.Equal(t, healthStateDown, tr.From)
+	require.Equal(t, healthStateDegraded, tr.To)
+
+	// and recovers once the failing target connects, which is notified
+	tr = h.record(outcome("https://c/", true))
+	require.NotNil(t, tr)
+	require.Equal(t, healthStateDegraded, tr.From)
+	require.Equal(t, healthStateUp, tr.To)
+	require.True(t, tr.Recovered)
+	require.Equal(t, webhookEventProxyRecovered, newWebhookEvent(tr).Event)
+}
+
+func TestHealthTransitionMetrics(t *testing.T) {
+	e := newTestExporter(t, Config{})
+
+	proxyURL := "http://proxy:8080"
+	e.onHealthTransition(&healthTransition{ProxyURL: proxyURL, From: healthStateUp, To: healthStateDown})
+
+	requireCounter(t,
+		e.metrics.proxyHealthTransitions,
+		prometheus.Labels{"proxy_url": proxyURL, "from": healthStateUp, "to": healthStateDown},
+		1,
+	)
+
+	g, err := e.metrics.proxyHealthState.GetMetricWith(prometheus.Labels{"proxy_url": proxyURL, "state": healthStateDown})
+	require.NoError(t, err)
+	require.Equal(t, 1.0, testutil.ToFloat64(g))
+	g, err = e.metrics.proxyHealthState.GetMetricWith(prometheus.Labels{"proxy_url": proxyURL, "state": healthStateUp})
+	require.NoError(t, err)
+	require.Equal(t, 0.0, testutil.ToFloat64(g))
+}
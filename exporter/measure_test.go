@@ -0,0 +1,494 @@
+package exporter
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+	"github.com/criteo/http-proxy-exporter/proxytest"
+	"github.com/phayes/freeport"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+type srvFunc func(*testing.T, int) (string, func())
+
+func requireCounter(t *testing.T, counter *prometheus.CounterVec, labels prometheus.Labels, value float64) {
+	c, err := counter.GetMetricWith(labels)
+	require.NoError(t, err)
+
+	pb := &dto.Metric{}
+	c.Write(pb)
+	v := pb.GetCounter().GetValue()
+	require.Equal(t, value, v)
+}
+
+func runFakeProxy(t *testing.T, useTLS bool, c proxytest.Config) (string, func()) {
+	newProxy := proxytest.NewProxy
+	if useTLS {
+		newProxy = proxytest.NewTLSProxy
+	}
+	proxy, err := newProxy(c)
+	require.NoError(t, err)
+	return proxy.URL, func() { proxy.Close() }
+}
+
+// proxyStatus is the status injected by a fake proxy, which forwards the requests on 200
+func proxyStatus(code int) int {
+	if code == http.StatusOK {
+		return 0
+	}
+	return code
+}
+
+func runProxy(t *testing.T, code int) (string, func()) {
+	return runFakeProxy(t, false, proxytest.Config{StatusCode: proxyStatus(code)})
+}
+
+func runProxyTLS(t *testing.T, code int) (string, func()) {
+	return runFakeProxy(t, true, proxytest.Config{StatusCode: proxyStatus(code)})
+}
+
+func runReflector(t *testing.T, useTLS bool) (string, func()) {
+	newOrigin := proxytest.NewOrigin
+	if useTLS {
+		newOrigin = proxytest.NewTLSOrigin
+	}
+	origin, err := newOrigin(proxytest.Config{}, nil)
+	require.NoError(t, err)
+	return origin.URL, func() { origin.Close() }
+}
+
+func runOrigin(t *testing.T, resCode int) (string, func()) {
+	originURL, done := runReflector(t, false)
+	return fmt.Sprintf("%s/status/%d", originURL, resCode), done
+}
+
+func runOriginTLS(t *testing.T, resCode int) (string, func()) {
+	originURL, done := runReflector(t, true)
+	return fmt.Sprintf("%s/status/%d", originURL, resCode), done
+}
+
+var testMatrix = []struct {
+	proxyTLS  bool
+	originTLS bool
+}{
+	{
+		proxyTLS:  false,
+		originTLS: false,
+	},
+	{
+		proxyTLS:  true,
+		originTLS: false,
+	},
+	{
+		proxyTLS:  false,
+		originTLS: true,
+	},
+	{
+		proxyTLS:  true,
+		originTLS: true,
+	},
+}
+
+func testDoMatrix(t *testing.T, do func(
+	t *testing.T,
+	proxyFunc,
+	originFunc srvFunc)) {
+	for _, tc := range testMatrix {
+		name := fmt.Sprintf("proxy_tls=%v origin_tls=%v", tc.proxyTLS, tc.originTLS)
+		t.Run(name, func(t *testing.T) {
+			p := runProxy
+			if tc.proxyTLS {
+				p = runProxyTLS
+			}
+
+			o := runOrigin
+			if tc.originTLS {
+				o = runOriginTLS
+			}
+
+			do(t, p, o)
+		})
+	}
+}
+
+func newTestExporter(t *testing.T, config Config) *Exporter {
+	e, err := New(&config, Options{Registerer: prometheus.NewRegistry()})
+	require.NoError(t, err)
+	return e
+}
+
+func TestProxyOK(t *testing.T) {
+	testDoMatrix(t, func(t *testing.T, proxy, origin srvFunc) {
+		e := newTestExporter(t, Config{})
+
+		proxyURL, done := runProxy(t, 200)
+		defer done()
+
+		originURL, done := runOrigin(t, 200)
+		defer done()
+
+		e.measureOne(proxyURL, Target{URL: originURL, Insecure: true}, &proxyclient.AuthMethod{})
+
+		requireCounter(t,
+			e.metrics.proxyConnectionSuccesses,
+			prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL},
+			1,
+		)
+		requireCounter(t,
+			e.metrics.proxyConnectionErrors,
+			prometheus.Labels{"proxy_url": proxyURL, "cause": proxyConnectionErrorCauseProxy, "resource_url": originURL},
+			0,
+		)
+		requireCounter(t,
+			e.metrics.proxyRequestTotal,
+			prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL},
+			1,
+		)
+		requireCounter(t,
+			e.metrics.proxyRequestsSuccesses,
+			prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL, "status_code": "200"},
+			1,
+		)
+		requireCounter(t,
+			e.metrics.proxyRequestsFailures,
+			prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL},
+			0,
+		)
+	})
+}
+
+func TestProxyOKAuth(t *testing.T) {
+	testDoMatrix(t, func(t *testing.T, proxy, origin srvFunc) {
+		e := newTestExporter(t, Config{})
+
+		proxyURL, done := runProxy(t, 200)
+		defer done()
+
+		originURL, done := runOrigin(t, 200)
+		defer done()
+
+		u, _ := url.Parse(proxyURL)
+		u.User = url.UserPassword("user", "secret_pass")
+		proxyURL = u.String()
+		u.User = nil
+		proxyURLMetrics := u.String()
+
+		e.measureOne(proxyURL, Target{URL: originURL, Insecure: true}, &proxyclient.AuthMethod{})
+
+		requireCounter(t,
+			e.metrics.proxyConnectionSuccesses,
+			prometheus.Labels{"proxy_url": proxyURLMetrics, "resource_url": originURL},
+			1,
+		)
+		requireCounter(t,
+			e.metrics.proxyConnectionErrors,
+			prometheus.Labels{"proxy_url": proxyURLMetrics, "cause": proxyConnectionErrorCauseProxy, "resource_url": originURL},
+			0,
+		)
+		requireCounter(t,
+			e.metrics.proxyRequestTotal,
+			prometheus.Labels{"proxy_url": proxyURLMetrics, "resource_url": originURL},
+			1,
+		)
+		requireCounter(t,
+			e.metrics.proxyRequestsSuccesses,
+			prometheus.Labels{"proxy_url": proxyURLMetrics, "resource_url": originURL, "status_code": "200"},
+			1,
+		)
+		requireCounter(t,
+			e.metrics.proxyRequestsFailures,
+			prometheus.Labels{"proxy_url": proxyURLMetrics, "resource_url": originURL},
+			0,
+		)
+	})
+}
+
+func TestProxyNoProxy(t *testing.T) {
+	e := newTestExporter(t, Config{})
+
+	originURL, done := runOrigin(t, 200)
+	defer done()
+
+	proxyURL := ""
+
+	e.measureOne(proxyURL, Target{URL: originURL, Insecure: true}, &proxyclient.AuthMethod{})
+
+	requireCounter(t,
+		e.metrics.proxyConnectionSuccesses,
+		prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL},
+		1,
+	)
+	requireCounter(t,
+		e.metrics.proxyConnectionErrors,
+		prometheus.Labels{"proxy_url": proxyURL, "cause": proxyConnectionErrorCauseProxy, "resource_url": originURL},
+		0,
+	)
+	requireCounter(t,
+		e.metrics.proxyRequestTotal,
+		prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL},
+		1,
+	)
+	requireCounter(t,
+		e.metrics.proxyRequestsSuccesses,
+		prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL, "status_code": "200"},
+		1,
+	)
+	requireCounter(t,
+		e.metrics.proxyRequestsFailures,
+		prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL},
+		0,
+	)
+}
+
+func TestProxyResolveFailure(t *testing.T) {
+	e := newTestExporter(t, Config{})
+
+	proxyURL := "http://i_do_not_exist.local"
+	originURL := "http://i_wont_get_called"
+
+	e.measureOne(proxyURL, Target{URL: originURL, Insecure: true}, &proxyclient.AuthMethod{})
+
+	requireCounter(t,
+		e.metrics.proxyConnectionSuccesses,
+		prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL},
+		0,
+	)
+	requireCounter(t,
+		e.metrics.proxyConnectionErrors,
+		prometheus.Labels{"proxy_url": proxyURL, "cause": proxyConnectionErrorCauseLookup, "resource_url": originURL},
+		1,
+	)
+}
+
+func TestProxyInvalidURL(t *testing.T) {
+	e := newTestExporter(t, Config{})
+
+	originURL := "http://i_wont_get_called"
+	o := e.measureOne("http://user:secret@[::1", Target{URL: originURL}, &proxyclient.AuthMethod{})
+	require.NotContains(t, o.Error, "secret")
+
+	requireCounter(t,
+		e.metrics.proxyConnectionErrors,
+		prometheus.Labels{"proxy_url": invalidProxy, "cause": proxyConnectionErrorCauseLookup, "resource_url": originURL},
+		1,
+	)
+}
+
+func TestProxyBadProxy502(t *testing.T) {
+	testDoMatrix(t, func(t *testing.T, proxy, origin srvFunc) {
+		e := newTestExporter(t, Config{})
+
+		proxyURL, done := runProxy(t, 502)
+		defer done()
+
+		originURL, done := runOrigin(t, 200)
+		defer done()
+
+		e.measureOne(proxyURL, Target{URL: originURL, Insecure: true}, &proxyclient.AuthMethod{})
+
+		requireCounter(t,
+			e.metrics.proxyConnectionSuccesses,
+			prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL},
+			0,
+		)
+		requireCounter(t,
+			e.metrics.proxyConnectionErrors,
+			prometheus.Labels{"proxy_url": proxyURL, "cause": "proxy", "resource_url": originURL},
+			1,
+		)
+	})
+}
+
+func TestProxyBadOrigin502(t *testing.T) {
+	testDoMatrix(t, func(t *testing.T, proxy, origin srvFunc) {
+		e := newTestExporter(t, Config{})
+
+		proxyURL, done := runProxy(t, 200)
+		defer done()
+
+		originURL, done := runOrigin(t, 502)
+		defer done()
+
+		e.measureOne(proxyURL, Target{URL: originURL, Insecure: true}, &proxyclient.AuthMethod{})
+
+		requireCounter(t,
+			e.metrics.proxyConnectionSuccesses,
+			prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL},
+			0,
+		)
+		requireCounter(t,
+			e.metrics.proxyConnectionErrors,
+			prometheus.Labels{"proxy_url": proxyURL, "cause": "proxy", "resource_url": originURL},
+			1,
+		)
+	})
+}
+
+func TestProxyBadOrigin500(t *testing.T) {
+	testDoMatrix(t, func(t *testing.T, proxy, origin srvFunc) {
+		e := newTestExporter(t, Config{})
+
+		proxyURL, done := runProxy(t, 200)
+		defer done()
+
+		originURL, done := runOrigin(t, 500)
+		defer done()
+
+		e.measureOne(proxyURL, Target{URL: originURL, Insecure: true}, &proxyclient.AuthMethod{})
+
+		requireCounter(t,
+			e.metrics.proxyConnectionSuccesses,
+			prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL},
+			1,
+		)
+		requireCounter(t,
+			e.metrics.proxyConnectionErrors,
+			prometheus.Labels{"proxy_url": proxyURL, "cause": proxyConnectionErrorCauseProxy, "resource_url": originURL},
+			0,
+		)
+		requireCounter(t,
+			e.metrics.proxyRequestTotal,
+			prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL},
+			1,
+		)
+		requireCounter(t,
+			e.metrics.proxyRequestsSuccesses,
+			prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL, "status_code": "500"},
+			1,
+		)
+		requireCounter(t,
+			e.metrics.proxyRequestsFailures,
+			prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL},
+			0,
+		)
+	})
+}
+
+func TestProxyBadOriginRST(t *testing.T) {
+	testDoMatrix(t, func(t *testing.T, proxy, origin srvFunc) {
+		e := newTestExporter(t, Config{})
+
+		proxyURL, done := runProxy(t, 200)
+		defer done()
+
+		originPort, err := freeport.GetFreePort()
+		require.NoError(t, err)
+
+		originURL := fmt.Sprintf("http://127.0.0.1:%d", originPort)
+
+		e.measureOne(proxyURL, Target{URL: originURL, Insecure: true}, &proxyclient.AuthMethod{})
+
+		requireCounter(t,
+			e.metrics.proxyConnectionSuccesses,
+			prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL},
+			1,
+		)
+		requireCounter(t,
+			e.metrics.proxyConnectionErrors,
+			prometheus.Labels{"proxy_url": proxyURL, "cause": proxyConnectionErrorCauseProxy, "resource_url": originURL},
+			0,
+		)
+		requireCounter(t,
+			e.metrics.proxyRequestTotal,
+			prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL},
+			1,
+		)
+		// this particular proxy returns a 500 on origin RST
+		requireCounter(t,
+			e.metrics.proxyRequestsSuccesses,
+			prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL, "status_code": "500"},
+			1,
+		)
+		requireCounter(t,
+			e.metrics.proxyRequestsFailures,
+			prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL},
+			0,
+		)
+	})
+}
+
+func TestProxyAuthRequired(t *testing.T) {
+	for _, tc := range testMatrix {
+		t.Run(fmt.Sprintf("proxy_tls=%v origin_tls=%v", tc.proxyTLS, tc.originTLS), func(t *testing.T) {
+			testProxyAuthRequired(t, tc.proxyTLS, tc.originTLS)
+		})
+	}
+}
+
+func testProxyAuthRequired(t *testing.T, proxyTLS, originTLS bool) {
+	e := newTestExporter(t, Config{})
+
+	origin := runOrigin
+	if originTLS {
+		origin = runOriginTLS
+	}
+	for _, scheme := range []string{proxytest.AuthBasic, proxytest.AuthNTLM} {
+		proxyURL, done := runFakeProxy(t, proxyTLS, proxytest.Config{Auth: &proxytest.Auth{Scheme: scheme}})
+		defer done()
+
+		originURL, done := origin(t, 200)
+		defer done()
+
+		e.measureOne(proxyURL, Target{URL: originURL, Insecure: true}, &proxyclient.AuthMethod{})
+
+		requireCounter(t,
+			e.metrics.proxyConnectionErrors,
+			prometheus.Labels{"proxy_url": proxyURL, "cause": proxyConnectionErrorCauseProxy, "resource_url": originURL},
+			1,
+		)
+	}
+
+	// only the right credentials are accepted
+	auth := &proxytest.Auth{Scheme: proxytest.AuthBasic, Username: "user", Password: "secret"}
+	proxyURL, done := runFakeProxy(t, proxyTLS, proxytest.Config{Auth: auth})
+	defer done()
+	originURL, done := origin(t, 200)
+	defer done()
+	for _, password := range []string{"wrong", "secret"} {
+		e.measureOne(proxyURL, Target{URL: originURL, Insecure: true}, &proxyclient.AuthMethod{
+			Type:   "basic",
+			Params: map[string]string{"username": "user", "password": password},
+		})
+	}
+	labels := prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL}
+	requireCounter(t, e.metrics.proxyConnectionSuccesses, labels, 1)
+	requireCounter(t, e.metrics.proxyConnectionErrors, prometheus.Labels{"proxy_url": proxyURL, "cause": proxyConnectionErrorCauseProxy, "resource_url": originURL}, 1)
+}
+
+func requireHistogramCount(t *testing.T, histogram *prometheus.HistogramVec, labels prometheus.Labels, count uint64) {
+	h, err := histogram.GetMetricWith(labels)
+	require.NoError(t, err)
+
+	pb := &dto.Metric{}
+	h.(prometheus.Metric).Write(pb)
+	require.Equal(t, count, pb.GetHistogram().GetSampleCount())
+}
+
+func TestKeepAlive(t *testing.T) {
+	testDoMatrix(t, func(t *testing.T, proxy, origin srvFunc) {
+		e := newTestExporter(t, Config{})
+		defer e.prober.CloseIdleConnections()
+
+		proxyURL, done := proxy(t, 200)
+		defer done()
+
+		originURL, done := origin(t, 200)
+		defer done()
+
+		target := Target{URL: originURL, Insecure: true, KeepAlive: true}
+		for i := 0; i < 3; i++ {
+			e.measureOne(proxyURL, target, &proxyclient.AuthMethod{})
+		}
+
+		labels := prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL}
+		labels["connection"] = keepAliveConnectionCold
+		requireHistogramCount(t, e.metrics.proxyKeepAliveDurations, labels, 1)
+		labels["connection"] = keepAliveConnectionWarm
+		requireHistogramCount(t, e.metrics.proxyKeepAliveDurations, labels, 2)
+	})
+}
@@ -0,0 +1,303 @@
+package exporter
+
+import (
+	"net/url"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	proxyConnectionErrorCauseLookup = "lookup"
+	proxyConnectionErrorCauseProxy  = "proxy"
+	// the proxy of the environment could not be picked
+	proxyConnectionErrorCauseSystem = "system"
+	// the request could not be prepared, e.g. from an invalid target URL
+	proxyConnectionErrorCausePrepare = "prepare"
+
+	keepAliveConnectionCold = "cold"
+	keepAliveConnectionWarm = "warm"
+)
+
+// metrics are the collectors of an exporter
+type metrics struct {
+	proxyConnectionTentatives *prometheus.CounterVec
+	proxyConnectionSuccesses  *prometheus.CounterVec
+	proxyConnectionErrors     *prometheus.CounterVec
+	proxyRequestTotal         *prometheus.CounterVec
+	proxyRequestsSuccesses    *prometheus.CounterVec
+	proxyRequestsFailures     *prometheus.CounterVec
+
+	proxyRequestsDurations  *prometheus.HistogramVec
+	proxyKeepAliveDurations *prometheus.HistogramVec
+
+	proxyBurstDurations   *prometheus.GaugeVec
+	proxyBurstFailures    *prometheus.GaugeVec
+	proxyBurstDegradation *prometheus.GaugeVec
+
+	proxyHealthState       *prometheus.GaugeVec
+	proxyHealthTransitions *prometheus.CounterVec
+
+	proxyPolicyBlocked    *prometheus.GaugeVec
+	proxyPolicyCompliance *prometheus.GaugeVec
+
+	proxyEgressIPMatch *prometheus.GaugeVec
+	proxyEgressIPInfo  *prometheus.GaugeVec
+
+	proxyHeaderPresent       *prometheus.GaugeVec
+	proxyHeaderChange        *prometheus.GaugeVec
+	proxyHeaderRuleViolation *prometheus.GaugeVec
+
+	proxySystemSelected       *prometheus.GaugeVec
+	proxySystemBypass         *prometheus.GaugeVec
+	proxySystemBypassExpected *prometheus.GaugeVec
+
+	pacDecision      *prometheus.GaugeVec
+	pacSelectedProxy *prometheus.GaugeVec
+	pacChainFailures *prometheus.CounterVec
+	pacErrors        *prometheus.CounterVec
+
+	webhookNotifications *prometheus.CounterVec
+
+	sinkResultsWritten *prometheus.CounterVec
+	sinkResultsDropped *prometheus.CounterVec
+	sinkWriteErrors    *prometheus.CounterVec
+
+	otlpPushes *prometheus.CounterVec
+
+	tracingExports *prometheus.CounterVec
+	tracingDropped prometheus.Counter
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		proxyConnectionTentatives: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_connection_tentatives_total",
+			Help: "Total number of tentatives (including proxy connection errors).",
+		}, []string{"proxy_url", "resource_url"}),
+		proxyConnectionSuccesses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_connection_successes_total",
+			Help: "Number of successful connections towards proxy.",
+		}, []string{"proxy_url", "resource_url"}),
+		proxyConnectionErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_connection_errors_total",
+			Help: "Number of connection errors towards proxy.",
+		}, []string{"proxy_url", "cause", "resource_url"}),
+		proxyRequestTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_requests_total",
+			Help: "Total number of requests sent to proxy",
+		}, []string{"proxy_url", "resource_url"}),
+		proxyRequestsSuccesses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_requests_successes_total",
+			Help: "Number of successful requests.",
+		}, []string{"proxy_url", "resource_url", "status_code"}),
+		proxyRequestsFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_requests_failure_total",
+			Help: "Number of failed requests.",
+		}, []string{"proxy_url", "resource_url"}),
+
+		proxyRequestsDurations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "proxy_requests_rtt_seconds",
+			Help:    "Histogram of requests durations.",
+			Buckets: []float64{.0025, .005, .0075, .01, .0125, .015, .0175, .02, .025, .035, .05, .075, .1, .2, .5, 1},
+		}, []string{"proxy_url", "resource_url"}),
+		proxyKeepAliveDurations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "proxy_keepalive_rtt_seconds",
+			Help:    "Histogram of requests durations of keepalive targets, on new (cold) or reused (warm) connections.",
+			Buckets: []float64{.0025, .005, .0075, .01, .0125, .015, .0175, .02, .025, .035, .05, .075, .1, .2, .5, 1},
+		}, []string{"proxy_url", "resource_url", "connection"}),
+
+		proxyBurstDurations: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_burst_duration_seconds",
+			Help: "Min, max and 95th percentile of the durations of the successful requests of the last concurrent burst.",
+		}, []string{"proxy_url", "resource_url", "stat"}),
+		proxyBurstFailures: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_burst_failures",
+			Help: "Number of failed requests of the last concurrent burst.",
+		}, []string{"proxy_url", "resource_url"}),
+		proxyBurstDegradation: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_burst_degradation_ratio",
+			Help: "95th percentile of the durations of the last concurrent burst over the duration of the single request before it.",
+		}, []string{"proxy_url", "resource_url"}),
+
+		proxyHealthState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_health_state",
+			Help: "Health state of the proxy (1 for the current state, 0 otherwise).",
+		}, []string{"proxy_url", "state"}),
+		proxyHealthTransitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_health_transitions_total",
+			Help: "Number of health state transitions of the proxy.",
+		}, []string{"proxy_url", "from", "to"}),
+
+		proxyPolicyBlocked: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_policy_blocked",
+			Help: "Whether the proxy blocked the target (1) or not (0).",
+		}, []string{"proxy_url", "resource_url"}),
+		proxyPolicyCompliance: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_policy_compliance",
+			Help: "Whether the proxy blocked or allowed the target as expected (1) or not (0).",
+		}, []string{"proxy_url", "resource_url", "expect"}),
+
+		proxyEgressIPMatch: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_egress_ip_match",
+			Help: "Whether the egress IP observed through the proxy is one of its expected egress IPs (1) or not (0).",
+		}, []string{"proxy_url", "resource_url"}),
+		proxyEgressIPInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_egress_ip_info",
+			Help: "Egress IP observed through the proxy.",
+		}, []string{"proxy_url", "resource_url", "ip"}),
+
+		proxyHeaderPresent: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_header_present",
+			Help: "Whether the header was received by the origin through the proxy (1) or not (0).",
+		}, []string{"proxy_url", "resource_url", "header"}),
+		proxyHeaderChange: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_header_change",
+			Help: "Header added, stripped or modified by the proxy.",
+		}, []string{"proxy_url", "resource_url", "header", "change"}),
+		proxyHeaderRuleViolation: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_header_rule_violation",
+			Help: "Whether the headers received by the origin through the proxy violate the rule (1) or not (0).",
+		}, []string{"proxy_url", "resource_url", "header", "rule"}),
+
+		proxySystemSelected: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_system_selected",
+			Help: "Proxy picked by the environment (HTTP_PROXY, HTTPS_PROXY, NO_PROXY) for the target (empty for direct).",
+		}, []string{"resource_url", "proxy_url"}),
+		proxySystemBypass: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_system_bypass",
+			Help: "Whether the target bypasses the system proxy (1) or not (0).",
+		}, []string{"resource_url"}),
+		proxySystemBypassExpected: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_system_bypass_expected",
+			Help: "Whether the system proxy bypass of the target matches its expect_bypass setting (1) or not (0).",
+		}, []string{"resource_url"}),
+
+		pacDecision: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "pac_decision",
+			Help: "Current PAC decision (FindProxyForURL result) for the target.",
+		}, []string{"resource_url", "decision"}),
+		pacSelectedProxy: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "pac_selected_proxy",
+			Help: "Proxy of the PAC decision which was used to reach the target (empty for DIRECT).",
+		}, []string{"resource_url", "decision", "proxy_url"}),
+		pacChainFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pac_chain_failures_total",
+			Help: "Number of probes for which no proxy of the PAC decision could be connected to.",
+		}, []string{"resource_url", "decision"}),
+		pacErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pac_errors_total",
+			Help: "Number of PAC file errors by stage (fetch, parse, evaluate).",
+		}, []string{"stage"}),
+
+		webhookNotifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_notifications_total",
+			Help: "Number of webhook notifications by event and result.",
+		}, []string{"event", "result"}),
+
+		sinkResultsWritten: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sink_results_written_total",
+			Help: "Number of probe results written to a sink.",
+		}, []string{"sink"}),
+		sinkResultsDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sink_results_dropped_total",
+			Help: "Number of probe results dropped because the buffer of a sink was full.",
+		}, []string{"sink"}),
+		sinkWriteErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sink_write_errors_total",
+			Help: "Number of probe results which could not be written to a sink.",
+		}, []string{"sink"}),
+
+		otlpPushes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "otlp_pushes_total",
+			Help: "Number of pushes of the metrics to the OpenTelemetry collector by result.",
+		}, []string{"result"}),
+
+		tracingExports: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tracing_exports_total",
+			Help: "Number of exports of batches of probe traces to the OpenTelemetry collector by result.",
+		}, []string{"result"}),
+		tracingDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tracing_traces_dropped_total",
+			Help: "Number of probe traces dropped because the export queue was full.",
+		}),
+	}
+}
+
+// collectors returns all the collectors of the metrics, to register them
+func (m *metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.proxyConnectionTentatives,
+		m.proxyConnectionSuccesses,
+		m.proxyConnectionErrors,
+		m.proxyRequestTotal,
+		m.proxyRequestsSuccesses,
+		m.proxyRequestsFailures,
+		m.proxyRequestsDurations,
+		m.proxyKeepAliveDurations,
+		m.proxyBurstDurations,
+		m.proxyBurstFailures,
+		m.proxyBurstDegradation,
+		m.proxyHealthState,
+		m.proxyHealthTransitions,
+		m.proxyPolicyBlocked,
+		m.proxyPolicyCompliance,
+		m.proxyEgressIPMatch,
+		m.proxyEgressIPInfo,
+		m.proxyHeaderPresent,
+		m.proxyHeaderChange,
+		m.proxyHeaderRuleViolation,
+		m.proxySystemSelected,
+		m.proxySystemBypass,
+		m.proxySystemBypassExpected,
+		m.pacDecision,
+		m.pacSelectedProxy,
+		m.pacChainFailures,
+		m.pacErrors,
+		m.webhookNotifications,
+		m.sinkResultsWritten,
+		m.sinkResultsDropped,
+		m.sinkWriteErrors,
+		m.otlpPushes,
+		m.tracingExports,
+		m.tracingDropped,
+	}
+}
+
+// initMetrics initializes the series of the proxies and targets, so that they are exported before the first probe
+func (e *Exporter) initMetrics(proxyURLs []string, targets []Target) error {
+	for _, p := range proxyURLs {
+		if p == systemProxy {
+			// the actual proxy is only known once picked for a target
+			continue
+		}
+		proxyURL, err := metricsProxyURL(p)
+		if err != nil {
+			return err
+		}
+
+		e.setHealthState(proxyURL, healthStateUp)
+
+		for _, target := range targets {
+			e.metrics.proxyConnectionTentatives.WithLabelValues(proxyURL, target.URL).Add(0)
+			e.metrics.proxyConnectionSuccesses.WithLabelValues(proxyURL, target.URL).Add(0)
+
+			e.metrics.proxyConnectionErrors.WithLabelValues(proxyURL, proxyConnectionErrorCauseLookup, target.URL).Add(0)
+			e.metrics.proxyConnectionErrors.WithLabelValues(proxyURL, proxyConnectionErrorCauseProxy, target.URL).Add(0)
+		}
+	}
+
+	return nil
+}
+
+// metricsProxyURL returns the proxy URL as exposed in metrics, without credentials
+func metricsProxyURL(proxy string) (string, error) {
+	if proxy == "" {
+		return "", nil
+	}
+	url, err := url.Parse(proxy)
+	if err != nil {
+		return "", err
+	}
+	url.User = nil
+	return url.String(), nil
+}
@@ -0,0 +1,419 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	otlpProtocolHTTP = "http"
+	otlpProtocolGRPC = "grpc"
+
+	otlpHTTPPath = "/v1/metrics"
+	otlpGRPCPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+	// otlpName is the default service name and the name of the instrumentation scope
+	otlpName = "http-proxy-exporter"
+
+	otlpResultSuccess = "success"
+	otlpResultFailure = "failure"
+
+	// aggregationTemporalityCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE of OTLP
+	aggregationTemporalityCumulative = 2
+)
+
+// OTLPConfig configures the push of the metrics to an OpenTelemetry collector
+type OTLPConfig struct {
+	// Endpoint is the URL of the collector, the push is disabled when empty
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// Protocol is http (OTLP/HTTP with protobuf) or grpc (OTLP/gRPC)
+	Protocol string            `yaml:"protocol,omitempty"`
+	Interval string            `yaml:"interval,omitempty"`
+	Timeout  string            `yaml:"timeout,omitempty"`
+	Headers  map[string]string `yaml:"headers,omitempty"`
+	// Insecure skips the verification of the certificate of the collector
+	Insecure           bool              `yaml:"insecure,omitempty"`
+	ResourceAttributes map[string]string `yaml:"resource_attributes,omitempty"`
+}
+
+// otlpClient sends the requests of a signal to a collector, over OTLP/HTTP or OTLP/gRPC
+type otlpClient struct {
+	url     string
+	grpc    bool
+	timeout time.Duration
+	headers map[string]string
+	client  *http.Client
+}
+
+// newOTLPClient returns the client of a collector, with the paths of the signal for each protocol
+func newOTLPClient(c OTLPConfig, httpPath, grpcPath string) (*otlpClient, error) {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid otlp endpoint %q, must be a http(s) URL", c.Endpoint)
+	}
+	timeout, err := parseDurationOr(c.Timeout, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid otlp timeout: %s", err)
+	}
+
+	oc := &otlpClient{timeout: timeout, headers: c.Headers}
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.Insecure}
+	switch c.Protocol {
+	case "", otlpProtocolHTTP:
+		if u.Path == "" || u.Path == "/" {
+			u.Path = httpPath
+		}
+		// the collector is not reached through the proxies of the environment
+		oc.client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	case otlpProtocolGRPC:
+		oc.grpc = true
+		u.Path = strings.TrimSuffix(u.Path, "/") + grpcPath
+		transport := &http2.Transport{TLSClientConfig: tlsConfig}
+		if u.Scheme == "http" {
+			// gRPC without TLS is HTTP/2 with prior knowledge
+			transport.AllowHTTP = true
+			transport.DialTLS = func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			}
+		}
+		oc.client = &http.Client{Transport: transport}
+	default:
+		return nil, fmt.Errorf("invalid otlp protocol %q, must be %q or %q", c.Protocol, otlpProtocolHTTP, otlpProtocolGRPC)
+	}
+	oc.url = u.String()
+	return oc, nil
+}
+
+// otlpResource returns the resource attributes of the configuration
+func otlpResource(c OTLPConfig, version string) map[string]string {
+	resource := map[string]string{"service.name": otlpName}
+	if version != "" {
+		resource["service.version"] = version
+	}
+	for k, v := range c.ResourceAttributes {
+		resource[k] = v
+	}
+	return resource
+}
+
+// otlpPusher pushes the metrics gathered from a registry to a collector
+type otlpPusher struct {
+	client   *otlpClient
+	interval time.Duration
+	resource map[string]string
+	version  string
+	start    time.Time
+
+	gatherer prometheus.Gatherer
+	// pushes counts the pushes by result
+	pushes *prometheus.CounterVec
+}
+
+func newOTLPPusher(c OTLPConfig, gatherer prometheus.Gatherer, pushes *prometheus.CounterVec, version string) (*otlpPusher, error) {
+	client, err := newOTLPClient(c, otlpHTTPPath, otlpGRPCPath)
+	if err != nil {
+		return nil, err
+	}
+	interval, err := parseDurationOr(c.Interval, 30*time.Second)
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid otlp interval %q", c.Interval)
+	}
+	return &otlpPusher{
+		client:   client,
+		interval: interval,
+		resource: otlpResource(c, version),
+		version:  version,
+		start:    time.Now(),
+		gatherer: gatherer,
+		pushes:   pushes,
+	}, nil
+}
+
+// run pushes the metrics every interval, and a last time once the context is done
+func (p *otlpPusher) run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			p.pushLogged(context.Background())
+			return
+		case <-ticker.C:
+			p.pushLogged(ctx)
+		}
+	}
+}
+
+func (p *otlpPusher) pushLogged(ctx context.Context) {
+	if err := p.push(ctx); err != nil {
+		log.Warnf("could not push metrics to %s: %s", p.client.url, err)
+		p.pushes.WithLabelValues(otlpResultFailure).Inc()
+		return
+	}
+	p.pushes.WithLabelValues(otlpResultSuccess).Inc()
+}
+
+// push sends the current value of the metrics to the collector
+func (p *otlpPusher) push(ctx context.Context) error {
+	families, err := p.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("could not gather metrics: %s", err)
+	}
+	return p.client.export(ctx, otlpMetricsRequest(families, p.resource, p.version, p.start, time.Now()))
+}
+
+// export sends an encoded request to the collector
+func (c *otlpClient) export(ctx context.Context, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	if c.grpc {
+		return c.exportGRPC(ctx, body)
+	}
+	return c.exportHTTP(ctx, body)
+}
+
+func (c *otlpClient) newRequest(ctx context.Context, body []byte, contentType string) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", contentType)
+	return req, nil
+}
+
+func (c *otlpClient) exportHTTP(ctx context.Context, body []byte) error {
+	req, err := c.newRequest(ctx, body, "application/x-protobuf")
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %q: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+func (c *otlpClient) exportGRPC(ctx context.Context, body []byte) error {
+	// a gRPC message is prefixed by its compression flag and its length
+	frame := make([]byte, 5, 5+len(body))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(body)))
+	req, err := c.newRequest(ctx, append(frame, body...), "application/grpc")
+	if err != nil {
+		return err
+	}
+	req.Header.Set("TE", "trailers")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	// the status is in the trailers, or in the headers of responses without a body
+	io.Copy(ioutil.Discard, resp.Body)
+	status, msg := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, msg = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		return fmt.Errorf("grpc status %q: %s", status, msg)
+	}
+	return nil
+}
+
+// otlpMetricsRequest encodes the metric families as an ExportMetricsServiceRequest:
+// the counters are cumulative monotonic sums, the gauges and untyped metrics
+// gauges, the histograms cumulative histograms and the summaries summaries.
+func otlpMetricsRequest(families []*dto.MetricFamily, resource map[string]string, version string, start, now time.Time) []byte {
+	startNano, nowNano := uint64(start.UnixNano()), uint64(now.UnixNano())
+
+	scope := appendMessage(nil, 1, otlpScope(version))
+	for _, mf := range families {
+		if len(mf.Metric) == 0 {
+			continue
+		}
+		var data []byte
+		var field protowire.Number
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			for _, m := range mf.Metric {
+				data = appendMessage(data, 1, numberDataPoint(m.Label, m.GetCounter().GetValue(), startNano, nowNano))
+			}
+			data = appendVarint(data, 2, aggregationTemporalityCumulative)
+			data = appendVarint(data, 3, 1)
+			field = 7
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			for _, m := range mf.Metric {
+				value := m.GetGauge().GetValue()
+				if mf.GetType() == dto.MetricType_UNTYPED {
+					value = m.GetUntyped().GetValue()
+				}
+				data = appendMessage(data, 1, numberDataPoint(m.Label, value, startNano, nowNano))
+			}
+			field = 5
+		case dto.MetricType_HISTOGRAM:
+			for _, m := range mf.Metric {
+				data = appendMessage(data, 1, histogramDataPoint(m.Label, m.GetHistogram(), startNano, nowNano))
+			}
+			data = appendVarint(data, 2, aggregationTemporalityCumulative)
+			field = 9
+		case dto.MetricType_SUMMARY:
+			for _, m := range mf.Metric {
+				data = appendMessage(data, 1, summaryDataPoint(m.Label, m.GetSummary(), startNano, nowNano))
+			}
+			field = 11
+		default:
+			continue
+		}
+		var metric []byte
+		metric = appendString(metric, 1, mf.GetName())
+		metric = appendString(metric, 2, mf.GetHelp())
+		metric = appendMessage(metric, field, data)
+		scope = appendMessage(scope, 2, metric)
+	}
+
+	var rm []byte
+	rm = appendMessage(rm, 1, otlpResourceMessage(resource))
+	rm = appendMessage(rm, 2, scope)
+	return appendMessage(nil, 1, rm)
+}
+
+// otlpResourceMessage encodes a Resource with the attributes
+func otlpResourceMessage(attributes map[string]string) []byte {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b []byte
+	for _, k := range keys {
+		b = appendMessage(b, 1, keyValue(k, attributes[k]))
+	}
+	return b
+}
+
+// otlpScope encodes the InstrumentationScope of the exporter
+func otlpScope(version string) []byte {
+	return appendString(appendString(nil, 1, otlpName), 2, version)
+}
+
+func numberDataPoint(labels []*dto.LabelPair, value float64, start, now uint64) []byte {
+	var b []byte
+	for _, l := range labels {
+		b = appendMessage(b, 7, keyValue(l.GetName(), l.GetValue()))
+	}
+	b = appendFixed64(b, 2, start)
+	b = appendFixed64(b, 3, now)
+	return appendFixed64(b, 4, math.Float64bits(value))
+}
+
+// histogramDataPoint converts the cumulative buckets of Prometheus to the bucket counts of OTLP
+func histogramDataPoint(labels []*dto.LabelPair, h *dto.Histogram, start, now uint64) []byte {
+	var counts, bounds []byte
+	var previous uint64
+	for _, bucket := range h.Bucket {
+		if math.IsInf(bucket.GetUpperBound(), +1) {
+			continue
+		}
+		counts = protowire.AppendFixed64(counts, bucket.GetCumulativeCount()-previous)
+		bounds = protowire.AppendFixed64(bounds, math.Float64bits(bucket.GetUpperBound()))
+		previous = bucket.GetCumulativeCount()
+	}
+	counts = protowire.AppendFixed64(counts, h.GetSampleCount()-previous)
+
+	var b []byte
+	for _, l := range labels {
+		b = appendMessage(b, 9, keyValue(l.GetName(), l.GetValue()))
+	}
+	b = appendFixed64(b, 2, start)
+	b = appendFixed64(b, 3, now)
+	b = appendFixed64(b, 4, h.GetSampleCount())
+	b = appendFixed64(b, 5, math.Float64bits(h.GetSampleSum()))
+	b = appendMessage(b, 6, counts)
+	return appendMessage(b, 7, bounds)
+}
+
+// summaryDataPoint converts the quantiles of a Prometheus summary, e.g. of the
+// sliding windows, to a SummaryDataPoint
+func summaryDataPoint(labels []*dto.LabelPair, summary *dto.Summary, start, now uint64) []byte {
+	var b []byte
+	b = appendFixed64(b, 2, start)
+	b = appendFixed64(b, 3, now)
+	b = appendFixed64(b, 4, summary.GetSampleCount())
+	b = appendFixed64(b, 5, math.Float64bits(summary.GetSampleSum()))
+	for _, q := range summary.Quantile {
+		var v []byte
+		v = appendFixed64(v, 1, math.Float64bits(q.GetQuantile()))
+		v = appendFixed64(v, 2, math.Float64bits(q.GetValue()))
+		b = appendMessage(b, 6, v)
+	}
+	for _, l := range labels {
+		b = appendMessage(b, 7, keyValue(l.GetName(), l.GetValue()))
+	}
+	return b
+}
+
+// keyValue encodes a KeyValue with a string value
+func keyValue(k, v string) []byte {
+	return appendMessage(appendString(nil, 1, k), 2, appendString(nil, 1, v))
+}
+
+// keyValueInt encodes a KeyValue with an integer value
+func keyValueInt(k string, v int64) []byte {
+	return appendMessage(appendString(nil, 1, k), 2, appendVarint(nil, 3, uint64(v)))
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// appendMessage appends an embedded message, or a packed repeated field
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func appendFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
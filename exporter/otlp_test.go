@@ -0,0 +1,349 @@
+package exporter
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// otlpPoint is a data point decoded by the stand-in collector
+type otlpPoint struct {
+	Attributes   map[string]string
+	Value        float64
+	Count        uint64
+	BucketCounts []uint64
+	Bounds       []float64
+	// Quantiles are the values of a summary by quantile
+	Quantiles map[float64]float64
+}
+
+// otlpMetric is a metric decoded by the stand-in collector
+type otlpMetric struct {
+	// Kind is gauge, sum, histogram or summary
+	Kind   string
+	Points []otlpPoint
+}
+
+// otlpExport is an ExportMetricsServiceRequest decoded by the stand-in collector
+type otlpExport struct {
+	Resource map[string]string
+	Metrics  map[string]*otlpMetric
+}
+
+// protoFields calls f with each field of a protobuf message, with the value of
+// the varint and fixed64 fields or the content of the bytes fields
+func protoFields(t *testing.T, b []byte, f func(num protowire.Number, v uint64, data []byte)) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		require.True(t, n > 0, "invalid tag")
+		b = b[n:]
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			require.True(t, n > 0)
+			f(num, v, nil)
+			b = b[n:]
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			require.True(t, n > 0)
+			f(num, v, nil)
+			b = b[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			require.True(t, n > 0)
+			f(num, 0, v)
+			b = b[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", typ)
+		}
+	}
+}
+
+func decodeKeyValue(t *testing.T, b []byte) (key, value string) {
+	protoFields(t, b, func(num protowire.Number, _ uint64, data []byte) {
+		switch num {
+		case 1:
+			key = string(data)
+		case 2:
+			protoFields(t, data, func(num protowire.Number, v uint64, data []byte) {
+				switch num {
+				case 1:
+					value = string(data)
+				case 3:
+					value = fmt.Sprint(int64(v))
+				}
+			})
+		}
+	})
+	return key, value
+}
+
+func decodePackedFixed64(b []byte) []uint64 {
+	var values []uint64
+	for len(b) > 0 {
+		v, n := protowire.ConsumeFixed64(b)
+		values = append(values, v)
+		b = b[n:]
+	}
+	return values
+}
+
+func decodeDataPoint(t *testing.T, b []byte, kind string) otlpPoint {
+	p := otlpPoint{Attributes: map[string]string{}}
+	histogram, summary := kind == "histogram", kind == "summary"
+	attributes := protowire.Number(7)
+	if histogram {
+		attributes = 9
+	}
+	protoFields(t, b, func(num protowire.Number, v uint64, data []byte) {
+		switch {
+		case num == attributes:
+			k, v := decodeKeyValue(t, data)
+			p.Attributes[k] = v
+		case (histogram || summary) && num == 4:
+			p.Count = v
+		case (histogram || summary) && num == 5:
+			p.Value = math.Float64frombits(v)
+		case histogram && num == 6:
+			p.BucketCounts = decodePackedFixed64(data)
+		case histogram && num == 7:
+			for _, bound := range decodePackedFixed64(data) {
+				p.Bounds = append(p.Bounds, math.Float64frombits(bound))
+			}
+		case summary && num == 6:
+			var quantile, value float64
+			protoFields(t, data, func(num protowire.Number, v uint64, _ []byte) {
+				switch num {
+				case 1:
+					quantile = math.Float64frombits(v)
+				case 2:
+					value = math.Float64frombits(v)
+				}
+			})
+			if p.Quantiles == nil {
+				p.Quantiles = map[float64]float64{}
+			}
+			p.Quantiles[quantile] = value
+		case !histogram && !summary && num == 4:
+			p.Value = math.Float64frombits(v)
+		}
+	})
+	return p
+}
+
+func decodeOTLP(t *testing.T, b []byte) *otlpExport {
+	e := &otlpExport{Resource: map[string]string{}, Metrics: map[string]*otlpMetric{}}
+	protoFields(t, b, func(num protowire.Number, _ uint64, rm []byte) {
+		protoFields(t, rm, func(num protowire.Number, _ uint64, data []byte) {
+			switch num {
+			case 1: // resource
+				protoFields(t, data, func(num protowire.Number, _ uint64, kv []byte) {
+					k, v := decodeKeyValue(t, kv)
+					e.Resource[k] = v
+				})
+			case 2: // scope metrics
+				protoFields(t, data, func(num protowire.Number, _ uint64, metric []byte) {
+					if num != 2 {
+						return
+					}
+					var name string
+					m := &otlpMetric{}
+					protoFields(t, metric, func(num protowire.Number, _ uint64, data []byte) {
+						switch num {
+						case 1:
+							name = string(data)
+						case 5, 7, 9, 11:
+							m.Kind = map[protowire.Number]string{5: "gauge", 7: "sum", 9: "histogram", 11: "summary"}[num]
+							protoFields(t, data, func(num protowire.Number, _ uint64, point []byte) {
+								if num == 1 {
+									m.Points = append(m.Points, decodeDataPoint(t, point, m.Kind))
+								}
+							})
+						}
+					})
+					e.Metrics[name] = m
+				})
+			}
+		})
+	})
+	return e
+}
+
+// otlpCollector is a stand-in OpenTelemetry collector recording the exports it receives
+type otlpCollector struct {
+	mu      sync.Mutex
+	exports [][]byte
+	headers []http.Header
+}
+
+// all returns the bodies of the exports received
+func (c *otlpCollector) all() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([][]byte(nil), c.exports...)
+}
+
+func (c *otlpCollector) record(r *http.Request, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.exports = append(c.exports, body)
+	c.headers = append(c.headers, r.Header)
+}
+
+func (c *otlpCollector) last(t *testing.T) (*otlpExport, http.Header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	require.NotEmpty(t, c.exports)
+	return decodeOTLP(t, c.exports[len(c.exports)-1]), c.headers[len(c.headers)-1]
+}
+
+// runOTLPCollector starts a stand-in collector over OTLP/HTTP, or over OTLP/gRPC
+// answering with the given gRPC status
+func runOTLPCollector(t *testing.T, grpc bool, grpcStatus string) (*otlpCollector, string, func()) {
+	c := &otlpCollector{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		if !grpc {
+			require.Contains(t, []string{otlpHTTPPath, otlpTracesHTTPPath}, r.URL.Path)
+			require.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+			c.record(r, body)
+			w.Header().Set("Content-Type", "application/x-protobuf")
+			return
+		}
+
+		require.Contains(t, []string{otlpGRPCPath, otlpTracesGRPCPath}, r.URL.Path)
+		require.Equal(t, "application/grpc", r.Header.Get("Content-Type"))
+		require.True(t, len(body) >= 5)
+		require.Equal(t, uint32(len(body)-5), binary.BigEndian.Uint32(body[1:5]))
+		c.record(r, body[5:])
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		// an empty export response
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set("Grpc-Status", grpcStatus)
+		if grpcStatus != "0" {
+			w.Header().Set("Grpc-Message", "rejected")
+		}
+	})
+	srv := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	return c, srv.URL, srv.Close
+}
+
+func TestOTLPPush(t *testing.T) {
+	proxyURL, done := runProxy(t, 200)
+	defer done()
+
+	originURL, done := runOrigin(t, 200)
+	defer done()
+
+	for _, protocol := range []string{otlpProtocolHTTP, otlpProtocolGRPC} {
+		t.Run(protocol, func(t *testing.T) {
+			collector, endpoint, done := runOTLPCollector(t, protocol == otlpProtocolGRPC, "0")
+			defer done()
+
+			config := Config{
+				Proxies: []Proxy{{URL: proxyURL}},
+				Targets: []Target{{URL: originURL}},
+				Windows: []string{"5m"},
+				OTLP: OTLPConfig{
+					Endpoint:           endpoint,
+					Protocol:           protocol,
+					Headers:            map[string]string{"Authorization": "Bearer token"},
+					ResourceAttributes: map[string]string{"deployment.environment": "test"},
+				},
+			}
+			e, err := New(&config, Options{
+				Registerer:  prometheus.NewRegistry(),
+				Namespace:   "edge",
+				ConstLabels: prometheus.Labels{"site": "par"},
+				Version:     "1.2.3",
+			})
+			require.NoError(t, err)
+			e.measureOne(proxyURL, config.Targets[0], &proxyclient.AuthMethod{})
+			e.measureOne(proxyURL, config.Targets[0], &proxyclient.AuthMethod{})
+
+			require.NoError(t, e.otlp.push(context.Background()))
+			export, headers := collector.last(t)
+			require.Equal(t, "Bearer token", headers.Get("Authorization"))
+			require.Equal(t, map[string]string{
+				"service.name":           "http-proxy-exporter",
+				"service.version":        "1.2.3",
+				"deployment.environment": "test",
+			}, export.Resource)
+
+			attributes := map[string]string{"site": "par", "proxy_url": proxyURL, "resource_url": originURL}
+			tentatives := export.Metrics["edge_proxy_connection_tentatives_total"]
+			require.NotNil(t, tentatives)
+			require.Equal(t, "sum", tentatives.Kind)
+			require.Equal(t, []otlpPoint{{Attributes: attributes, Value: 2}}, tentatives.Points)
+
+			require.Equal(t, "sum", export.Metrics["edge_proxy_connection_errors_total"].Kind)
+			require.Equal(t, "gauge", export.Metrics["edge_proxy_health_state"].Kind)
+
+			rtt := export.Metrics["edge_proxy_requests_rtt_seconds"]
+			require.NotNil(t, rtt)
+			require.Equal(t, "histogram", rtt.Kind)
+			require.Len(t, rtt.Points, 1)
+			p := rtt.Points[0]
+			require.Equal(t, attributes, p.Attributes)
+			require.Equal(t, uint64(2), p.Count)
+			require.Len(t, p.BucketCounts, len(p.Bounds)+1)
+			var total uint64
+			for _, c := range p.BucketCounts {
+				total += c
+			}
+			require.Equal(t, p.Count, total)
+
+			// the percentiles of the sliding windows
+			window := export.Metrics["edge_proxy_window_rtt_seconds"]
+			require.NotNil(t, window)
+			require.Equal(t, "summary", window.Kind)
+			require.Len(t, window.Points, 1)
+			p = window.Points[0]
+			require.Equal(t, map[string]string{"site": "par", "proxy_url": proxyURL, "window": "5m0s"}, p.Attributes)
+			require.Equal(t, uint64(2), p.Count)
+			require.Len(t, p.Quantiles, len(windowQuantiles))
+			for _, q := range windowQuantiles {
+				require.True(t, p.Quantiles[q] > 0, q)
+			}
+		})
+	}
+}
+
+func TestOTLPPushFailure(t *testing.T) {
+	_, endpoint, done := runOTLPCollector(t, true, "14")
+	defer done()
+
+	config := Config{OTLP: OTLPConfig{Endpoint: endpoint, Protocol: otlpProtocolGRPC}}
+	e := newTestExporter(t, config)
+	require.Error(t, e.otlp.push(context.Background()))
+
+	e.otlp.pushLogged(context.Background())
+	require.Equal(t, 1.0, testutil.ToFloat64(e.metrics.otlpPushes.WithLabelValues(otlpResultFailure)))
+}
+
+func TestOTLPConfig(t *testing.T) {
+	for _, c := range []OTLPConfig{
+		{Endpoint: "collector:4318"},
+		{Endpoint: "http://collector:4318", Protocol: "thrift"},
+		{Endpoint: "http://collector:4318", Interval: "0s"},
+	} {
+		_, err := newOTLPPusher(c, nil, nil, "")
+		require.Error(t, err, c)
+	}
+}
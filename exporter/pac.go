@@ -0,0 +1,187 @@
+package exporter
+
+import (
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/criteo/http-proxy-exporter/pac"
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	pacErrorStageFetch    = "fetch"
+	pacErrorStageParse    = "parse"
+	pacErrorStageEvaluate = "evaluate"
+)
+
+// pacSelection is the PAC decision for a target and the proxy which was used
+type pacSelection struct {
+	decision string
+	proxyURL string
+	selected bool
+}
+
+// pacProber picks the proxies of each target by evaluating a PAC file, and
+// probes them in order the way a browser would
+type pacProber struct {
+	e       *Exporter
+	url     string
+	file    string
+	refresh time.Duration
+	timeout time.Duration
+
+	mu          sync.Mutex
+	script      *pac.Script
+	loading     bool
+	attemptedAt time.Time
+	failures    int
+	last        map[string]pacSelection
+}
+
+func newPACProber(e *Exporter) (*pacProber, error) {
+	config := e.config
+	refresh, err := parseDurationOr(config.PACRefresh, 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stage := range []string{pacErrorStageFetch, pacErrorStageParse, pacErrorStageEvaluate} {
+		e.metrics.pacErrors.WithLabelValues(stage).Add(0)
+	}
+
+	return &pacProber{
+		e:       e,
+		url:     config.PACURL,
+		file:    config.PACFile,
+		refresh: refresh,
+		timeout: time.Duration(config.Interval) * time.Second,
+		last:    make(map[string]pacSelection),
+	}, nil
+}
+
+// loadScript returns the PAC script, reloading it when it is older than the
+// refresh delay. The previous script is kept if the reload fails, and the
+// reload is retried after a backoff, from the interval up to the refresh
+// delay. A single probe reloads the script at a time, outside of the lock,
+// the others keep using the previous one meanwhile.
+func (p *pacProber) loadScript() *pac.Script {
+	p.mu.Lock()
+	if p.loading || time.Since(p.attemptedAt) < p.reloadDelay() {
+		defer p.mu.Unlock()
+		return p.script
+	}
+	p.loading = true
+	p.mu.Unlock()
+
+	script, err := p.readScript()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.loading = false
+	p.attemptedAt = time.Now()
+	if err != nil {
+		p.failures++
+		return p.script
+	}
+	p.failures = 0
+	p.script = script
+	return p.script
+}
+
+// reloadDelay returns the delay since the last attempt before reloading the
+// script, doubling from the interval up to the refresh delay on failures
+func (p *pacProber) reloadDelay() time.Duration {
+	if p.failures == 0 {
+		return p.refresh
+	}
+	delay := p.timeout
+	for i := 1; i < p.failures && delay < p.refresh; i++ {
+		delay *= 2
+	}
+	if delay > p.refresh {
+		return p.refresh
+	}
+	return delay
+}
+
+// readScript fetches and parses the PAC file
+func (p *pacProber) readScript() (*pac.Script, error) {
+	var src string
+	var err error
+	if p.url != "" {
+		src, err = pac.Fetch(p.url, p.timeout)
+	} else {
+		var content []byte
+		content, err = ioutil.ReadFile(p.file)
+		src = string(content)
+	}
+	if err != nil {
+		log.Errorf("could not fetch PAC file: %s", err)
+		p.e.metrics.pacErrors.WithLabelValues(pacErrorStageFetch).Inc()
+		return nil, err
+	}
+
+	script, err := pac.Parse(src)
+	if err != nil {
+		log.Errorf("could not parse PAC file: %s", err)
+		p.e.metrics.pacErrors.WithLabelValues(pacErrorStageParse).Inc()
+		return nil, err
+	}
+	return script, nil
+}
+
+// measure evaluates the PAC file for the target and probes the returned
+// proxies in order until one of them accepts the connection
+func (p *pacProber) measure(target Target, auth *proxyclient.AuthMethod) {
+	script := p.loadScript()
+	if script == nil {
+		return
+	}
+
+	entries, err := script.Entries(target.URL)
+	if err != nil {
+		log.Errorf("could not evaluate PAC file for %q: %s", target.URL, err)
+		p.e.metrics.pacErrors.WithLabelValues(pacErrorStageEvaluate).Inc()
+		return
+	}
+	decision := pac.FormatEntries(entries)
+
+	for _, e := range entries {
+		proxy, err := e.ProxyURL()
+		if err != nil {
+			log.Warnf("skipping PAC entry %q for %q: %s", e, target.URL, err)
+			continue
+		}
+		o := p.e.measureOne(proxy, target, auth)
+		if o.ConnectionSuccess {
+			p.setSelection(target.URL, pacSelection{decision: decision, proxyURL: o.ProxyURL, selected: true})
+			return
+		}
+	}
+
+	log.Errorf("req to %q: no working proxy in PAC decision %q", target.URL, decision)
+	p.e.metrics.pacChainFailures.WithLabelValues(target.URL, decision).Inc()
+	p.setSelection(target.URL, pacSelection{decision: decision})
+}
+
+// setSelection exposes the PAC decision of a target, removing the previous one
+func (p *pacProber) setSelection(targetURL string, s pacSelection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if last, ok := p.last[targetURL]; ok {
+		p.e.metrics.pacDecision.DeleteLabelValues(targetURL, last.decision)
+		if last.selected {
+			p.e.metrics.pacSelectedProxy.DeleteLabelValues(targetURL, last.decision, last.proxyURL)
+		}
+	}
+	p.last[targetURL] = s
+
+	p.e.metrics.pacDecision.WithLabelValues(targetURL, s.decision).Set(1)
+	if s.selected {
+		p.e.metrics.pacSelectedProxy.WithLabelValues(targetURL, s.decision, s.proxyURL).Set(1)
+	}
+}
@@ -0,0 +1,122 @@
+package exporter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+	"github.com/phayes/freeport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func writePAC(t *testing.T, result string) (string, func()) {
+	dir, err := ioutil.TempDir("", "pac")
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, "proxy.pac")
+	src := fmt.Sprintf("function FindProxyForURL(url, host) { return %q; }", result)
+	require.NoError(t, ioutil.WriteFile(path, []byte(src), 0644))
+
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestPACFallback(t *testing.T) {
+	proxyURL, done := runProxy(t, 200)
+	defer done()
+
+	originURL, done := runOrigin(t, 200)
+	defer done()
+
+	deadPort, err := freeport.GetFreePort()
+	require.NoError(t, err)
+	deadProxy := fmt.Sprintf("127.0.0.1:%d", deadPort)
+
+	u, err := url.Parse(proxyURL)
+	require.NoError(t, err)
+	decision := fmt.Sprintf("PROXY %s; PROXY %s; DIRECT", deadProxy, u.Host)
+
+	path, cleanup := writePAC(t, decision)
+	defer cleanup()
+
+	e := newTestExporter(t, Config{PACFile: path, Interval: 1})
+	e.pacs.measure(Target{URL: originURL}, &proxyclient.AuthMethod{})
+
+	require.Equal(t, 1.0, testutil.ToFloat64(e.metrics.pacDecision.WithLabelValues(originURL, decision)))
+	require.Equal(t, 1.0, testutil.ToFloat64(e.metrics.pacSelectedProxy.WithLabelValues(originURL, decision, proxyURL)))
+	requireCounter(t,
+		e.metrics.proxyConnectionErrors,
+		prometheus.Labels{"proxy_url": "http://" + deadProxy, "cause": proxyConnectionErrorCauseProxy, "resource_url": originURL},
+		1,
+	)
+	requireCounter(t,
+		e.metrics.proxyRequestsSuccesses,
+		prometheus.Labels{"proxy_url": proxyURL, "resource_url": originURL, "status_code": "200"},
+		1,
+	)
+	requireCounter(t, e.metrics.pacChainFailures, prometheus.Labels{"resource_url": originURL, "decision": decision}, 0)
+}
+
+func TestPACErrors(t *testing.T) {
+	e := newTestExporter(t, Config{PACFile: "idontexist.pac", Interval: 1})
+	e.pacs.measure(Target{URL: "http://i_wont_get_called"}, &proxyclient.AuthMethod{})
+	requireCounter(t, e.metrics.pacErrors, prometheus.Labels{"stage": pacErrorStageFetch}, 1)
+
+	path, cleanup := writePAC(t, "FTP i_am_not_a_proxy")
+	defer cleanup()
+
+	e = newTestExporter(t, Config{PACFile: path, Interval: 1})
+	e.pacs.measure(Target{URL: "http://i_wont_get_called"}, &proxyclient.AuthMethod{})
+	requireCounter(t, e.metrics.pacErrors, prometheus.Labels{"stage": pacErrorStageEvaluate}, 1)
+}
+
+func TestPACFetchBackoff(t *testing.T) {
+	var fetches int32
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		<-unblock
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	e := newTestExporter(t, Config{PACURL: server.URL, PACRefresh: "1h", Interval: 10})
+
+	// the probes do not wait behind the fetch in progress
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		e.pacs.measure(Target{URL: "http://i_wont_get_called"}, &proxyclient.AuthMethod{})
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&fetches) == 1 }, time.Second, 10*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		e.pacs.measure(Target{URL: "http://i_wont_get_called"}, &proxyclient.AuthMethod{})
+	}
+	close(unblock)
+	wg.Wait()
+
+	// a failed fetch is not retried before the backoff
+	e.pacs.measure(Target{URL: "http://i_wont_get_called"}, &proxyclient.AuthMethod{})
+	require.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+	requireCounter(t, e.metrics.pacErrors, prometheus.Labels{"stage": pacErrorStageFetch}, 1)
+	require.Equal(t, 10*time.Second, e.pacs.reloadDelay())
+
+	e.pacs.attemptedAt = time.Now().Add(-10 * time.Second)
+	e.pacs.measure(Target{URL: "http://i_wont_get_called"}, &proxyclient.AuthMethod{})
+	require.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+	require.Equal(t, 20*time.Second, e.pacs.reloadDelay())
+
+	e.pacs.failures = 20
+	require.Equal(t, time.Hour, e.pacs.reloadDelay())
+}
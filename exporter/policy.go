@@ -0,0 +1,115 @@
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	policyExpectBlocked = "blocked"
+	policyExpectAllowed = "allowed"
+)
+
+// BlockPage is the fingerprint of the response of a proxy blocking a request,
+// all the configured criteria must match
+type BlockPage struct {
+	StatusCode int    `yaml:"status_code,omitempty"`
+	BodyRegex  string `yaml:"body_regex,omitempty"`
+	// Header is a header name and a value regex, e.g. "X-Blocked-By: .*"
+	Header string `yaml:"header,omitempty"`
+}
+
+// verifyPolicy ensures that the URL filtering expectations of a target are valid
+func verifyPolicy(target Target) []error {
+	var errs []error
+
+	switch target.Expect {
+	case "", policyExpectBlocked, policyExpectAllowed:
+	default:
+		errs = append(errs, fmt.Errorf("target %q: unknown expect %q", target.URL, target.Expect))
+	}
+	if target.BlockPage == nil {
+		return errs
+	}
+	if target.Expect == "" {
+		errs = append(errs, fmt.Errorf("target %q: block_page requires expect", target.URL))
+	}
+	if _, err := regexp.Compile(target.BlockPage.BodyRegex); err != nil {
+		errs = append(errs, fmt.Errorf("target %q: invalid block_page body_regex: %s", target.URL, err))
+	}
+	if target.BlockPage.Header != "" {
+		if _, _, err := parseHeaderMatcher(target.BlockPage.Header); err != nil {
+			errs = append(errs, fmt.Errorf("target %q: invalid block_page header: %s", target.URL, err))
+		}
+	}
+	return errs
+}
+
+// parseHeaderMatcher parses a "Name: regex" header matcher
+func parseHeaderMatcher(matcher string) (string, *regexp.Regexp, error) {
+	parts := strings.SplitN(matcher, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return "", nil, errors.New("expected \"Name: regex\"")
+	}
+	re, err := regexp.Compile(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return "", nil, err
+	}
+	return strings.TrimSpace(parts[0]), re, nil
+}
+
+// isBlocked reports whether a response, or the status of a refused CONNECT
+// request, is a block page
+func isBlocked(bp *BlockPage, resp *http.Response, connectStatus int, body []byte) bool {
+	statusCode := connectStatus
+	var header http.Header
+	if resp != nil {
+		statusCode = resp.StatusCode
+		header = resp.Header
+	}
+
+	if bp == nil {
+		return statusCode == http.StatusForbidden || statusCode == http.StatusUnavailableForLegalReasons
+	}
+
+	if bp.StatusCode != 0 && bp.StatusCode != statusCode {
+		return false
+	}
+	if bp.BodyRegex != "" {
+		re, err := regexp.Compile(bp.BodyRegex)
+		if err != nil || !re.Match(body) {
+			return false
+		}
+	}
+	if bp.Header != "" {
+		name, re, err := parseHeaderMatcher(bp.Header)
+		if err != nil || header == nil {
+			return false
+		}
+		matched := false
+		for _, v := range header.Values(name) {
+			if re.MatchString(v) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return statusCode != 0 || resp != nil
+}
+
+// onPolicyCheck exposes whether the proxy enforces the URL filtering policy for the target
+func (e *Exporter) onPolicyCheck(proxyURL string, target Target, blocked, reachedOrigin bool) {
+	compliant := blocked
+	if target.Expect == policyExpectAllowed {
+		compliant = !blocked && reachedOrigin
+	}
+
+	e.metrics.proxyPolicyBlocked.WithLabelValues(proxyURL, target.URL).Set(boolToFloat(blocked))
+	e.metrics.proxyPolicyCompliance.WithLabelValues(proxyURL, target.URL, target.Expect).Set(boolToFloat(compliant))
+}
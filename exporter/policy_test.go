@@ -0,0 +1,88 @@
+package exporter
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+	"github.com/criteo/http-proxy-exporter/proxytest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyPolicy(t *testing.T) {
+	require.Len(t, verifyPolicy(Target{URL: "http://a/"}), 0)
+	require.Len(t, verifyPolicy(Target{URL: "http://a/", Expect: policyExpectBlocked}), 0)
+	require.Len(t, verifyPolicy(Target{URL: "http://a/", Expect: "maybe"}), 1)
+	require.Len(t, verifyPolicy(Target{URL: "http://a/", BlockPage: &BlockPage{StatusCode: 403}}), 1)
+	require.Len(t, verifyPolicy(Target{
+		URL:    "http://a/",
+		Expect: policyExpectBlocked,
+		BlockPage: &BlockPage{
+			BodyRegex: "(",
+			Header:    "no regex",
+		},
+	}), 2)
+}
+
+func TestIsBlocked(t *testing.T) {
+	blockPage := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"X-Squid-Error": []string{"ERR_ACCESS_DENIED 0"}},
+	}
+	body := []byte("<html>Access denied by policy</html>")
+
+	// default fingerprint
+	require.True(t, isBlocked(nil, &http.Response{StatusCode: http.StatusForbidden}, 0, nil))
+	require.False(t, isBlocked(nil, blockPage, 0, body))
+	require.True(t, isBlocked(nil, nil, http.StatusForbidden, nil))
+	require.False(t, isBlocked(nil, nil, 0, nil))
+
+	// configured fingerprint
+	bp := &BlockPage{StatusCode: http.StatusOK, BodyRegex: "Access denied", Header: "X-Squid-Error: ^ERR_ACCESS_DENIED"}
+	require.True(t, isBlocked(bp, blockPage, 0, body))
+	require.False(t, isBlocked(bp, blockPage, 0, []byte("Hello from origin")))
+	require.False(t, isBlocked(bp, &http.Response{StatusCode: http.StatusOK}, 0, body))
+
+	bp = &BlockPage{StatusCode: http.StatusUnavailableForLegalReasons}
+	require.True(t, isBlocked(bp, nil, http.StatusUnavailableForLegalReasons, nil))
+	require.False(t, isBlocked(bp, &http.Response{StatusCode: http.StatusForbidden}, 0, nil))
+}
+
+func TestPolicyCompliance(t *testing.T) {
+	e := newTestExporter(t, Config{})
+
+	blockingProxyURL, done := runProxy(t, http.StatusForbidden)
+	defer done()
+
+	proxyURL, done := runProxy(t, http.StatusOK)
+	defer done()
+
+	originURL, done := runOrigin(t, http.StatusOK)
+	defer done()
+
+	blocked := Target{URL: originURL, Expect: policyExpectBlocked}
+	e.measureOne(blockingProxyURL, blocked, &proxyclient.AuthMethod{})
+	e.measureOne(proxyURL, blocked, &proxyclient.AuthMethod{})
+
+	require.Equal(t, 1.0, testutil.ToFloat64(e.metrics.proxyPolicyBlocked.WithLabelValues(blockingProxyURL, originURL)))
+	require.Equal(t, 1.0, testutil.ToFloat64(e.metrics.proxyPolicyCompliance.WithLabelValues(blockingProxyURL, originURL, policyExpectBlocked)))
+	require.Equal(t, 0.0, testutil.ToFloat64(e.metrics.proxyPolicyBlocked.WithLabelValues(proxyURL, originURL)))
+	require.Equal(t, 0.0, testutil.ToFloat64(e.metrics.proxyPolicyCompliance.WithLabelValues(proxyURL, originURL, policyExpectBlocked)))
+
+	allowed := Target{URL: originURL, Expect: policyExpectAllowed, BlockPage: &BlockPage{BodyRegex: "Access denied"}}
+	e.measureOne(proxyURL, allowed, &proxyclient.AuthMethod{})
+
+	require.Equal(t, 1.0, testutil.ToFloat64(e.metrics.proxyPolicyCompliance.WithLabelValues(proxyURL, originURL, policyExpectAllowed)))
+
+	// the CONNECT requests refused with a custom reason phrase
+	tlsOriginURL, done := runOriginTLS(t, http.StatusOK)
+	defer done()
+	customProxyURL, done := runFakeProxy(t, false, proxytest.Config{StatusCode: http.StatusForbidden, Reason: "Blocked by policy"})
+	defer done()
+
+	tunneled := Target{URL: tlsOriginURL, Expect: policyExpectBlocked, Insecure: true}
+	e.measureOne(customProxyURL, tunneled, &proxyclient.AuthMethod{})
+	require.Equal(t, 1.0, testutil.ToFloat64(e.metrics.proxyPolicyBlocked.WithLabelValues(customProxyURL, tlsOriginURL)))
+	require.Equal(t, 1.0, testutil.ToFloat64(e.metrics.proxyPolicyCompliance.WithLabelValues(customProxyURL, tlsOriginURL, policyExpectBlocked)))
+}
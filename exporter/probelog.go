@@ -0,0 +1,163 @@
+package exporter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Formats of the logs
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// defaultLogRepeatInterval is the delay before an identical error of a pair is logged again when not configured
+const defaultLogRepeatInterval = time.Minute
+
+// probeDetails are the details of a probe logged along with its outcome
+type probeDetails struct {
+	ID            string
+	ResolvedProxy string
+	StatusCode    int
+	ErrorKind     proxyclient.ErrorKind
+	Events        []proxyclient.Event
+	// Trace is the trace context of the probe, when traced
+	Trace      *traceContext
+	Connection probeConnection
+}
+
+// newProbeID returns a random identifier of a probe, to correlate its logs and records
+func newProbeID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// repeatedError is the last error logged for a pair
+type repeatedError struct {
+	msg        string
+	logged     time.Time
+	suppressed int
+}
+
+// probeLogger logs the outcomes of the probes, as text or as one JSON event
+// each, and suppresses the identical errors of a pair repeated within an interval
+type probeLogger struct {
+	json     bool
+	interval time.Duration
+
+	mu      sync.Mutex
+	repeats map[pairKey]*repeatedError
+}
+
+func newProbeLogger(format string, interval time.Duration) *probeLogger {
+	return &probeLogger{
+		json:     format == LogFormatJSON,
+		interval: interval,
+		repeats:  make(map[pairKey]*repeatedError),
+	}
+}
+
+// allow reports whether an outcome is logged, with the number of errors of
+// its pair suppressed since the last one logged
+func (l *probeLogger) allow(o probeOutcome) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := pairKey{o.ProxyURL, o.TargetURL}
+	r, found := l.repeats[key]
+	if o.Error == "" {
+		delete(l.repeats, key)
+		if found {
+			return true, r.suppressed
+		}
+		return true, 0
+	}
+	if found && r.msg == o.Error && l.interval > 0 && o.Time.Sub(r.logged) < l.interval {
+		r.suppressed++
+		return false, 0
+	}
+	suppressed := 0
+	if found {
+		suppressed = r.suppressed
+	}
+	l.repeats[key] = &repeatedError{msg: o.Error, logged: o.Time}
+	return true, suppressed
+}
+
+// log logs the outcome of a probe unless it repeats a recent error
+func (l *probeLogger) log(o probeOutcome, d probeDetails) {
+	ok, suppressed := l.allow(o)
+	if !ok {
+		return
+	}
+
+	result := outcomeResult(o)
+	level := log.DebugLevel
+	switch result {
+	case ResultConnectionFailure:
+		level = log.ErrorLevel
+	case ResultOriginFailure:
+		level = log.WarnLevel
+	}
+
+	if !l.json {
+		var msg string
+		switch {
+		case o.Cause == proxyConnectionErrorCauseLookup:
+			msg = fmt.Sprintf("error while resolving proxy address: %s", o.Error)
+		case o.Cause == proxyConnectionErrorCauseSystem:
+			msg = fmt.Sprintf("could not pick system proxy for %q: %s", o.TargetURL, o.Error)
+		case o.Cause == proxyConnectionErrorCausePrepare:
+			msg = fmt.Sprintf("req to %q via %q: error while preparing request: %s", o.TargetURL, o.ProxyURL, o.Error)
+		case result == ResultConnectionFailure:
+			msg = fmt.Sprintf("req to %q via %q: connect error: %s", o.TargetURL, o.ProxyURL, o.Error)
+		case result == ResultOriginFailure:
+			msg = fmt.Sprintf("req to %q via %q: request error: %s", o.TargetURL, o.ProxyURL, o.Error)
+		default:
+			msg = fmt.Sprintf("req to %q via %q: OK (%d)", o.TargetURL, o.ProxyURL, d.StatusCode)
+		}
+		if suppressed > 0 {
+			msg += fmt.Sprintf(" (%d repeated errors suppressed)", suppressed)
+		}
+		log.StandardLogger().Log(level, msg)
+		return
+	}
+
+	// every probe emits an event, the successful ones included
+	if level == log.DebugLevel {
+		level = log.InfoLevel
+	}
+	r := newProbeResult(o, d)
+	fields := log.Fields{
+		"probe_id":         r.ProbeID,
+		"proxy_url":        r.ProxyURL,
+		"target_url":       r.TargetURL,
+		"outcome":          r.Outcome,
+		"duration_seconds": r.DurationSeconds,
+	}
+	if r.Cause != "" {
+		fields["cause"] = r.Cause
+	}
+	if r.StatusCode != 0 {
+		fields["status_code"] = r.StatusCode
+	}
+	if r.ResolvedIP != "" {
+		fields["resolved_ip"] = r.ResolvedIP
+	}
+	if r.Error != "" {
+		fields["error"] = r.Error
+	}
+	if suppressed > 0 {
+		fields["suppressed"] = suppressed
+	}
+	log.WithFields(fields).Log(level, "probe")
+}
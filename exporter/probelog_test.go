@@ -0,0 +1,107 @@
+package exporter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeLogJSON(t *testing.T) {
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	proxyURL, done := runProxy(t, 200)
+	defer done()
+
+	originURL, done := runOrigin(t, 200)
+	defer done()
+
+	e := newTestExporter(t, Config{LogFormat: LogFormatJSON})
+	e.measureOne(proxyURL, Target{URL: originURL}, &proxyclient.AuthMethod{})
+
+	entry := hook.LastEntry()
+	require.NotNil(t, entry)
+	require.Equal(t, "probe", entry.Message)
+	require.Equal(t, log.InfoLevel, entry.Level)
+	require.Len(t, entry.Data["probe_id"], 16)
+	require.Equal(t, proxyURL, entry.Data["proxy_url"])
+	require.Equal(t, originURL, entry.Data["target_url"])
+	require.Equal(t, ResultOK, entry.Data["outcome"])
+	require.Equal(t, 200, entry.Data["status_code"])
+	require.Equal(t, "127.0.0.1", entry.Data["resolved_ip"])
+	require.NotContains(t, entry.Data, "error")
+
+	records, _ := e.debug.last(proxyURL, originURL)
+	require.Equal(t, entry.Data["probe_id"], records[0].ProbeID)
+
+	hook.Reset()
+	for i := 0; i < 3; i++ {
+		e.measureOne("http://127.0.0.1:1", Target{URL: originURL}, &proxyclient.AuthMethod{})
+	}
+	var probes []*log.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "probe" {
+			probes = append(probes, entry)
+		}
+	}
+	// the identical errors are logged once within the interval
+	require.Len(t, probes, 1)
+	entry = probes[0]
+	require.Equal(t, log.ErrorLevel, entry.Level)
+	require.Equal(t, ResultConnectionFailure, entry.Data["outcome"])
+	require.Equal(t, string(proxyclient.ErrorKindProxyConnect), entry.Data["cause"])
+	require.Contains(t, entry.Data, "error")
+
+	// the probes failing before they connect are logged too
+	hook.Reset()
+	badTarget := Target{URL: "http://bad host/"}
+	e.measureOne(systemProxy, badTarget, &proxyclient.AuthMethod{})
+	e.measureOne(proxyURL, badTarget, &proxyclient.AuthMethod{})
+	probes = nil
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "probe" {
+			probes = append(probes, entry)
+		}
+	}
+	require.Len(t, probes, 2)
+	for i, cause := range []string{proxyConnectionErrorCauseSystem, proxyConnectionErrorCausePrepare} {
+		require.Equal(t, log.ErrorLevel, probes[i].Level)
+		require.Equal(t, cause, probes[i].Data["cause"])
+		require.Len(t, probes[i].Data["probe_id"], 16)
+	}
+}
+
+func TestProbeLoggerRepeats(t *testing.T) {
+	l := newProbeLogger(LogFormatText, time.Minute)
+	now := time.Now()
+	failure := func(msg string, at time.Duration) probeOutcome {
+		return probeOutcome{Time: now.Add(at), ProxyURL: "p", TargetURL: "t", Error: msg}
+	}
+
+	for _, tc := range []struct {
+		outcome    probeOutcome
+		logged     bool
+		suppressed int
+	}{
+		{failure("refused", 0), true, 0},
+		{failure("refused", time.Second), false, 0},
+		{failure("refused", 2*time.Second), false, 0},
+		// the error is logged again once the interval elapsed
+		{failure("refused", time.Minute), true, 2},
+		{failure("refused", time.Minute+time.Second), false, 0},
+		// a different error is logged at once
+		{failure("timeout", time.Minute+2*time.Second), true, 1},
+		{failure("timeout", time.Minute+3*time.Second), false, 0},
+		// a success reports the errors suppressed before it
+		{probeOutcome{Time: now.Add(2 * time.Minute), ProxyURL: "p", TargetURL: "t", RequestSuccess: true}, true, 1},
+		{failure("timeout", 2*time.Minute+time.Second), true, 0},
+	} {
+		logged, suppressed := l.allow(tc.outcome)
+		require.Equal(t, tc.logged, logged, tc.outcome)
+		require.Equal(t, tc.suppressed, suppressed, tc.outcome)
+	}
+}
@@ -0,0 +1,427 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	sinkTypeJSONL  = "jsonl"
+	sinkTypeSyslog = "syslog"
+
+	defaultSinkBuffer    = 1000
+	defaultJSONLMaxBytes = 100 * 1024 * 1024
+	defaultJSONLMaxFiles = 5
+	defaultSyslogAppName = "http-proxy-exporter"
+)
+
+// syslogFacilities are the syslog facilities by name
+var syslogFacilities = map[string]int{
+	"user": 1, "daemon": 3,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// SinkConfig is a destination of the results of every probe
+type SinkConfig struct {
+	// Type is jsonl or syslog
+	Type string `yaml:"type"`
+	// Name identifies the sink in the metrics, its type by default
+	Name string `yaml:"name,omitempty"`
+	// Buffer is the number of results waiting to be written, the next ones are dropped
+	Buffer int `yaml:"buffer,omitempty"`
+
+	// Path is the file of a jsonl sink, rotated once over MaxBytes, keeping MaxFiles rotated files
+	Path     string `yaml:"path,omitempty"`
+	MaxBytes int64  `yaml:"max_bytes,omitempty"`
+	MaxFiles int    `yaml:"max_files,omitempty"`
+
+	// Network is the transport of a syslog sink, udp, tcp or unix, to Address
+	Network  string `yaml:"network,omitempty"`
+	Address  string `yaml:"address,omitempty"`
+	Facility string `yaml:"facility,omitempty"`
+	AppName  string `yaml:"app_name,omitempty"`
+}
+
+// verifySinks ensures that the sinks are valid and their names unique
+func verifySinks(configs []SinkConfig) []error {
+	var errs []error
+	names := make(map[string]bool)
+	for _, c := range configs {
+		name := sinkName(c)
+		if names[name] {
+			errs = append(errs, fmt.Errorf("sink %q: duplicate name", name))
+		}
+		names[name] = true
+		if c.Buffer < 0 {
+			errs = append(errs, fmt.Errorf("sink %q: buffer must be positive", name))
+		}
+		switch c.Type {
+		case sinkTypeJSONL:
+			if c.Path == "" {
+				errs = append(errs, fmt.Errorf("sink %q: path must be provided", name))
+			}
+		case sinkTypeSyslog:
+			switch c.Network {
+			case "udp", "tcp", "unix":
+			default:
+				errs = append(errs, fmt.Errorf("sink %q: network must be udp, tcp or unix", name))
+			}
+			if c.Address == "" {
+				errs = append(errs, fmt.Errorf("sink %q: address must be provided", name))
+			}
+			if _, ok := syslogFacilities[c.Facility]; c.Facility != "" && !ok {
+				errs = append(errs, fmt.Errorf("sink %q: unknown facility %q", name, c.Facility))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("sink %q: unknown type %q", name, c.Type))
+		}
+	}
+	return errs
+}
+
+func sinkName(c SinkConfig) string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Type
+}
+
+// probeResult is the result of a probe as written to the sinks
+type probeResult struct {
+	Time            time.Time `json:"time"`
+	ProbeID         string    `json:"probe_id,omitempty"`
+	ProxyURL        string    `json:"proxy_url"`
+	TargetURL       string    `json:"target_url"`
+	Outcome         string    `json:"outcome"`
+	Cause           string    `json:"cause,omitempty"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	StatusCode      int       `json:"status_code,omitempty"`
+	ResolvedIP      string    `json:"resolved_ip,omitempty"`
+	Error           string    `json:"error,omitempty"`
+}
+
+func newProbeResult(o probeOutcome, d probeDetails) *probeResult {
+	r := &probeResult{
+		Time:            o.Time,
+		ProbeID:         d.ID,
+		ProxyURL:        o.ProxyURL,
+		TargetURL:       o.TargetURL,
+		Outcome:         outcomeResult(o),
+		Cause:           o.Cause,
+		DurationSeconds: o.Duration.Seconds(),
+		StatusCode:      d.StatusCode,
+		ResolvedIP:      d.ResolvedProxy,
+		Error:           redactURLs(o.Error),
+	}
+	if d.ErrorKind != "" {
+		r.Cause = string(d.ErrorKind)
+	}
+	if host, _, err := net.SplitHostPort(d.ResolvedProxy); err == nil {
+		r.ResolvedIP = host
+	}
+	return r
+}
+
+// resultWriter writes the results to a destination, from a single goroutine
+type resultWriter interface {
+	write(r *probeResult) error
+	close() error
+}
+
+// resultSink writes the results in the background, dropping them when its buffer is full
+type resultSink struct {
+	name    string
+	w       resultWriter
+	queue   chan *probeResult
+	done    chan struct{}
+	metrics *metrics
+}
+
+func newResultSink(name string, w resultWriter, buffer int, m *metrics) *resultSink {
+	if buffer <= 0 {
+		buffer = defaultSinkBuffer
+	}
+	s := &resultSink{
+		name:    name,
+		w:       w,
+		queue:   make(chan *probeResult, buffer),
+		done:    make(chan struct{}),
+		metrics: m,
+	}
+	go s.run()
+	return s
+}
+
+func (s *resultSink) send(r *probeResult) {
+	select {
+	case s.queue <- r:
+	default:
+		s.metrics.sinkResultsDropped.WithLabelValues(s.name).Inc()
+	}
+}
+
+func (s *resultSink) run() {
+	defer close(s.done)
+	failing := false
+	for r := range s.queue {
+		if err := s.w.write(r); err != nil {
+			s.metrics.sinkWriteErrors.WithLabelValues(s.name).Inc()
+			// only the first error of a series is logged
+			if !failing {
+				log.Warnf("could not write result to sink %q: %s", s.name, err)
+			}
+			failing = true
+			continue
+		}
+		failing = false
+		s.metrics.sinkResultsWritten.WithLabelValues(s.name).Inc()
+	}
+	if err := s.w.close(); err != nil {
+		log.Warnf("could not close sink %q: %s", s.name, err)
+	}
+}
+
+// resultSinks sends the results to every sink
+type resultSinks struct {
+	mu     sync.RWMutex
+	sinks  []*resultSink
+	closed bool
+}
+
+func newResultSinks(configs []SinkConfig, m *metrics) (*resultSinks, error) {
+	if errs := verifySinks(configs); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	s := &resultSinks{}
+	for _, c := range configs {
+		var w resultWriter
+		var err error
+		switch c.Type {
+		case sinkTypeJSONL:
+			w, err = newJSONLWriter(c)
+		case sinkTypeSyslog:
+			w = newSyslogWriter(c)
+		}
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("sink %q: %s", sinkName(c), err)
+		}
+		s.sinks = append(s.sinks, newResultSink(sinkName(c), w, c.Buffer, m))
+	}
+	return s, nil
+}
+
+func (s *resultSinks) send(r *probeResult) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	for _, sink := range s.sinks {
+		sink.send(r)
+	}
+}
+
+// close writes the buffered results and closes the sinks
+func (s *resultSinks) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for _, sink := range s.sinks {
+		close(sink.queue)
+	}
+	for _, sink := range s.sinks {
+		<-sink.done
+	}
+}
+
+// jsonlWriter appends the results to a JSON Lines file, rotated by size
+type jsonlWriter struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+
+	f    *os.File
+	size int64
+}
+
+func newJSONLWriter(c SinkConfig) (*jsonlWriter, error) {
+	w := &jsonlWriter{path: c.Path, maxBytes: c.MaxBytes, maxFiles: c.MaxFiles}
+	if w.maxBytes <= 0 {
+		w.maxBytes = defaultJSONLMaxBytes
+	}
+	if w.maxFiles <= 0 {
+		w.maxFiles = defaultJSONLMaxFiles
+	}
+	return w, w.open()
+}
+
+func (w *jsonlWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.size = f, info.Size()
+	return nil
+}
+
+func (w *jsonlWriter) write(r *probeResult) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if w.f == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	if w.size > 0 && w.size+int64(len(data)) > w.maxBytes {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.f.Write(data)
+	w.size += int64(n)
+	return err
+}
+
+// rotate renames the file to path.1, path.1 to path.2 and so on, removing the
+// oldest one, and opens a new file
+func (w *jsonlWriter) rotate() error {
+	w.f.Close()
+	w.f = nil
+	os.Remove(fmt.Sprintf("%s.%d", w.path, w.maxFiles))
+	for i := w.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+	}
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+func (w *jsonlWriter) close() error {
+	if w.f == nil {
+		return nil
+	}
+	return w.f.Close()
+}
+
+// syslogWriter sends the results as RFC 5424 messages, connecting again after an error
+type syslogWriter struct {
+	network  string
+	address  string
+	facility int
+	appName  string
+	hostname string
+
+	conn   net.Conn
+	stream bool
+}
+
+func newSyslogWriter(c SinkConfig) *syslogWriter {
+	w := &syslogWriter{
+		network:  c.Network,
+		address:  c.Address,
+		facility: syslogFacilities["local0"],
+		appName:  c.AppName,
+		hostname: "-",
+	}
+	if f, ok := syslogFacilities[c.Facility]; ok {
+		w.facility = f
+	}
+	if w.appName == "" {
+		w.appName = defaultSyslogAppName
+	}
+	if h, err := os.Hostname(); err == nil && h != "" {
+		w.hostname = h
+	}
+	return w
+}
+
+func (w *syslogWriter) dial() error {
+	var err error
+	switch w.network {
+	case "unix":
+		// the local syslog daemons usually listen on datagram sockets
+		if w.conn, err = net.Dial("unixgram", w.address); err == nil {
+			w.stream = false
+			return nil
+		}
+		w.conn, err = net.Dial("unix", w.address)
+		w.stream = true
+	default:
+		w.conn, err = net.DialTimeout(w.network, w.address, 5*time.Second)
+		w.stream = w.network == "tcp"
+	}
+	return err
+}
+
+// format returns the RFC 5424 message of a result, its content is the result as JSON
+func (w *syslogWriter) format(r *probeResult) ([]byte, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	severity := 6 // informational
+	switch r.Outcome {
+	case ResultConnectionFailure:
+		severity = 3 // error
+	case ResultOriginFailure:
+		severity = 4 // warning
+	}
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s %d probe - %s",
+		w.facility*8+severity, r.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		w.hostname, w.appName, os.Getpid(), data)), nil
+}
+
+func (w *syslogWriter) write(r *probeResult) error {
+	msg, err := w.format(r)
+	if err != nil {
+		return err
+	}
+	if w.conn == nil {
+		if err := w.dial(); err != nil {
+			w.conn = nil
+			return err
+		}
+	}
+	if w.stream {
+		if w.network == "tcp" {
+			// octet counting framing of RFC 6587
+			msg = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+		} else {
+			msg = append(msg, '\n')
+		}
+	}
+	w.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := w.conn.Write(msg); err != nil {
+		w.conn.Close()
+		w.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (w *syslogWriter) close() error {
+	if w.conn == nil {
+		return nil
+	}
+	return w.conn.Close()
+}
@@ -0,0 +1,288 @@
+package exporter
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+	log "github.com/sirupsen/logrus"
+)
+
+// statusHistory is the number of outcomes of the sparklines of the status page
+const statusHistory = 30
+
+// Results of the pairs on the status page
+const (
+	ResultUnknown           = "unknown"
+	ResultOK                = "ok"
+	ResultOriginFailure     = "origin_failure"
+	ResultConnectionFailure = "connection_failure"
+)
+
+// PairResult is the state of a (proxy, target) pair on the status page
+type PairResult struct {
+	ProxyURL  string     `json:"proxy_url"`
+	TargetURL string     `json:"target_url"`
+	LastProbe *time.Time `json:"last_probe,omitempty"`
+	Result    string     `json:"result"`
+	// LatencySeconds is the duration of the last probe
+	LatencySeconds float64    `json:"latency_seconds"`
+	LastSuccess    *time.Time `json:"last_success,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	// History are the results of the last probes, from the oldest one
+	History []string `json:"history"`
+	// Causes are the causes of the errors of the probes of the history, empty for the successes
+	Causes []string `json:"causes"`
+	// Latencies are the durations of the successful probes of the history
+	Latencies []float64 `json:"latencies_seconds"`
+}
+
+// Results is the state of all the pairs, served as JSON by /api/v1/results
+type Results struct {
+	Time    time.Time     `json:"time"`
+	Proxies []string      `json:"proxies"`
+	Targets []string      `json:"targets"`
+	Results []*PairResult `json:"results"`
+}
+
+// statusBoard keeps the last outcomes of each (proxy, target) pair
+type statusBoard struct {
+	mu      sync.Mutex
+	proxies []string
+	targets []string
+	pairs   map[pairKey]*PairResult
+}
+
+func newStatusBoard(proxyURLs []string, targets []Target) *statusBoard {
+	b := &statusBoard{pairs: make(map[pairKey]*PairResult)}
+	for _, p := range proxyURLs {
+		if p == systemProxy {
+			// the actual proxy is only known once picked for a target
+			continue
+		}
+		proxyURL, err := metricsProxyURL(p)
+		if err != nil {
+			continue
+		}
+		for _, t := range targets {
+			b.pair(proxyURL, t.URL)
+		}
+	}
+	return b
+}
+
+// pair returns the status of a pair, adding it if needed, with the lock held
+func (b *statusBoard) pair(proxyURL, targetURL string) *PairResult {
+	key := pairKey{proxyURL, targetURL}
+	if s, ok := b.pairs[key]; ok {
+		return s
+	}
+	if !containsString(b.proxies, proxyURL) {
+		b.proxies = append(b.proxies, proxyURL)
+	}
+	if !containsString(b.targets, targetURL) {
+		b.targets = append(b.targets, targetURL)
+	}
+	s := &PairResult{ProxyURL: proxyURL, TargetURL: targetURL, Result: ResultUnknown}
+	b.pairs[key] = s
+	return s
+}
+
+// outcomeResult returns the result of a probe outcome
+func outcomeResult(o probeOutcome) string {
+	if o.RequestSuccess {
+		return ResultOK
+	} else if o.ConnectionSuccess {
+		return ResultOriginFailure
+	}
+	return ResultConnectionFailure
+}
+
+func (b *statusBoard) record(o probeOutcome) {
+	result := outcomeResult(o)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.pair(o.ProxyURL, o.TargetURL)
+	t := o.Time
+	s.LastProbe = &t
+	s.Result = result
+	s.LatencySeconds = o.Duration.Seconds()
+	s.Error = redactURLs(o.Error)
+	if o.RequestSuccess {
+		s.LastSuccess = &t
+	}
+	s.History = append(s.History, result)
+	s.Causes = append(s.Causes, outcomeCause(o))
+	if o.RequestSuccess {
+		s.Latencies = append(s.Latencies, o.Duration.Seconds())
+	}
+	if len(s.History) > statusHistory {
+		if s.History[0] == ResultOK {
+			s.Latencies = s.Latencies[1:]
+		}
+		s.History = s.History[1:]
+		s.Causes = s.Causes[1:]
+	}
+}
+
+// results returns a copy of the state of the pairs
+func (b *statusBoard) results() *Results {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := &Results{
+		Time:    time.Now(),
+		Proxies: append([]string(nil), b.proxies...),
+		Targets: append([]string(nil), b.targets...),
+	}
+	for _, p := range b.proxies {
+		for _, t := range b.targets {
+			if s, ok := b.pairs[pairKey{p, t}]; ok {
+				c := *s
+				c.History = append([]string(nil), s.History...)
+				c.Causes = append([]string(nil), s.Causes...)
+				c.Latencies = append([]float64(nil), s.Latencies...)
+				r.Results = append(r.Results, &c)
+			}
+		}
+	}
+	return r
+}
+
+// outcomeCause returns the cause of the error of a probe outcome, its kind
+// of error when known, empty for a success
+func outcomeCause(o probeOutcome) string {
+	if o.ErrorKind != proxyclient.ErrorKindNone {
+		return string(o.ErrorKind)
+	}
+	return o.Cause
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ResultsHandler serves the last results of each (proxy, target) pair as JSON
+func (e *Exporter) ResultsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(e.Results())
+	})
+}
+
+// Results returns the last results of each (proxy, target) pair
+func (e *Exporter) Results() *Results {
+	return e.status.results()
+}
+
+// statusCell is a cell of the grid of the status page
+type statusCell struct {
+	*PairResult
+	Latency      string
+	SinceSuccess string
+	DebugURL     string
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="30">
+<title>http-proxy-exporter</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.4em 0.6em; vertical-align: top; }
+th { background: #f4f4f4; text-align: left; }
+td a { color: inherit; text-decoration: none; display: block; }
+.ok { background: #e3f6e3; }
+.origin_failure { background: #fff1d6; }
+.connection_failure { background: #fbdede; }
+.unknown { background: #f4f4f4; }
+.spark span { display: inline-block; width: 4px; height: 12px; margin-right: 1px; }
+.spark .ok { background: #2e9e2e; }
+.spark .origin_failure { background: #e69500; }
+.spark .connection_failure { background: #d32f2f; }
+.detail { font-size: 0.85em; color: #555; }
+</style>
+</head>
+<body>
+<h1>Proxies</h1>
+<p class="detail">Updated {{.Time.Format "2006-01-02 15:04:05 MST"}}, <a href="/api/v1/results">JSON</a>, <a href="/metrics">metrics</a></p>
+<table>
+<tr><th>Proxy \ Target</th>{{range .Targets}}<th>{{.}}</th>{{end}}</tr>
+{{range .Rows}}<tr><th>{{if .Proxy}}{{.Proxy}}{{else}}DIRECT{{end}}</th>
+{{range .Cells}}{{if .}}<td class="{{.Result}}" title="{{.Error}}"><a href="{{.DebugURL}}">
+<strong>{{.Result}}</strong> {{.Latency}}<br>
+<span class="detail">last success: {{.SinceSuccess}}</span><br>
+<span class="spark">{{range .History}}<span class="{{.}}"></span>{{end}}</span>
+</a></td>{{else}}<td></td>{{end}}{{end}}
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// StatusHandler serves a page with the grid of the last results of the proxies against the targets
+func (e *Exporter) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		results := e.status.results()
+		type row struct {
+			Proxy string
+			Cells []*statusCell
+		}
+		data := struct {
+			*Results
+			Rows []row
+		}{Results: results}
+
+		byPair := make(map[pairKey]*PairResult, len(results.Results))
+		for _, s := range results.Results {
+			byPair[pairKey{s.ProxyURL, s.TargetURL}] = s
+		}
+		for _, p := range results.Proxies {
+			rw := row{Proxy: p}
+			for _, t := range results.Targets {
+				s, ok := byPair[pairKey{p, t}]
+				if !ok {
+					rw.Cells = append(rw.Cells, nil)
+					continue
+				}
+				cell := &statusCell{
+					PairResult:   s,
+					SinceSuccess: "never",
+					DebugURL:     "/debug/probe?" + url.Values{"proxy": {p}, "target": {t}}.Encode(),
+				}
+				if s.LastProbe != nil {
+					cell.Latency = time.Duration(s.LatencySeconds * float64(time.Second)).Round(time.Millisecond).String()
+				}
+				if s.LastSuccess != nil {
+					cell.SinceSuccess = results.Time.Sub(*s.LastSuccess).Round(time.Second).String() + " ago"
+				}
+				rw.Cells = append(rw.Cells, cell)
+			}
+			data.Rows = append(data.Rows, rw)
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := statusTemplate.Execute(w, data); err != nil {
+			log.Errorf("could not render status page: %s", err)
+		}
+	})
+}
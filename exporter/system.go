@@ -0,0 +1,66 @@
+package exporter
+
+import (
+	"net/url"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// systemProxy is the proxy entry using the proxy picked by the environment
+// (HTTP_PROXY, HTTPS_PROXY and NO_PROXY) for each target
+const systemProxy = "system"
+
+// systemDirect labels the probes of the system proxy entry reaching a target
+// directly, distinct from the explicit direct entry labelled with an empty string
+const systemDirect = "system:direct"
+
+// systemProxyLabel returns the label of the probes of the system proxy entry
+// through a picked proxy, apart from the entry of the same proxy if any
+func systemProxyLabel(proxyURL string) string {
+	if proxyURL == "" {
+		return systemDirect
+	}
+	return systemProxy + ":" + proxyURL
+}
+
+// systemProxyFor returns the proxy picked by the environment for a target, or
+// an empty string when the target is reached directly
+func systemProxyFor(targetURL string) (string, error) {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return "", err
+	}
+	// read the environment on each call, unlike http.ProxyFromEnvironment
+	proxyURL, err := httpproxy.FromEnvironment().ProxyFunc()(u)
+	if err != nil || proxyURL == nil {
+		return "", err
+	}
+	return proxyURL.String(), nil
+}
+
+// onSystemProxySelection exposes the proxy picked by the environment for a
+// target, systemDirect when bypassed, and whether it matches the expected
+// NO_PROXY bypass
+func (e *Exporter) onSystemProxySelection(target Target, proxyURL string) {
+	e.systemSelectionsMu.Lock()
+	if last, ok := e.systemSelections[target.URL]; ok && last != proxyURL {
+		e.metrics.proxySystemSelected.DeleteLabelValues(target.URL, last)
+	}
+	e.systemSelections[target.URL] = proxyURL
+	e.systemSelectionsMu.Unlock()
+
+	e.metrics.proxySystemSelected.WithLabelValues(target.URL, proxyURL).Set(1)
+
+	bypass := proxyURL == systemDirect
+	e.metrics.proxySystemBypass.WithLabelValues(target.URL).Set(boolToFloat(bypass))
+	if target.ExpectBypass != nil {
+		e.metrics.proxySystemBypassExpected.WithLabelValues(target.URL).Set(boolToFloat(bypass == *target.ExpectBypass))
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,109 @@
+package exporter
+
+import (
+	"os"
+	"testing"
+
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func setenv(t *testing.T, env map[string]string) func() {
+	previous := make(map[string]*string)
+	for k, v := range env {
+		if old, ok := os.LookupEnv(k); ok {
+			previous[k] = &old
+		} else {
+			previous[k] = nil
+		}
+		require.NoError(t, os.Setenv(k, v))
+	}
+	return func() {
+		for k, v := range previous {
+			if v == nil {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, *v)
+			}
+		}
+	}
+}
+
+func TestSystemProxy(t *testing.T) {
+	e := newTestExporter(t, Config{})
+
+	proxyURL, done := runProxy(t, 200)
+	defer done()
+
+	restore := setenv(t, map[string]string{
+		"HTTP_PROXY":  proxyURL,
+		"http_proxy":  proxyURL,
+		"NO_PROXY":    ".corp.example.com",
+		"no_proxy":    ".corp.example.com",
+		"HTTPS_PROXY": "",
+		"https_proxy": "",
+	})
+	defer restore()
+
+	expectBypass := true
+	proxied := Target{URL: "http://i_wont_be_resolved.example.com/", ExpectBypass: &expectBypass}
+	e.measureOne(systemProxy, proxied, &proxyclient.AuthMethod{})
+
+	systemProxyURL := "system:" + proxyURL
+	require.Equal(t, 1.0, testutil.ToFloat64(e.metrics.proxySystemSelected.WithLabelValues(proxied.URL, systemProxyURL)))
+	require.Equal(t, 0.0, testutil.ToFloat64(e.metrics.proxySystemBypass.WithLabelValues(proxied.URL)))
+	require.Equal(t, 0.0, testutil.ToFloat64(e.metrics.proxySystemBypassExpected.WithLabelValues(proxied.URL)))
+	requireCounter(t,
+		e.metrics.proxyConnectionTentatives,
+		prometheus.Labels{"proxy_url": systemProxyURL, "resource_url": proxied.URL},
+		1,
+	)
+
+	// the entry of the same proxy is labelled apart
+	e.measureOne(proxyURL, proxied, &proxyclient.AuthMethod{})
+	requireCounter(t,
+		e.metrics.proxyConnectionTentatives,
+		prometheus.Labels{"proxy_url": proxyURL, "resource_url": proxied.URL},
+		1,
+	)
+	requireCounter(t,
+		e.metrics.proxyConnectionTentatives,
+		prometheus.Labels{"proxy_url": systemProxyURL, "resource_url": proxied.URL},
+		1,
+	)
+
+	selected, err := systemProxyFor("http://intranet.corp.example.com/")
+	require.NoError(t, err)
+	require.Equal(t, "", selected)
+
+	// loopback targets are always reached directly
+	originURL, done := runOrigin(t, 200)
+	defer done()
+
+	direct := Target{URL: originURL, ExpectBypass: &expectBypass}
+	e.measureOne(systemProxy, direct, &proxyclient.AuthMethod{})
+
+	require.Equal(t, 1.0, testutil.ToFloat64(e.metrics.proxySystemSelected.WithLabelValues(direct.URL, systemDirect)))
+	require.Equal(t, 1.0, testutil.ToFloat64(e.metrics.proxySystemBypass.WithLabelValues(direct.URL)))
+	require.Equal(t, 1.0, testutil.ToFloat64(e.metrics.proxySystemBypassExpected.WithLabelValues(direct.URL)))
+	requireCounter(t,
+		e.metrics.proxyRequestsSuccesses,
+		prometheus.Labels{"proxy_url": systemDirect, "resource_url": direct.URL, "status_code": "200"},
+		1,
+	)
+
+	// the explicit direct entry is labelled apart
+	e.measureOne("", direct, &proxyclient.AuthMethod{})
+	requireCounter(t,
+		e.metrics.proxyRequestsSuccesses,
+		prometheus.Labels{"proxy_url": "", "resource_url": direct.URL, "status_code": "200"},
+		1,
+	)
+	requireCounter(t,
+		e.metrics.proxyRequestsSuccesses,
+		prometheus.Labels{"proxy_url": systemDirect, "resource_url": direct.URL, "status_code": "200"},
+		1,
+	)
+}
@@ -0,0 +1,321 @@
+package exporter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	otlpTracesHTTPPath = "/v1/traces"
+	otlpTracesGRPCPath = "/opentelemetry.proto.collector.trace.v1.TraceService/Export"
+
+	defaultTracingInterval = 5 * time.Second
+	// tracingBuffer is the number of traces waiting to be exported, the next ones are dropped
+	tracingBuffer = 1024
+	// tracingBatch is the number of traces exported at once
+	tracingBatch = 256
+
+	spanKindInternal = 1
+	spanKindClient   = 3
+	spanStatusError  = 2
+)
+
+// traceContext identifies the trace of a probe and its root span
+type traceContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+}
+
+func newTraceContext() *traceContext {
+	tc := &traceContext{}
+	rand.Read(tc.traceID[:])
+	rand.Read(tc.spanID[:])
+	return tc
+}
+
+// traceparent returns the W3C traceparent header of the root span, sampled
+func (tc *traceContext) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(tc.traceID[:]), hex.EncodeToString(tc.spanID[:]))
+}
+
+// header returns the headers propagating the trace context to the proxies and origins
+func (tc *traceContext) header() http.Header {
+	return http.Header{"Traceparent": {tc.traceparent()}}
+}
+
+// probeSpan is a span of the trace of a probe
+type probeSpan struct {
+	name       string
+	spanID     [8]byte
+	kind       int
+	start, end time.Time
+	attributes []byte
+	// err is the error of the failed steps
+	err string
+}
+
+func (s *probeSpan) setAttribute(k, v string) {
+	s.attributes = appendMessage(s.attributes, 9, keyValue(k, v))
+}
+
+// probeTrace is the trace of a probe: a root span and the spans of its steps
+type probeTrace struct {
+	traceContext
+	root  *probeSpan
+	steps []*probeSpan
+}
+
+// probeConnection describes the connection of a probe, to name the spans of its steps
+type probeConnection struct {
+	// proxied is whether the target is requested through a proxy, over TLS for proxyTLS
+	proxied  bool
+	proxyTLS bool
+	// tunnel is whether the target is requested through a CONNECT tunnel
+	tunnel bool
+}
+
+// newProbeTrace returns the trace of a probe, with the spans of its steps built from its events
+func newProbeTrace(o probeOutcome, d probeDetails) *probeTrace {
+	r := newProbeResult(o, d)
+	root := &probeSpan{name: "probe", spanID: d.Trace.spanID, kind: spanKindClient, start: o.Time.Add(-o.Duration), end: o.Time}
+	if len(d.Events) > 0 {
+		root.start = d.Events[0].Time
+	}
+	root.setAttribute("probe.id", r.ProbeID)
+	root.setAttribute("proxy.url", r.ProxyURL)
+	root.setAttribute("url.full", r.TargetURL)
+	root.setAttribute("probe.outcome", r.Outcome)
+	if r.Cause != "" {
+		root.setAttribute("probe.cause", r.Cause)
+	}
+	if r.ResolvedIP != "" {
+		root.setAttribute("proxy.address", r.ResolvedIP)
+	}
+	if r.StatusCode != 0 {
+		root.attributes = appendMessage(root.attributes, 9, keyValueInt("http.response.status_code", int64(r.StatusCode)))
+	}
+	root.err = r.Error
+
+	return &probeTrace{traceContext: *d.Trace, root: root, steps: stepSpans(d.Events, d.Connection, root.end)}
+}
+
+// stepSpans returns the spans of the steps of a probe from its events: the
+// DNS resolution, the connection, the TLS handshakes with the proxy and the
+// origin, the CONNECT exchange and the response. The CONNECT exchange has no
+// event, it spans from the connection to the proxy to the handshake with the
+// origin. The steps not done by the end of the probe end with it.
+func stepSpans(events []proxyclient.Event, conn probeConnection, end time.Time) []*probeSpan {
+	var (
+		spans                  []*probeSpan
+		dns, tlsHandshake, rsp *probeSpan
+		connects               []*probeSpan
+		connect                *probeSpan
+		handshakes             int
+	)
+	begin := func(name string, e proxyclient.Event) *probeSpan {
+		s := &probeSpan{name: name, kind: spanKindInternal, start: e.Time, end: end}
+		rand.Read(s.spanID[:])
+		if e.Detail != "" {
+			s.setAttribute("probe.detail", redactURLs(e.Detail))
+		}
+		spans = append(spans, s)
+		return s
+	}
+	finish := func(s *probeSpan, e proxyclient.Event) {
+		if s == nil {
+			return
+		}
+		s.end = e.Time
+		if e.Failed {
+			s.err = redactURLs(e.Detail)
+		}
+	}
+	// tunnel opens the span of the CONNECT exchange once connected to the proxy
+	tunnel := func(e proxyclient.Event) {
+		if conn.tunnel && !e.Failed && connect == nil {
+			connect = begin("proxy CONNECT", proxyclient.Event{Time: e.Time})
+		}
+	}
+
+	for _, e := range events {
+		switch e.Name {
+		case "dns_start":
+			dns = begin("dns", e)
+		case "dns_done":
+			finish(dns, e)
+		case "connect_start":
+			name := "connect"
+			if conn.proxied {
+				name = "proxy connect"
+			}
+			connects = append(connects, begin(name, e))
+		case "connect_done":
+			// the dials of dual-stack hosts may race
+			if len(connects) > 0 {
+				finish(connects[0], e)
+				connects = connects[1:]
+			}
+			if !conn.proxyTLS {
+				tunnel(e)
+			}
+		case "tls_handshake_start":
+			name := "origin tls handshake"
+			if conn.proxyTLS && handshakes == 0 {
+				name = "proxy tls handshake"
+			} else if connect != nil {
+				connect.end = e.Time
+			}
+			handshakes++
+			tlsHandshake = begin(name, e)
+		case "tls_handshake_done":
+			finish(tlsHandshake, e)
+			if conn.proxyTLS && handshakes == 1 {
+				tunnel(e)
+			}
+		case "wrote_request":
+			rsp = begin("response", e)
+		case "done":
+			finish(rsp, e)
+			if connect != nil && connect.end.Equal(end) {
+				// the tunnel was not established
+				finish(connect, e)
+			}
+		}
+	}
+	return spans
+}
+
+// encode encodes the spans of a trace
+func (t *probeTrace) encode(b []byte) []byte {
+	b = appendMessage(b, 2, t.encodeSpan(t.root, nil))
+	for _, s := range t.steps {
+		b = appendMessage(b, 2, t.encodeSpan(s, t.spanID[:]))
+	}
+	return b
+}
+
+func (t *probeTrace) encodeSpan(s *probeSpan, parent []byte) []byte {
+	var b []byte
+	b = appendBytes(b, 1, t.traceID[:])
+	b = appendBytes(b, 2, s.spanID[:])
+	if parent != nil {
+		b = appendBytes(b, 4, parent)
+	}
+	b = appendString(b, 5, s.name)
+	b = appendVarint(b, 6, uint64(s.kind))
+	b = appendFixed64(b, 7, uint64(s.start.UnixNano()))
+	b = appendFixed64(b, 8, uint64(s.end.UnixNano()))
+	b = append(b, s.attributes...)
+	if s.err != "" {
+		b = appendMessage(b, 15, appendVarint(appendString(nil, 2, s.err), 3, spanStatusError))
+	}
+	return b
+}
+
+// otlpTracesRequest encodes the traces as an ExportTraceServiceRequest
+func otlpTracesRequest(traces []*probeTrace, resource map[string]string, version string) []byte {
+	scope := appendMessage(nil, 1, otlpScope(version))
+	for _, t := range traces {
+		scope = t.encode(scope)
+	}
+	var rs []byte
+	rs = appendMessage(rs, 1, otlpResourceMessage(resource))
+	rs = appendMessage(rs, 2, scope)
+	return appendMessage(nil, 1, rs)
+}
+
+// probeTracer exports the traces of the probes to a collector in batches
+type probeTracer struct {
+	client   *otlpClient
+	interval time.Duration
+	resource map[string]string
+	version  string
+
+	queue chan *probeTrace
+	// exports counts the exports by result
+	exports *prometheus.CounterVec
+	dropped prometheus.Counter
+}
+
+func newProbeTracer(c OTLPConfig, m *metrics, version string) (*probeTracer, error) {
+	client, err := newOTLPClient(c, otlpTracesHTTPPath, otlpTracesGRPCPath)
+	if err != nil {
+		return nil, err
+	}
+	interval, err := parseDurationOr(c.Interval, defaultTracingInterval)
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid tracing interval %q", c.Interval)
+	}
+	t := &probeTracer{
+		client:   client,
+		interval: interval,
+		resource: otlpResource(c, version),
+		version:  version,
+		queue:    make(chan *probeTrace, tracingBuffer),
+	}
+	if m != nil {
+		t.exports, t.dropped = m.tracingExports, m.tracingDropped
+	}
+	return t, nil
+}
+
+// send queues a trace for the next export, it is dropped when the queue is full
+func (t *probeTracer) send(trace *probeTrace) {
+	select {
+	case t.queue <- trace:
+	default:
+		t.dropped.Inc()
+	}
+}
+
+// run exports the queued traces every interval or once a batch is full, and
+// the remaining ones once the context is done
+func (t *probeTracer) run(ctx context.Context) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	var batch []*probeTrace
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case trace := <-t.queue:
+					batch = append(batch, trace)
+				default:
+					t.export(context.Background(), batch)
+					return
+				}
+			}
+		case trace := <-t.queue:
+			batch = append(batch, trace)
+			if len(batch) >= tracingBatch {
+				t.export(ctx, batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.export(ctx, batch)
+			batch = nil
+		}
+	}
+}
+
+func (t *probeTracer) export(ctx context.Context, batch []*probeTrace) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := t.client.export(ctx, otlpTracesRequest(batch, t.resource, t.version)); err != nil {
+		log.Warnf("could not export %d traces to %s: %s", len(batch), t.client.url, err)
+		t.exports.WithLabelValues(otlpResultFailure).Inc()
+		return
+	}
+	t.exports.WithLabelValues(otlpResultSuccess).Inc()
+}
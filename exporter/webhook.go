@@ -0,0 +1,292 @@
+package exporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	webhookEventProxyDown      = "proxy_down"
+	webhookEventProxyRecovered = "proxy_recovered"
+
+	webhookResultSuccess      = "success"
+	webhookResultFailure      = "failure"
+	webhookResultDeduplicated = "deduplicated"
+)
+
+// WebhookConfig is an URL notified of proxy state changes
+type WebhookConfig struct {
+	URL         string            `yaml:"url"`
+	Headers     map[string]string `yaml:"headers,omitempty"`
+	Timeout     string            `yaml:"timeout,omitempty"`
+	Retries     int               `yaml:"retries,omitempty"`
+	DedupWindow string            `yaml:"dedup_window,omitempty"`
+}
+
+// webhook is a parsed WebhookConfig
+type webhook struct {
+	url         string
+	headers     map[string]string
+	timeout     time.Duration
+	retries     int
+	dedupWindow time.Duration
+}
+
+func parseWebhook(c WebhookConfig) (*webhook, error) {
+	if c.URL == "" {
+		return nil, fmt.Errorf("webhook url must be provided")
+	}
+	timeout, err := parseDurationOr(c.Timeout, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook timeout: %s", err)
+	}
+	dedupWindow, err := parseDurationOr(c.DedupWindow, 5*time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook dedup_window: %s", err)
+	}
+	retries := c.Retries
+	if retries < 0 {
+		return nil, fmt.Errorf("webhook retries must not be negative")
+	}
+	return &webhook{
+		url:         c.URL,
+		headers:     c.Headers,
+		timeout:     timeout,
+		retries:     retries,
+		dedupWindow: dedupWindow,
+	}, nil
+}
+
+// webhookEvent is the JSON document posted to webhooks
+type webhookEvent struct {
+	Event          string                 `json:"event"`
+	ProxyURL       string                 `json:"proxy_url"`
+	State          string                 `json:"state"`
+	PreviousState  string                 `json:"previous_state"`
+	Time           time.Time              `json:"time"`
+	LastSuccess    *time.Time             `json:"last_success,omitempty"`
+	FailingTargets []webhookFailingTarget `json:"failing_targets"`
+}
+
+type webhookFailingTarget struct {
+	ResourceURL string    `json:"resource_url"`
+	Cause       string    `json:"cause"`
+	Error       string    `json:"error,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// newWebhookEvent builds the event of a transition, it returns nil for
+// transitions which are not notified (only going down and recovering are)
+func newWebhookEvent(t *healthTransition) *webhookEvent {
+	var event string
+	switch {
+	case t.To == healthStateDown:
+		event = webhookEventProxyDown
+	case t.Recovered:
+		event = webhookEventProxyRecovered
+	default:
+		return nil
+	}
+
+	e := &webhookEvent{
+		Event:          event,
+		ProxyURL:       t.ProxyURL,
+		State:          t.To,
+		PreviousState:  t.From,
+		Time:           t.Time,
+		FailingTargets: []webhookFailingTarget{},
+	}
+	if !t.LastSuccess.IsZero() {
+		lastSuccess := t.LastSuccess
+		e.LastSuccess = &lastSuccess
+	}
+	for _, f := range t.FailingTargets {
+		e.FailingTargets = append(e.FailingTargets, webhookFailingTarget{
+			ResourceURL: f.TargetURL,
+			Cause:       f.Cause,
+			Error:       f.Error,
+			Time:        f.Time,
+		})
+	}
+	return e
+}
+
+// webhookNotifier posts proxy state changes to the configured webhooks
+type webhookNotifier struct {
+	webhooks   []*webhook
+	client     *http.Client
+	retryDelay time.Duration
+	now        func() time.Time
+	// notifications counts the notifications by event and result
+	notifications *prometheus.CounterVec
+
+	mu sync.Mutex
+	// lastSent is the last event sent to each webhook for each proxy
+	lastSent map[string]sentEvent
+	// queues are the pending deliveries to each webhook for each proxy, in
+	// order, while they are being delivered
+	queues map[string][]webhookDelivery
+	wg     sync.WaitGroup
+}
+
+// sentEvent is an event sent to a webhook
+type sentEvent struct {
+	event string
+	time  time.Time
+}
+
+// webhookDelivery is an event waiting to be posted to a webhook
+type webhookDelivery struct {
+	webhook *webhook
+	event   string
+	body    []byte
+}
+
+func newWebhookNotifier(configs []WebhookConfig, notifications *prometheus.CounterVec) (*webhookNotifier, error) {
+	n := &webhookNotifier{
+		client:        &http.Client{},
+		retryDelay:    time.Second,
+		now:           time.Now,
+		notifications: notifications,
+		lastSent:      make(map[string]sentEvent),
+		queues:        make(map[string][]webhookDelivery),
+	}
+	for _, c := range configs {
+		w, err := parseWebhook(c)
+		if err != nil {
+			return nil, err
+		}
+		n.webhooks = append(n.webhooks, w)
+	}
+	return n, nil
+}
+
+// notify sends the event of a transition to every webhook in the background,
+// after the previous events of the proxy
+func (n *webhookNotifier) notify(t *healthTransition) {
+	e := newWebhookEvent(t)
+	if e == nil {
+		return
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("could not encode webhook event: %s", err)
+		return
+	}
+
+	for i, w := range n.webhooks {
+		key := fmt.Sprintf("%d|%s", i, e.ProxyURL)
+		if n.deduplicated(key, e.Event, w.dedupWindow) {
+			n.notifications.WithLabelValues(e.Event, webhookResultDeduplicated).Inc()
+			continue
+		}
+		n.enqueue(key, webhookDelivery{webhook: w, event: e.Event, body: body})
+	}
+}
+
+// deduplicated reports whether the last event sent for the key is the same
+// one and was sent within the window, a change of state is always sent
+func (n *webhookNotifier) deduplicated(key, event string, window time.Duration) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := n.now()
+	if last, ok := n.lastSent[key]; ok && last.event == event && now.Sub(last.time) < window {
+		return true
+	}
+	n.lastSent[key] = sentEvent{event: event, time: now}
+	return false
+}
+
+// enqueue queues a delivery for the key, delivered by a single goroutine per
+// key so that the events of a proxy are received in order, retries included
+func (n *webhookNotifier) enqueue(key string, d webhookDelivery) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	_, running := n.queues[key]
+	n.queues[key] = append(n.queues[key], d)
+	if running {
+		return
+	}
+	n.wg.Add(1)
+	go n.drain(key)
+}
+
+// drain delivers the queued events of a key until there are none left
+func (n *webhookNotifier) drain(key string) {
+	defer n.wg.Done()
+	for {
+		n.mu.Lock()
+		queue := n.queues[key]
+		if len(queue) == 0 {
+			delete(n.queues, key)
+			n.mu.Unlock()
+			return
+		}
+		d := queue[0]
+		n.queues[key] = queue[1:]
+		n.mu.Unlock()
+
+		n.deliver(d.webhook, d.event, d.body)
+	}
+}
+
+// deliver posts the event, retrying with an exponential backoff
+func (n *webhookNotifier) deliver(w *webhook, event string, body []byte) {
+	delay := n.retryDelay
+	for attempt := 0; attempt <= w.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		err := n.post(w, body)
+		if err == nil {
+			n.notifications.WithLabelValues(event, webhookResultSuccess).Inc()
+			return
+		}
+		// do not log the webhook url in case it contains a token
+		log.Warnf("webhook delivery of %s failed (attempt %d/%d): %s", event, attempt+1, w.retries+1, err)
+	}
+	n.notifications.WithLabelValues(event, webhookResultFailure).Inc()
+}
+
+func (n *webhookNotifier) post(w *webhook, body []byte) error {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+
+	client := *n.client
+	client.Timeout = w.timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			return urlErr.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	return nil
+}
+
+// wait blocks until all pending deliveries are done
+func (n *webhookNotifier) wait() {
+	n.wg.Wait()
+}
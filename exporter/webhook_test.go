@@ -0,0 +1,148 @@
+package exporter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+type webhookReceiver struct {
+	mu       sync.Mutex
+	events   []webhookEvent
+	failures int
+}
+
+func (r *webhookReceiver) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.failures > 0 {
+		r.failures--
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	var e webhookEvent
+	if err := json.NewDecoder(req.Body).Decode(&e); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.events = append(r.events, e)
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	notifications := newMetrics().webhookNotifications
+
+	receiver := &webhookReceiver{failures: 1}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	n, err := newWebhookNotifier([]WebhookConfig{{URL: srv.URL, Retries: 2, DedupWindow: "1h"}}, notifications)
+	require.NoError(t, err)
+	n.retryDelay = time.Millisecond
+
+	proxyURL := "http://proxy:8080"
+	targetURL := "https://www.example.com/"
+	lastSuccess := time.Now().Add(-time.Minute)
+
+	h := newHealthTracker(HealthConfig{DownAfter: 2})
+	h.record(probeOutcome{Time: lastSuccess, ProxyURL: proxyURL, TargetURL: targetURL, ConnectionSuccess: true})
+	n.notify(h.record(probeOutcome{Time: time.Now(), ProxyURL: proxyURL, TargetURL: targetURL, Cause: "proxy", Error: "bad gateway"}))
+	down := h.record(probeOutcome{Time: time.Now(), ProxyURL: proxyURL, TargetURL: targetURL, Cause: "proxy", Error: "bad gateway"})
+	require.Equal(t, healthStateDown, down.To)
+
+	n.notify(down)
+	// the same event is not sent twice within the dedup window
+	n.notify(down)
+	n.wait()
+
+	require.Len(t, receiver.events, 1)
+	e := receiver.events[0]
+	require.Equal(t, webhookEventProxyDown, e.Event)
+	require.Equal(t, proxyURL, e.ProxyURL)
+	require.Equal(t, healthStateDown, e.State)
+	require.NotNil(t, e.LastSuccess)
+	require.True(t, lastSuccess.Equal(*e.LastSuccess))
+	require.Len(t, e.FailingTargets, 1)
+	require.Equal(t, targetURL, e.FailingTargets[0].ResourceURL)
+	require.Equal(t, "proxy", e.FailingTargets[0].Cause)
+
+	requireCounter(t, notifications,
+		prometheus.Labels{"event": webhookEventProxyDown, "result": webhookResultSuccess}, 1)
+	requireCounter(t, notifications,
+		prometheus.Labels{"event": webhookEventProxyDown, "result": webhookResultDeduplicated}, 1)
+
+	// recovery is notified as well
+	h.record(probeOutcome{Time: time.Now(), ProxyURL: proxyURL, TargetURL: targetURL, ConnectionSuccess: true})
+	n.notify(h.record(probeOutcome{Time: time.Now(), ProxyURL: proxyURL, TargetURL: targetURL, ConnectionSuccess: true}))
+	n.wait()
+
+	require.Len(t, receiver.events, 2)
+	require.Equal(t, webhookEventProxyRecovered, receiver.events[1].Event)
+	require.Empty(t, receiver.events[1].FailingTargets)
+}
+
+func TestWebhookNotifierFailure(t *testing.T) {
+	notifications := newMetrics().webhookNotifications
+
+	receiver := &webhookReceiver{failures: 10}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	n, err := newWebhookNotifier([]WebhookConfig{{URL: srv.URL, Retries: 1}}, notifications)
+	require.NoError(t, err)
+	n.retryDelay = time.Millisecond
+
+	n.notify(&healthTransition{ProxyURL: "http://proxy:8080", From: healthStateDegraded, To: healthStateDown})
+	n.wait()
+
+	require.Empty(t, receiver.events)
+	require.Equal(t, 8, receiver.failures)
+	requireCounter(t, notifications,
+		prometheus.Labels{"event": webhookEventProxyDown, "result": webhookResultFailure}, 1)
+}
+
+func TestWebhookNotifierStateChanges(t *testing.T) {
+	notifications := newMetrics().webhookNotifications
+
+	// the first delivery is retried, the next events must wait for it
+	receiver := &webhookReceiver{failures: 1}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	n, err := newWebhookNotifier([]WebhookConfig{{URL: srv.URL, Retries: 2, DedupWindow: "1h"}}, notifications)
+	require.NoError(t, err)
+	n.retryDelay = 20 * time.Millisecond
+
+	proxyURL := "http://proxy:8080"
+	down := &healthTransition{ProxyURL: proxyURL, From: healthStateUp, To: healthStateDown}
+	recovered := &healthTransition{ProxyURL: proxyURL, From: healthStateDown, To: healthStateUp, Recovered: true}
+
+	// a proxy going down again after recovering is notified within the dedup window
+	n.notify(down)
+	n.notify(recovered)
+	n.notify(down)
+	n.notify(down)
+	n.wait()
+
+	var events []string
+	for _, e := range receiver.events {
+		events = append(events, e.Event)
+	}
+	require.Equal(t, []string{webhookEventProxyDown, webhookEventProxyRecovered, webhookEventProxyDown}, events)
+	requireCounter(t, notifications,
+		prometheus.Labels{"event": webhookEventProxyDown, "result": webhookResultDeduplicated}, 1)
+}
+
+func TestParseWebhook(t *testing.T) {
+	_, err := parseWebhook(WebhookConfig{URL: "http://hooks/", Retries: 0})
+	require.NoError(t, err)
+	_, err = parseWebhook(WebhookConfig{URL: "http://hooks/", Retries: -1})
+	require.EqualError(t, err, "webhook retries must not be negative")
+}
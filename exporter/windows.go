@@ -0,0 +1,256 @@
+package exporter
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// windowQuantiles are the latency percentiles exported for each window
+var windowQuantiles = []float64{0.5, 0.9, 0.99}
+
+var (
+	windowSuccessRatioDesc = prometheus.NewDesc(
+		"proxy_window_success_ratio",
+		"Ratio of successful probes (connection and request) over the window, across all targets.",
+		[]string{"proxy_url", "window"}, nil,
+	)
+	windowConnectionSuccessRatioDesc = prometheus.NewDesc(
+		"proxy_window_connection_success_ratio",
+		"Ratio of successful connections towards proxy over the window, across all targets.",
+		[]string{"proxy_url", "window"}, nil,
+	)
+	windowRTTDesc = prometheus.NewDesc(
+		"proxy_window_rtt_seconds",
+		"Percentiles of successful requests durations over the window, across all targets.",
+		[]string{"proxy_url", "window"}, nil,
+	)
+	windowTargetSuccessRatioDesc = prometheus.NewDesc(
+		"proxy_window_target_success_ratio",
+		"Ratio of successful probes (connection and request) over the window.",
+		[]string{"proxy_url", "resource_url", "window"}, nil,
+	)
+	windowTargetRTTDesc = prometheus.NewDesc(
+		"proxy_window_target_rtt_seconds",
+		"Percentiles of successful requests durations over the window.",
+		[]string{"proxy_url", "resource_url", "window"}, nil,
+	)
+)
+
+// probeOutcome is the outcome of a single probe, as recorded by the on* callbacks
+type probeOutcome struct {
+	Time              time.Time
+	ProxyURL          string
+	TargetURL         string
+	ConnectionSuccess bool
+	RequestSuccess    bool
+	Duration          time.Duration
+	// Cause is the cause of the connection error, if any
+	Cause string
+	// ErrorKind is the kind of error of the probe, if any
+	ErrorKind proxyclient.ErrorKind
+	// Error is the error message of the probe, if any
+	Error string
+}
+
+// outcomeRing is a growable ring buffer of probe outcomes ordered by time
+type outcomeRing struct {
+	buf   []probeOutcome
+	start int
+	size  int
+}
+
+func (r *outcomeRing) push(o probeOutcome) {
+	if r.size == len(r.buf) {
+		grown := make([]probeOutcome, 2*len(r.buf)+1)
+		for i := 0; i < r.size; i++ {
+			grown[i] = r.at(i)
+		}
+		r.buf = grown
+		r.start = 0
+	}
+	r.buf[(r.start+r.size)%len(r.buf)] = o
+	r.size++
+}
+
+func (r *outcomeRing) at(i int) probeOutcome {
+	return r.buf[(r.start+i)%len(r.buf)]
+}
+
+// expire drops the outcomes recorded before the given time
+func (r *outcomeRing) expire(before time.Time) {
+	for r.size > 0 && r.at(0).Time.Before(before) {
+		r.buf[r.start] = probeOutcome{}
+		r.start = (r.start + 1) % len(r.buf)
+		r.size--
+	}
+}
+
+// since returns the outcomes recorded after the given time
+func (r *outcomeRing) since(after time.Time) []probeOutcome {
+	var out []probeOutcome
+	for i := r.size - 1; i >= 0; i-- {
+		o := r.at(i)
+		if o.Time.Before(after) {
+			break
+		}
+		out = append(out, o)
+	}
+	return out
+}
+
+type pairKey struct {
+	proxyURL  string
+	targetURL string
+}
+
+// slidingWindows keeps recent probe outcomes in memory and exports success
+// ratios and latency percentiles over the configured windows
+type slidingWindows struct {
+	mu      sync.Mutex
+	windows []time.Duration
+	now     func() time.Time
+
+	pairs   map[pairKey]*outcomeRing
+	proxies map[string]*outcomeRing
+}
+
+func newSlidingWindows(windows []time.Duration) *slidingWindows {
+	return &slidingWindows{
+		windows: windows,
+		now:     time.Now,
+		pairs:   make(map[pairKey]*outcomeRing),
+		proxies: make(map[string]*outcomeRing),
+	}
+}
+
+func (s *slidingWindows) retention() time.Duration {
+	var max time.Duration
+	for _, w := range s.windows {
+		if w > max {
+			max = w
+		}
+	}
+	return max
+}
+
+func (s *slidingWindows) record(o probeOutcome) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := pairKey{o.ProxyURL, o.TargetURL}
+	pair, ok := s.pairs[key]
+	if !ok {
+		pair = &outcomeRing{}
+		s.pairs[key] = pair
+	}
+	proxy, ok := s.proxies[o.ProxyURL]
+	if !ok {
+		proxy = &outcomeRing{}
+		s.proxies[o.ProxyURL] = proxy
+	}
+
+	expireBefore := s.now().Add(-s.retention())
+	for _, r := range []*outcomeRing{pair, proxy} {
+		r.push(o)
+		r.expire(expireBefore)
+	}
+}
+
+// Describe implements prometheus.Collector
+func (s *slidingWindows) Describe(ch chan<- *prometheus.Desc) {
+	ch <- windowSuccessRatioDesc
+	ch <- windowConnectionSuccessRatioDesc
+	ch <- windowRTTDesc
+	ch <- windowTargetSuccessRatioDesc
+	ch <- windowTargetRTTDesc
+}
+
+// Collect implements prometheus.Collector
+func (s *slidingWindows) Collect(ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for _, w := range s.windows {
+		window := w.String()
+		after := now.Add(-w)
+
+		for proxyURL, r := range s.proxies {
+			st := summarize(r.since(after))
+			if st.total == 0 {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(windowSuccessRatioDesc, prometheus.GaugeValue,
+				st.successRatio(), proxyURL, window)
+			ch <- prometheus.MustNewConstMetric(windowConnectionSuccessRatioDesc, prometheus.GaugeValue,
+				st.connectionSuccessRatio(), proxyURL, window)
+			ch <- prometheus.MustNewConstSummary(windowRTTDesc,
+				uint64(len(st.durations)), st.sum, st.quantiles(), proxyURL, window)
+		}
+
+		for key, r := range s.pairs {
+			st := summarize(r.since(after))
+			if st.total == 0 {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(windowTargetSuccessRatioDesc, prometheus.GaugeValue,
+				st.successRatio(), key.proxyURL, key.targetURL, window)
+			ch <- prometheus.MustNewConstSummary(windowTargetRTTDesc,
+				uint64(len(st.durations)), st.sum, st.quantiles(), key.proxyURL, key.targetURL, window)
+		}
+	}
+}
+
+// windowStats aggregates the outcomes of a window
+type windowStats struct {
+	total               int
+	connectionSuccesses int
+	requestSuccesses    int
+	durations           []float64
+	sum                 float64
+}
+
+func summarize(outcomes []probeOutcome) windowStats {
+	st := windowStats{total: len(outcomes)}
+	for _, o := range outcomes {
+		if o.ConnectionSuccess {
+			st.connectionSuccesses++
+		}
+		if o.RequestSuccess {
+			st.requestSuccesses++
+			st.durations = append(st.durations, o.Duration.Seconds())
+			st.sum += o.Duration.Seconds()
+		}
+	}
+	sort.Float64s(st.durations)
+	return st
+}
+
+func (st windowStats) successRatio() float64 {
+	return float64(st.requestSuccesses) / float64(st.total)
+}
+
+func (st windowStats) connectionSuccessRatio() float64 {
+	return float64(st.connectionSuccesses) / float64(st.total)
+}
+
+// quantiles computes the nearest-rank percentiles of the sorted durations
+func (st windowStats) quantiles() map[float64]float64 {
+	q := make(map[float64]float64, len(windowQuantiles))
+	if len(st.durations) == 0 {
+		return q
+	}
+	for _, p := range windowQuantiles {
+		rank := int(math.Ceil(p*float64(len(st.durations)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		q[p] = st.durations[rank]
+	}
+	return q
+}
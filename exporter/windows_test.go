@@ -0,0 +1,124 @@
+package exporter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func findMetric(t *testing.T, families []*dto.MetricFamily, name string, labels prometheus.Labels) *dto.Metric {
+	for _, mf := range families {
+		if mf.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if v, ok := labels[lp.GetName()]; ok && v != lp.GetValue() {
+					continue metrics
+				}
+			}
+			return m
+		}
+	}
+	return nil
+}
+
+func TestOutcomeRing(t *testing.T) {
+	base := time.Now()
+	r := &outcomeRing{}
+
+	for i := 0; i < 10; i++ {
+		r.push(probeOutcome{Time: base.Add(time.Duration(i) * time.Minute)})
+	}
+	require.Equal(t, 10, r.size)
+
+	r.expire(base.Add(5 * time.Minute))
+	require.Equal(t, 5, r.size)
+	require.Equal(t, base.Add(5*time.Minute), r.at(0).Time)
+
+	// wrap around the buffer after expiration
+	for i := 10; i < 20; i++ {
+		r.push(probeOutcome{Time: base.Add(time.Duration(i) * time.Minute)})
+	}
+	require.Equal(t, 15, r.size)
+	require.Len(t, r.since(base.Add(17*time.Minute)), 3)
+	require.Len(t, r.since(base), 15)
+}
+
+func TestWindowStatsQuantiles(t *testing.T) {
+	var outcomes []probeOutcome
+	for i := 1; i <= 100; i++ {
+		outcomes = append(outcomes, probeOutcome{
+			ConnectionSuccess: true,
+			RequestSuccess:    true,
+			Duration:          time.Duration(i) * time.Millisecond,
+		})
+	}
+	outcomes = append(outcomes, probeOutcome{})
+
+	st := summarize(outcomes)
+	require.Equal(t, 101, st.total)
+	require.InDelta(t, 100.0/101, st.successRatio(), 1e-9)
+	require.InDelta(t, 100.0/101, st.connectionSuccessRatio(), 1e-9)
+
+	q := st.quantiles()
+	require.InDelta(t, 0.050, q[0.5], 1e-9)
+	require.InDelta(t, 0.090, q[0.9], 1e-9)
+	require.InDelta(t, 0.099, q[0.99], 1e-9)
+}
+
+func TestSlidingWindowsCollect(t *testing.T) {
+	now := time.Now()
+	sw := newSlidingWindows([]time.Duration{5 * time.Minute, time.Hour})
+	sw.now = func() time.Time { return now }
+
+	proxyURL := "http://proxy:8080"
+	targetURL := "https://www.example.com/"
+
+	// an old failure only visible in the 1h window
+	sw.record(probeOutcome{
+		Time:      now.Add(-30 * time.Minute),
+		ProxyURL:  proxyURL,
+		TargetURL: targetURL,
+	})
+	// a recent origin failure and a recent success
+	sw.record(probeOutcome{
+		Time:              now.Add(-time.Minute),
+		ProxyURL:          proxyURL,
+		TargetURL:         targetURL,
+		ConnectionSuccess: true,
+	})
+	sw.record(probeOutcome{
+		Time:              now,
+		ProxyURL:          proxyURL,
+		TargetURL:         targetURL,
+		ConnectionSuccess: true,
+		RequestSuccess:    true,
+		Duration:          20 * time.Millisecond,
+	})
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(sw)
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	m := findMetric(t, families, "proxy_window_target_success_ratio",
+		prometheus.Labels{"proxy_url": proxyURL, "resource_url": targetURL, "window": "5m0s"})
+	require.NotNil(t, m)
+	require.Equal(t, 0.5, m.GetGauge().GetValue())
+
+	m = findMetric(t, families, "proxy_window_connection_success_ratio",
+		prometheus.Labels{"proxy_url": proxyURL, "window": "1h0m0s"})
+	require.NotNil(t, m)
+	require.InDelta(t, 2.0/3, m.GetGauge().GetValue(), 1e-9)
+
+	m = findMetric(t, families, "proxy_window_rtt_seconds",
+		prometheus.Labels{"proxy_url": proxyURL, "window": "1h0m0s"})
+	require.NotNil(t, m)
+	require.Equal(t, uint64(1), m.GetSummary().GetSampleCount())
+	require.Equal(t, 0.02, m.GetSummary().GetSampleSum())
+}
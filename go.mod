@@ -3,11 +3,13 @@ module github.com/criteo/http-proxy-exporter
 go 1.15
 
 require (
-	github.com/elazarl/goproxy v0.0.0-20200809112317-0581fc3aee2d
+	github.com/dop251/goja v0.0.0-20220405120441-9037c2b61cbf
 	github.com/phayes/freeport v0.0.0-20180830031419-95f893ade6f2
 	github.com/prometheus/client_golang v1.11.1
 	github.com/prometheus/client_model v0.2.0
 	github.com/sirupsen/logrus v1.6.0
 	github.com/stretchr/testify v1.5.1
-	gopkg.in/yaml.v2 v2.3.0
+	golang.org/x/net v0.0.0-20200625001655-4c5254603344
+	google.golang.org/protobuf v1.26.0
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,317 @@
+package pac
+
+import (
+	"encoding/binary"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+var (
+	// now is the clock used by the time-based functions
+	now = time.Now
+
+	// lookupHost is the resolver used by the DNS functions
+	lookupHost = net.LookupHost
+
+	weekdays = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+	months   = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+)
+
+// registerBuiltins defines the predefined functions available to PAC files
+func registerBuiltins(vm *goja.Runtime) {
+	vm.Set("isPlainHostName", isPlainHostName)
+	vm.Set("dnsDomainIs", dnsDomainIs)
+	vm.Set("localHostOrDomainIs", localHostOrDomainIs)
+	vm.Set("isResolvable", isResolvable)
+	vm.Set("isInNet", isInNet)
+	vm.Set("dnsResolve", func(host string) goja.Value {
+		ip := resolveIPv4(host)
+		if ip == nil {
+			return goja.Null()
+		}
+		return vm.ToValue(ip.String())
+	})
+	vm.Set("convert_addr", convertAddr)
+	vm.Set("myIpAddress", myIPAddress)
+	vm.Set("dnsDomainLevels", dnsDomainLevels)
+	vm.Set("shExpMatch", shExpMatch)
+	vm.Set("weekdayRange", func(call goja.FunctionCall) goja.Value {
+		return vm.ToValue(weekdayRange(exportArgs(call)))
+	})
+	vm.Set("dateRange", func(call goja.FunctionCall) goja.Value {
+		return vm.ToValue(dateRange(exportArgs(call)))
+	})
+	vm.Set("timeRange", func(call goja.FunctionCall) goja.Value {
+		return vm.ToValue(timeRange(exportArgs(call)))
+	})
+	vm.Set("alert", func(string) {})
+}
+
+func exportArgs(call goja.FunctionCall) []interface{} {
+	args := make([]interface{}, 0, len(call.Arguments))
+	for _, a := range call.Arguments {
+		args = append(args, a.Export())
+	}
+	return args
+}
+
+func isPlainHostName(host string) bool {
+	return !strings.Contains(host, ".")
+}
+
+func dnsDomainIs(host, domain string) bool {
+	return strings.HasSuffix(strings.ToLower(host), strings.ToLower(domain))
+}
+
+func localHostOrDomainIs(host, hostdom string) bool {
+	host, hostdom = strings.ToLower(host), strings.ToLower(hostdom)
+	if host == hostdom {
+		return true
+	}
+	return !strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+".")
+}
+
+func isResolvable(host string) bool {
+	return resolveIPv4(host) != nil
+}
+
+func isInNet(host, pattern, mask string) bool {
+	ip := resolveIPv4(host)
+	p := net.ParseIP(pattern).To4()
+	m := net.ParseIP(mask).To4()
+	if ip == nil || p == nil || m == nil {
+		return false
+	}
+	return ip.Mask(net.IPMask(m)).Equal(p.Mask(net.IPMask(m)))
+}
+
+// resolveIPv4 returns the first IPv4 address of a host, or nil
+func resolveIPv4(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.To4()
+	}
+	addrs, err := lookupHost(host)
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		if ip := net.ParseIP(a).To4(); ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+func convertAddr(ipaddr string) uint32 {
+	ip := net.ParseIP(ipaddr).To4()
+	if ip == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(ip)
+}
+
+// myIPAddress returns the address used to reach the outside, no packet is sent
+func myIPAddress() string {
+	conn, err := net.Dial("udp4", "198.51.100.1:53")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+func dnsDomainLevels(host string) int {
+	return strings.Count(host, ".")
+}
+
+func shExpMatch(str, shexp string) bool {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range shexp {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return false
+	}
+	return re.MatchString(str)
+}
+
+// clock returns the current time, in UTC if the last argument is "GMT", and
+// the remaining arguments
+func clock(args []interface{}) (time.Time, []interface{}) {
+	t := now()
+	if len(args) > 0 {
+		if s, ok := args[len(args)-1].(string); ok && strings.ToUpper(s) == "GMT" {
+			return t.UTC(), args[:len(args)-1]
+		}
+	}
+	return t, args
+}
+
+func indexOf(values []string, s string) int {
+	for i, v := range values {
+		if v == strings.ToUpper(s) {
+			return i
+		}
+	}
+	return -1
+}
+
+// inRange reports whether v is between start and end, wrapping around if end is before start
+func inRange(v, start, end int64) bool {
+	if start <= end {
+		return start <= v && v <= end
+	}
+	return v >= start || v <= end
+}
+
+func weekdayRange(args []interface{}) bool {
+	t, args := clock(args)
+	if len(args) < 1 || len(args) > 2 {
+		return false
+	}
+	var days []int64
+	for _, a := range args {
+		s, ok := a.(string)
+		if !ok {
+			return false
+		}
+		d := indexOf(weekdays, s)
+		if d < 0 {
+			return false
+		}
+		days = append(days, int64(d))
+	}
+	if len(days) == 1 {
+		days = append(days, days[0])
+	}
+	return inRange(int64(t.Weekday()), days[0], days[1])
+}
+
+// dateComponent is a day, month or year argument of dateRange
+type dateComponent struct {
+	kind  byte
+	value int64
+}
+
+func parseDateComponent(a interface{}) (dateComponent, bool) {
+	switch v := a.(type) {
+	case string:
+		m := indexOf(months, v)
+		if m < 0 {
+			return dateComponent{}, false
+		}
+		return dateComponent{'m', int64(m) + 1}, true
+	case int64:
+		if v >= 1 && v <= 31 {
+			return dateComponent{'d', v}, true
+		}
+		return dateComponent{'y', v}, true
+	case float64:
+		return parseDateComponent(int64(v))
+	}
+	return dateComponent{}, false
+}
+
+// dateOrdinal projects a partial date on a comparable number, along with its components kinds
+func dateOrdinal(components []dateComponent) (int64, string) {
+	var ordinal int64
+	var kinds string
+	for _, c := range components {
+		switch c.kind {
+		case 'y':
+			ordinal += c.value * 10000
+		case 'm':
+			ordinal += c.value * 100
+		case 'd':
+			ordinal += c.value
+		}
+		kinds += string(c.kind)
+	}
+	return ordinal, kinds
+}
+
+func dateRange(args []interface{}) bool {
+	t, args := clock(args)
+	if len(args) == 0 || (len(args) > 1 && len(args)%2 != 0) || len(args) > 6 {
+		return false
+	}
+	var components []dateComponent
+	for _, a := range args {
+		c, ok := parseDateComponent(a)
+		if !ok {
+			return false
+		}
+		components = append(components, c)
+	}
+
+	start, end := components, components
+	if len(components) > 1 {
+		start, end = components[:len(components)/2], components[len(components)/2:]
+	}
+	startOrdinal, startKinds := dateOrdinal(start)
+	endOrdinal, endKinds := dateOrdinal(end)
+	if startKinds != endKinds {
+		return false
+	}
+
+	var current []dateComponent
+	for _, c := range start {
+		switch c.kind {
+		case 'y':
+			current = append(current, dateComponent{'y', int64(t.Year())})
+		case 'm':
+			current = append(current, dateComponent{'m', int64(t.Month())})
+		case 'd':
+			current = append(current, dateComponent{'d', int64(t.Day())})
+		}
+	}
+	currentOrdinal, _ := dateOrdinal(current)
+
+	if strings.Contains(startKinds, "y") {
+		// ranges including years never wrap around
+		return startOrdinal <= currentOrdinal && currentOrdinal <= endOrdinal
+	}
+	return inRange(currentOrdinal, startOrdinal, endOrdinal)
+}
+
+func timeRange(args []interface{}) bool {
+	t, args := clock(args)
+	var values []int64
+	for _, a := range args {
+		switch v := a.(type) {
+		case int64:
+			values = append(values, v)
+		case float64:
+			values = append(values, int64(v))
+		default:
+			return false
+		}
+	}
+
+	seconds := int64(t.Hour()*3600 + t.Minute()*60 + t.Second())
+	switch len(values) {
+	case 1:
+		return int64(t.Hour()) == values[0]
+	case 2:
+		return inRange(seconds, values[0]*3600, values[1]*3600-1)
+	case 4:
+		return inRange(seconds, values[0]*3600+values[1]*60, values[2]*3600+values[3]*60-1)
+	case 6:
+		return inRange(seconds, values[0]*3600+values[1]*60+values[2], values[3]*3600+values[4]*60+values[5])
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+// Package pac evaluates Proxy Auto-Configuration files to find the proxies
+// to use for a given URL.
+package pac
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+const (
+	// EntryDirect means a direct connection, without a proxy
+	EntryDirect = "DIRECT"
+	// EntryProxy is an HTTP proxy
+	EntryProxy = "PROXY"
+	// EntryHTTP is an HTTP proxy (alias of PROXY)
+	EntryHTTP = "HTTP"
+	// EntryHTTPS is an HTTP proxy reached over TLS
+	EntryHTTPS = "HTTPS"
+	// EntrySocks is a SOCKS proxy
+	EntrySocks = "SOCKS"
+)
+
+// Entry is one of the ways to reach an URL returned by FindProxyForURL
+type Entry struct {
+	Type string
+	Host string
+}
+
+// ProxyURL returns the URL of the proxy of the entry, or an empty string for DIRECT
+func (e Entry) ProxyURL() (string, error) {
+	switch e.Type {
+	case EntryDirect:
+		return "", nil
+	case EntryProxy, EntryHTTP:
+		return fmt.Sprintf("http://%s", e.Host), nil
+	case EntryHTTPS:
+		return fmt.Sprintf("https://%s", e.Host), nil
+	}
+	return "", fmt.Errorf("unsupported PAC entry type %q", e.Type)
+}
+
+func (e Entry) String() string {
+	if e.Type == EntryDirect {
+		return EntryDirect
+	}
+	return fmt.Sprintf("%s %s", e.Type, e.Host)
+}
+
+// ParseResult parses the value returned by FindProxyForURL (e.g. "PROXY a:8080; DIRECT")
+func ParseResult(result string) ([]Entry, error) {
+	var entries []Entry
+	for _, part := range strings.Split(result, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		e := Entry{Type: strings.ToUpper(fields[0])}
+		switch e.Type {
+		case EntryDirect:
+			if len(fields) != 1 {
+				return nil, fmt.Errorf("invalid PAC entry %q", part)
+			}
+		case EntryProxy, EntryHTTP, EntryHTTPS, EntrySocks, "SOCKS4", "SOCKS5":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("invalid PAC entry %q", part)
+			}
+			e.Host = fields[1]
+		default:
+			return nil, fmt.Errorf("unknown PAC entry type %q", fields[0])
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("empty PAC result")
+	}
+	return entries, nil
+}
+
+// FormatEntries formats entries the way FindProxyForURL returns them
+func FormatEntries(entries []Entry) string {
+	parts := make([]string, 0, len(entries))
+	for _, e := range entries {
+		parts = append(parts, e.String())
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Script is a parsed PAC file
+type Script struct {
+	mu       sync.Mutex
+	vm       *goja.Runtime
+	findFunc goja.Callable
+}
+
+// Parse compiles a PAC file, which must define FindProxyForURL
+func Parse(src string) (*Script, error) {
+	vm := goja.New()
+	registerBuiltins(vm)
+
+	if _, err := vm.RunString(src); err != nil {
+		return nil, fmt.Errorf("could not evaluate PAC file: %s", err)
+	}
+	findFunc, ok := goja.AssertFunction(vm.Get("FindProxyForURL"))
+	if !ok {
+		return nil, errors.New("PAC file does not define FindProxyForURL")
+	}
+	return &Script{vm: vm, findFunc: findFunc}, nil
+}
+
+// FindProxyForURL evaluates the PAC file for an URL and returns the raw result
+func (s *Script) FindProxyForURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("could not parse URL: %s", err)
+	}
+
+	// goja runtimes are not goroutine-safe
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.findFunc(goja.Undefined(), s.vm.ToValue(rawURL), s.vm.ToValue(u.Hostname()))
+	if err != nil {
+		return "", fmt.Errorf("FindProxyForURL failed: %s", err)
+	}
+	return res.String(), nil
+}
+
+// Entries evaluates the PAC file for an URL and returns the parsed entries
+func (s *Script) Entries(rawURL string) ([]Entry, error) {
+	res, err := s.FindProxyForURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return ParseResult(res)
+}
+
+// Fetch downloads a PAC file
+func Fetch(pacURL string, timeout time.Duration) (string, error) {
+	client := &http.Client{
+		Timeout: timeout,
+		// PAC files are fetched directly
+		Transport: &http.Transport{Proxy: nil},
+	}
+	resp, err := client.Get(pacURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
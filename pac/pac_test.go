@@ -0,0 +1,130 @@
+package pac
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPAC = `
+function FindProxyForURL(url, host) {
+	if (isPlainHostName(host) || dnsDomainIs(host, ".corp.example.com")) {
+		return "DIRECT";
+	}
+	if (isInNet(host, "10.0.0.0", "255.0.0.0")) {
+		return "PROXY internal-proxy:3128";
+	}
+	if (shExpMatch(url, "https://*.secure.example.com/*")) {
+		return "HTTPS secure-proxy:8443";
+	}
+	return "PROXY proxy-a:8080; PROXY proxy-b:8080; DIRECT";
+}
+`
+
+func TestParseResult(t *testing.T) {
+	entries, err := ParseResult("PROXY proxy-a:8080;  HTTPS proxy-b:8443 ;DIRECT;")
+	require.NoError(t, err)
+	require.Equal(t, []Entry{
+		{Type: EntryProxy, Host: "proxy-a:8080"},
+		{Type: EntryHTTPS, Host: "proxy-b:8443"},
+		{Type: EntryDirect},
+	}, entries)
+	require.Equal(t, "PROXY proxy-a:8080; HTTPS proxy-b:8443; DIRECT", FormatEntries(entries))
+
+	proxyURL, err := entries[1].ProxyURL()
+	require.NoError(t, err)
+	require.Equal(t, "https://proxy-b:8443", proxyURL)
+
+	proxyURL, err = entries[2].ProxyURL()
+	require.NoError(t, err)
+	require.Equal(t, "", proxyURL)
+
+	_, err = Entry{Type: EntrySocks, Host: "socks:1080"}.ProxyURL()
+	require.Error(t, err)
+
+	for _, invalid := range []string{"", "PROXY", "DIRECT proxy:8080", "FTP proxy:21"} {
+		_, err = ParseResult(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestScript(t *testing.T) {
+	defer func() { lookupHost = net.LookupHost }()
+	lookupHost = func(host string) ([]string, error) {
+		return nil, fmt.Errorf("no such host %q", host)
+	}
+
+	s, err := Parse(testPAC)
+	require.NoError(t, err)
+
+	for rawURL, expected := range map[string]string{
+		"http://intranet/":                      "DIRECT",
+		"http://wiki.corp.example.com/":         "DIRECT",
+		"http://10.1.2.3/":                      "PROXY internal-proxy:3128",
+		"https://www.secure.example.com/login":  "HTTPS secure-proxy:8443",
+		"https://www.example.com/":              "PROXY proxy-a:8080; PROXY proxy-b:8080; DIRECT",
+		"http://192.168.1.1:8080/some/path?a=b": "PROXY proxy-a:8080; PROXY proxy-b:8080; DIRECT",
+	} {
+		res, err := s.FindProxyForURL(rawURL)
+		require.NoError(t, err)
+		assert.Equal(t, expected, res, rawURL)
+	}
+
+	_, err = Parse("var a = 1;")
+	require.Error(t, err)
+
+	_, err = Parse("function FindProxyForURL(url, host) {")
+	require.Error(t, err)
+}
+
+func TestTimeBuiltins(t *testing.T) {
+	defer func() { now = time.Now }()
+	// Wednesday, June 15th 2022, 14:30
+	now = func() time.Time { return time.Date(2022, time.June, 15, 14, 30, 0, 0, time.UTC) }
+
+	assert.True(t, weekdayRange([]interface{}{"WED"}))
+	assert.True(t, weekdayRange([]interface{}{"MON", "FRI", "GMT"}))
+	assert.False(t, weekdayRange([]interface{}{"SAT", "SUN"}))
+	assert.True(t, weekdayRange([]interface{}{"SAT", "WED"}))
+
+	assert.True(t, dateRange([]interface{}{int64(15)}))
+	assert.True(t, dateRange([]interface{}{"JUN"}))
+	assert.True(t, dateRange([]interface{}{int64(2022)}))
+	assert.True(t, dateRange([]interface{}{"MAY", "AUG"}))
+	assert.False(t, dateRange([]interface{}{"SEP", "MAR"}))
+	assert.True(t, dateRange([]interface{}{"NOV", "JUL"}))
+	assert.True(t, dateRange([]interface{}{int64(1), "JUN", int64(30), "JUN"}))
+	assert.True(t, dateRange([]interface{}{int64(1), "JAN", int64(2022), int64(31), "DEC", int64(2022)}))
+	assert.False(t, dateRange([]interface{}{int64(1), "JAN", int64(2023), int64(31), "DEC", int64(2023)}))
+	assert.False(t, dateRange([]interface{}{int64(1), "JUN", int64(30)}))
+
+	assert.True(t, timeRange([]interface{}{int64(14)}))
+	assert.True(t, timeRange([]interface{}{int64(8), int64(17)}))
+	assert.False(t, timeRange([]interface{}{int64(8), int64(14)}))
+	assert.True(t, timeRange([]interface{}{int64(14), int64(0), int64(14), int64(45), "GMT"}))
+	assert.True(t, timeRange([]interface{}{int64(22), int64(15)}))
+}
+
+func TestFetch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/proxy.pac" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(rw, testPAC)
+	}))
+	defer srv.Close()
+
+	src, err := Fetch(srv.URL+"/proxy.pac", time.Second)
+	require.NoError(t, err)
+	require.Equal(t, testPAC, src)
+
+	_, err = Fetch(srv.URL+"/wpad.dat", time.Second)
+	require.Error(t, err)
+}
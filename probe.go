@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/criteo/http-proxy-exporter/exporter"
+	"github.com/criteo/http-proxy-exporter/proxyclient"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// runProbe probes a target through a proxy once with the arguments of the
+// probe subcommand, or all the pairs of the configuration with -once
+func runProbe(args []string) {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	configFile := fs.String("config_file", "", "Path to configuration file, required with -once.")
+	target := fs.String("target", "", "URL requested through the proxy.")
+	proxy := fs.String("proxy", "", "URL of the proxy, empty for a direct connection.")
+	insecure := fs.Bool("insecure", false, "Skip the verification of TLS certificates.")
+	once := fs.Bool("once", false, "Probe every target through every proxy of the configuration once.")
+	fs.Parse(args)
+
+	config := defaults
+	if *once && *configFile == "" {
+		*configFile = "config.yml"
+	}
+	if *configFile != "" {
+		c, err := exporter.LoadConfig(*configFile, defaults)
+		if err != nil {
+			log.Fatalf("error while loading config: %s", err)
+		}
+		config = *c
+	}
+	if !*once && *target == "" {
+		fmt.Fprintln(os.Stderr, "-target is required")
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	// the metrics of the exporter are not exposed
+	exp, err := exporter.New(localConfig(config), exporter.Options{Registerer: prometheus.NewRegistry()})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ok := false
+	if *once {
+		ok = probeAll(exp, &config, os.Stdout)
+	} else {
+		t := exporter.Target{URL: *target, Insecure: *insecure}
+		for _, ct := range config.Targets {
+			// probe the target as configured, e.g. with its mode
+			if ct.URL == *target {
+				t = ct
+				t.Insecure = t.Insecure || *insecure
+			}
+		}
+		ok = probeOne(exp, *proxy, t, os.Stdout)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// probeOne probes a target through a proxy with a verbose trace, and reports whether it succeeded
+func probeOne(exp *exporter.Exporter, proxy string, target exporter.Target, w io.Writer) bool {
+	fmt.Fprintf(w, "* Probing %s via %q\n", target.URL, redactProxy(proxy))
+	res, err := exp.Probe(context.Background(), proxy, target, w)
+	if err != nil {
+		fmt.Fprintf(w, "* Failure: %s\n", err)
+		return false
+	}
+
+	fmt.Fprintf(w, "* Timings: dns=%s connect=%s tls=%s first_byte=%s total=%s\n",
+		res.Timings.DNS, res.Timings.Connect, res.Timings.TLSHandshake, res.Timings.FirstByte, res.Timings.Total)
+	fmt.Fprintf(w, "* Bytes: sent=%d received=%d\n", res.BytesSent, res.BytesReceived)
+	if res.ErrorKind != proxyclient.ErrorKindNone {
+		fmt.Fprintf(w, "* Failure (%s): %s\n", res.ErrorKind, res.Err)
+		return false
+	}
+	fmt.Fprintf(w, "* Success (%d)\n", res.StatusCode)
+	return true
+}
+
+// probeAll probes every target through every proxy of the configuration
+// once, prints a table of the results and reports whether they all succeeded
+func probeAll(exp *exporter.Exporter, config *exporter.Config, w io.Writer) bool {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROXY\tTARGET\tSTATUS\tRESULT\tDURATION\tERROR")
+	ok := true
+	for _, target := range config.Targets {
+		for _, p := range config.Proxies {
+			proxy := p.URL
+			res, err := exp.Probe(context.Background(), proxy, target, nil)
+			if err != nil {
+				ok = false
+				fmt.Fprintf(tw, "%s\t%s\t-\t%s\t-\t%s\n", redactProxy(proxy), target.URL, "lookup", err)
+				continue
+			}
+			result, errMsg := "ok", ""
+			if res.ErrorKind != proxyclient.ErrorKindNone {
+				ok = false
+				result, errMsg = string(res.ErrorKind), res.Err.Error()
+			}
+			status := "-"
+			if res.StatusCode != 0 {
+				status = fmt.Sprint(res.StatusCode)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", redactProxy(proxy), target.URL,
+				status, result, res.Timings.Total.Round(time.Millisecond), errMsg)
+		}
+	}
+	tw.Flush()
+	return ok
+}
+
+// redactProxy returns the proxy URL without its credentials
+func redactProxy(proxy string) string {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return "<invalid>"
+	}
+	u.User = nil
+	return u.String()
+}
@@ -0,0 +1,633 @@
+package proxyclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrorKind classifies the failure of a probe
+type ErrorKind string
+
+// Error kinds, the proxy_* ones and bad_gateway are failures to go through the proxy
+const (
+	ErrorKindNone ErrorKind = ""
+	// ErrorKindProxyConnect is a failure to connect to the proxy, or to open a
+	// tunnel through it before it answers the CONNECT request (conn reset, timeout...)
+	ErrorKindProxyConnect ErrorKind = "proxy_connect"
+	// ErrorKindProxyAuth is a 407 answered by the proxy, in GET or CONNECT mode
+	ErrorKindProxyAuth ErrorKind = "proxy_auth"
+	// ErrorKindBadGateway is a 502, which may also come from the origin
+	ErrorKindBadGateway ErrorKind = "bad_gateway"
+	// ErrorKindTimeout is a timeout past the connection to the proxy
+	ErrorKindTimeout ErrorKind = "timeout"
+	// ErrorKindTLS is a TLS failure with the origin
+	ErrorKindTLS ErrorKind = "tls"
+	// ErrorKindOrigin is any other failure, which should not be related to the proxy
+	ErrorKindOrigin ErrorKind = "origin"
+)
+
+// ConnectionFailure reports whether the kind is a failure to go through the proxy
+func (k ErrorKind) ConnectionFailure() bool {
+	switch k {
+	case ErrorKindProxyConnect, ErrorKindProxyAuth, ErrorKindBadGateway:
+		return true
+	}
+	return false
+}
+
+// OriginFailure reports whether the kind is a failure past the proxy
+func (k ErrorKind) OriginFailure() bool {
+	return k != ErrorKindNone && !k.ConnectionFailure()
+}
+
+// ProbeSpec describes a probe of a target through a proxy
+type ProbeSpec struct {
+	RequestConfig
+	// BodyLimit is the number of bytes of the body read and kept in the
+	// result, the rest is only read with KeepAlive, to reuse the connection
+	BodyLimit int64
+	// Trace receives a curl-like verbose trace of the probe when set, such
+	// probes do not share the transports of the others
+	Trace io.Writer
+	// Header is added to the headers of the request, e.g. to propagate a
+	// trace context. The CONNECT requests to the proxies do not carry it.
+	Header http.Header
+}
+
+// Timings are the durations of the phases of a probe, the zero ones did not happen
+type Timings struct {
+	DNS          time.Duration
+	Connect      time.Duration
+	TLSHandshake time.Duration
+	// FirstByte is the time to the first byte of the response, from the start of the probe
+	FirstByte time.Duration
+	// Total is the duration of the probe, including the read of the body
+	Total time.Duration
+}
+
+// Event is a step of a probe, e.g. the start of a connection
+type Event struct {
+	Time   time.Time `json:"time"`
+	Name   string    `json:"name"`
+	Detail string    `json:"detail,omitempty"`
+	// Failed is whether the step failed, its detail is then the error
+	Failed bool `json:"failed,omitempty"`
+}
+
+// TLSInfo describes the TLS connection to the origin
+type TLSInfo struct {
+	Version     string
+	CipherSuite string
+	ServerName  string
+	// NotAfter is the expiry of the origin certificate
+	NotAfter time.Time
+}
+
+// Result is the outcome of a probe
+type Result struct {
+	Start   time.Time
+	Timings Timings
+	// Request is the request sent, its headers are the ones set before the transport
+	Request *http.Request
+	// Response is nil when no response was received, its body is already
+	// closed: the part read is in Body
+	Response   *http.Response
+	StatusCode int
+	Body       []byte
+	// Reused reports whether the request went through a kept-alive connection
+	Reused bool
+	// BytesSent and BytesReceived are counted on the wire, including the
+	// exchanges with the proxy and the TLS overhead, on the connections
+	// dialed for the probe: they are zero when a connection is reused. With
+	// concurrent probes sharing a transport, a connection dialed for a probe
+	// may serve another one, its bytes are then counted by the former.
+	BytesSent     int64
+	BytesReceived int64
+	// ConnectStatusCode is the status of the response of the proxy to the
+	// CONNECT request of the probe, zero when the probe sent none, e.g.
+	// through a reused connection, or when the proxy did not answer
+	ConnectStatusCode int
+	TLS               *TLSInfo
+	// Events are the steps of the probe, in order
+	Events    []Event
+	Err       error
+	ErrorKind ErrorKind
+}
+
+// ConnectionFailure reports whether the probe failed to go through the proxy
+func (r *Result) ConnectionFailure() bool {
+	return r.ErrorKind.ConnectionFailure()
+}
+
+// OriginFailure reports whether the probe went through the proxy and failed past it
+func (r *Result) OriginFailure() bool {
+	return r.ErrorKind.OriginFailure()
+}
+
+// transportKey identifies the transports which can be shared between probes
+type transportKey struct {
+	proxy      string
+	target     string
+	sourceAddr string
+	insecure   bool
+	keepAlive  bool
+	authType   string
+	authParams string
+}
+
+const (
+	// transportExpiryTimeouts is the number of request timeouts after which an unused transport is evicted
+	transportExpiryTimeouts = 3
+	// defaultTransportExpiry is the expiry of the transports of the requests without timeout
+	defaultTransportExpiry = 5 * time.Minute
+)
+
+// cachedTransport is a transport of the cache, with the time of its last use
+type cachedTransport struct {
+	tr       *http.Transport
+	lastUsed time.Time
+	expiry   time.Duration
+}
+
+// Prober probes targets through proxies, it is safe for concurrent use. The
+// transports are cached per proxy, target and TLS settings, and evicted with
+// their idle connections once unused for three times their request timeout,
+// e.g. when the proxy resolves to other addresses.
+type Prober struct {
+	mu         sync.Mutex
+	transports map[transportKey]*cachedTransport
+}
+
+// NewProber returns a prober
+func NewProber() *Prober {
+	return &Prober{transports: make(map[transportKey]*cachedTransport)}
+}
+
+type (
+	byteCounterKey   struct{}
+	connectStatusKey struct{}
+)
+
+// transport returns the cached transport of the request, creating it if needed
+func (p *Prober) transport(rc RequestConfig) (*http.Transport, error) {
+	key := transportKey{
+		proxy:      rc.Proxy,
+		target:     rc.Target,
+		sourceAddr: rc.SourceAddr,
+		insecure:   rc.Insecure,
+		keepAlive:  rc.KeepAlive,
+	}
+	if rc.Auth != nil {
+		key.authType, key.authParams = rc.Auth.Type, authParamsKey(rc.Auth.Params)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	p.evict(now)
+	if c, ok := p.transports[key]; ok {
+		c.lastUsed = now
+		return c.tr, nil
+	}
+
+	tr, err := newTransport(rc)
+	if err != nil {
+		return nil, err
+	}
+	countBytes(tr)
+	watchConnect(tr, rc)
+	expiry := transportExpiryTimeouts * rc.Timeout
+	if expiry <= 0 {
+		expiry = defaultTransportExpiry
+	}
+	p.transports[key] = &cachedTransport{tr: tr, lastUsed: now, expiry: expiry}
+	return tr, nil
+}
+
+// evict removes the expired transports, with the lock held. The probes still
+// using them keep them until they are done.
+func (p *Prober) evict(now time.Time) {
+	for key, c := range p.transports {
+		if now.Sub(c.lastUsed) > c.expiry {
+			c.tr.CloseIdleConnections()
+			delete(p.transports, key)
+		}
+	}
+}
+
+// authParamsKey returns the parameters of an auth method as a string, the
+// keys and values are quoted so that distinct parameters cannot collide
+func authParamsKey(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%q=%q;", k, params[k])
+	}
+	return b.String()
+}
+
+// countBytes counts the bytes of the connections of the transport for the
+// probe which dials them. The transport may hand a connection dialed for a
+// probe to another concurrent one, whose bytes are then counted by the former.
+func countBytes(tr *http.Transport) {
+	dial := tr.DialContext
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		counter, _ := ctx.Value(byteCounterKey{}).(*byteCounter)
+		if counter == nil {
+			return conn, nil
+		}
+		return &countingConn{Conn: conn, counter: counter}, nil
+	}
+}
+
+// watchConnect records the status of the responses to the CONNECT requests of
+// the transport, for the probe which dials the connection to the proxy
+func watchConnect(tr *http.Transport, rc RequestConfig) {
+	wrapTunnelConns(tr, rc, func(ctx context.Context, conn net.Conn) net.Conn {
+		status, _ := ctx.Value(connectStatusKey{}).(*int32)
+		if status == nil {
+			return conn
+		}
+		return &connectConn{Conn: conn, status: status}
+	})
+}
+
+// wrapTunnelConns wraps the connections of the transport to the proxy on
+// which the CONNECT requests are sent, above the TLS connection with HTTPS
+// proxies. Nothing is wrapped when the target is not reached through a tunnel.
+func wrapTunnelConns(tr *http.Transport, rc RequestConfig, wrap func(ctx context.Context, conn net.Conn) net.Conn) {
+	if !tunneled(rc) {
+		return
+	}
+	proxyURL, _ := url.Parse(rc.Proxy)
+
+	if proxyURL.Scheme != "https" {
+		dial := tr.DialContext
+		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return wrap(ctx, conn), nil
+		}
+		return
+	}
+
+	dialTLS := tr.DialTLSContext
+	if dialTLS == nil {
+		dialTLS = dialProxyTLS(tr, proxyURL)
+	}
+	tr.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialTLS(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return wrap(ctx, conn), nil
+	}
+}
+
+// dialProxyTLS returns a function dialing the TLS connections to an HTTPS
+// proxy as the transport does, for the CONNECT exchanges to be wrapped above them
+func dialProxyTLS(tr *http.Transport, proxyURL *url.URL) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dial := tr.DialContext
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		config := tr.TLSClientConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName = proxyURL.Hostname()
+		}
+		tlsConn := tls.Client(conn, config)
+
+		// the transport only traces the handshakes it makes
+		trace := httptrace.ContextClientTrace(ctx)
+		if trace != nil && trace.TLSHandshakeStart != nil {
+			trace.TLSHandshakeStart()
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		err = tlsConn.Handshake()
+		conn.SetDeadline(time.Time{})
+		if trace != nil && trace.TLSHandshakeDone != nil {
+			trace.TLSHandshakeDone(tlsConn.ConnectionState(), err)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+// CloseIdleConnections closes the kept-alive connections which are not in use
+func (p *Prober) CloseIdleConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.transports {
+		c.tr.CloseIdleConnections()
+	}
+}
+
+// Probe makes a request to the target through the proxy of the spec. Failures of
+// the request are reported by the result, the error is only set when the
+// request could not be prepared.
+func (p *Prober) Probe(ctx context.Context, spec ProbeSpec) (*Result, error) {
+	preq, err := requestByAuthType(spec.Target, spec.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("error during request creation: %s", err)
+	}
+	for k, v := range spec.Header {
+		preq.Header[k] = v
+	}
+	var (
+		tr *http.Transport
+		t  *tracer
+	)
+	if spec.Trace != nil {
+		proxyURL, err := url.Parse(spec.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse proxy URL: %s", err)
+		}
+		t = newTracer(spec.Trace, preq, proxyURL)
+		tr, err = tracedTransport(spec.RequestConfig, t)
+		if err != nil {
+			return nil, err
+		}
+		defer tr.CloseIdleConnections()
+	} else {
+		tr, err = p.transport(spec.RequestConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	client := &http.Client{Transport: tr, Timeout: spec.Timeout}
+
+	res := &Result{}
+	counter := &byteCounter{}
+	ctx = context.WithValue(ctx, byteCounterKey{}, counter)
+	var connectStatus int32
+	ctx = context.WithValue(ctx, connectStatusKey{}, &connectStatus)
+
+	// the callbacks may run concurrently, as dual-stack dials race
+	var (
+		mu                               sync.Mutex
+		timings                          Timings
+		reused, gotConn                  bool
+		events                           []Event
+		dnsStart, connectStart, tlsStart time.Time
+	)
+	record := func(name, detail string, err error, f func(now time.Time)) {
+		mu.Lock()
+		defer mu.Unlock()
+		now := time.Now()
+		events = append(events, Event{Time: now, Name: name, Detail: eventDetail(detail, err), Failed: err != nil})
+		if f != nil {
+			f(now)
+		}
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			record("dns_start", info.Host, nil, func(now time.Time) { dnsStart = now })
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			record("dns_done", fmt.Sprint(info.Addrs), info.Err, func(now time.Time) { timings.DNS += now.Sub(dnsStart) })
+		},
+		ConnectStart: func(_, addr string) {
+			record("connect_start", addr, nil, func(now time.Time) { connectStart = now })
+		},
+		ConnectDone: func(_, addr string, err error) {
+			record("connect_done", addr, err, func(now time.Time) { timings.Connect += now.Sub(connectStart) })
+		},
+		// with an HTTPS proxy, the handshakes with the proxy and the origin add up
+		TLSHandshakeStart: func() {
+			record("tls_handshake_start", "", nil, func(now time.Time) { tlsStart = now })
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			record("tls_handshake_done", tlsVersions[state.Version], err, func(now time.Time) { timings.TLSHandshake += now.Sub(tlsStart) })
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			record("got_conn", fmt.Sprintf("reused=%v", info.Reused), nil, func(time.Time) { reused, gotConn = info.Reused, true })
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			record("wrote_request", "", info.Err, nil)
+		},
+		GotFirstResponseByte: func() {
+			record("first_byte", "", nil, func(now time.Time) { timings.FirstByte = now.Sub(res.Start) })
+		},
+	}
+	if t != nil {
+		trace = t.wrap(trace)
+	}
+	req := preq.WithContext(httptrace.WithClientTrace(ctx, trace))
+	res.Request = req
+
+	record("start", spec.Target, nil, func(now time.Time) { res.Start = now })
+	resp, err := client.Do(req)
+	if err == nil {
+		res.Response = resp
+		res.StatusCode = resp.StatusCode
+		if t != nil {
+			t.response(resp)
+		}
+		if spec.BodyLimit > 0 {
+			res.Body, err = ioutil.ReadAll(io.LimitReader(resp.Body, spec.BodyLimit))
+		}
+		if err == nil && spec.KeepAlive {
+			// the connection is only reused once its response is fully read
+			_, err = io.Copy(ioutil.Discard, resp.Body)
+		}
+		if err != nil {
+			err = fmt.Errorf("error while reading body: %s", err)
+		}
+		resp.Body.Close()
+		if resp.TLS != nil {
+			res.TLS = newTLSInfo(resp.TLS)
+		}
+	}
+	record("done", "", err, nil)
+	mu.Lock()
+	res.Timings = timings
+	res.Reused = reused
+	res.Events = events
+	mu.Unlock()
+	res.Timings.Total = time.Since(res.Start)
+	res.BytesSent = atomic.LoadInt64(&counter.sent)
+	res.BytesReceived = atomic.LoadInt64(&counter.received)
+	res.ConnectStatusCode = int(atomic.LoadInt32(&connectStatus))
+	res.ErrorKind, res.Err = classify(resp, err)
+	if tunneled(spec.RequestConfig) && !gotConn && res.ConnectStatusCode/100 != 2 && res.OriginFailure() {
+		// the failure happened before the tunnel came up, the origin was never reached
+		res.ErrorKind = tunnelFailureKind(res.ConnectStatusCode)
+	}
+	return res, nil
+}
+
+// tunneled reports whether the target of a request is reached through a CONNECT tunnel
+func tunneled(rc RequestConfig) bool {
+	scheme, _ := GetURLScheme(rc.Target)
+	proxyURL, err := url.Parse(rc.Proxy)
+	return err == nil && scheme == "https" && proxyURL.Host != ""
+}
+
+// tunnelFailureKind returns the kind of a failure to open a tunnel, from the
+// status of the response to the CONNECT request. The tunnels refused with
+// another status, e.g. by a URL filtering policy, are answered by a working
+// proxy and stay origin failures, as the same answers do in GET mode.
+func tunnelFailureKind(connectStatus int) ErrorKind {
+	switch connectStatus {
+	case 0:
+		// no answer: the connection was reset or timed out
+		return ErrorKindProxyConnect
+	case http.StatusProxyAuthRequired:
+		return ErrorKindProxyAuth
+	case http.StatusBadGateway:
+		return ErrorKindBadGateway
+	}
+	return ErrorKindOrigin
+}
+
+// eventDetail returns the detail of an event, the error when it failed
+func eventDetail(detail string, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return detail
+}
+
+// classify returns the error and the kind of the outcome of a request
+func classify(resp *http.Response, err error) (ErrorKind, error) {
+	if err != nil {
+		msg := err.Error()
+		switch {
+		case strings.Contains(msg, "proxyconnect"):
+			// general error connecting to the proxy (conn reset, timeout...)
+			return ErrorKindProxyConnect, err
+		case strings.Contains(msg, "Proxy Authentication Required"):
+			// auth error in CONNECT mode
+			return ErrorKindProxyAuth, err
+		}
+		// should not be related to the proxy, but to the origin
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return ErrorKindTimeout, err
+		}
+		if strings.Contains(msg, "x509:") || strings.Contains(msg, "tls:") {
+			return ErrorKindTLS, err
+		}
+		return ErrorKindOrigin, err
+	}
+
+	switch resp.StatusCode {
+	// auth error in GET mode
+	case http.StatusProxyAuthRequired:
+		return ErrorKindProxyAuth, fmt.Errorf("proxy authentication required")
+
+	// this will also catch origin 502 but we prefer false positives to false negatives
+	case http.StatusBadGateway:
+		return ErrorKindBadGateway, fmt.Errorf("bad gateway")
+	}
+	return ErrorKindNone, nil
+}
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+func newTLSInfo(state *tls.ConnectionState) *TLSInfo {
+	info := &TLSInfo{
+		Version:     tlsVersions[state.Version],
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ServerName:  state.ServerName,
+	}
+	if len(state.PeerCertificates) > 0 {
+		info.NotAfter = state.PeerCertificates[0].NotAfter
+	}
+	return info
+}
+
+// byteCounter counts the bytes of the connections of a probe
+type byteCounter struct {
+	sent     int64
+	received int64
+}
+
+type countingConn struct {
+	net.Conn
+	counter *byteCounter
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.counter.received, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.counter.sent, int64(n))
+	return n, err
+}
+
+// connectConn records the status code of the first response received on a
+// connection to a proxy, the one to the CONNECT request
+type connectConn struct {
+	net.Conn
+	status *int32
+	buf    []byte
+	done   bool
+}
+
+func (c *connectConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.done {
+		c.buf = append(c.buf, b[:n]...)
+		if i := bytes.IndexByte(c.buf, '\n'); i >= 0 {
+			atomic.StoreInt32(c.status, int32(parseStatusCode(string(c.buf[:i]))))
+			c.done, c.buf = true, nil
+		} else if len(c.buf) > maxTapSize {
+			c.done, c.buf = true, nil
+		}
+	}
+	return n, err
+}
+
+// parseStatusCode returns the status code of a status line, whatever its
+// reason phrase, or zero when it is not one
+func parseStatusCode(line string) int {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/") {
+		return 0
+	}
+	code, err := strconv.Atoi(fields[1])
+	if err != nil || code < 100 || code > 999 {
+		return 0
+	}
+	return code
+}
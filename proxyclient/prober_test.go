@@ -0,0 +1,270 @@
+package proxyclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/criteo/http-proxy-exporter/proxytest"
+	"github.com/stretchr/testify/require"
+)
+
+func probe(t *testing.T, proxy, target string) *Result {
+	res, err := NewProber().Probe(context.Background(), ProbeSpec{
+		RequestConfig: RequestConfig{
+			Target:   target,
+			Proxy:    proxy,
+			Auth:     &AuthMethod{},
+			Insecure: true,
+			Timeout:  5 * time.Second,
+		},
+		BodyLimit: 1024,
+	})
+	require.NoError(t, err)
+	return res
+}
+
+func TestProbe(t *testing.T) {
+	proxy, err := proxytest.NewTLSProxy(proxytest.Config{})
+	require.NoError(t, err)
+	defer proxy.Close()
+
+	origin, err := proxytest.NewTLSOrigin(proxytest.Config{}, nil)
+	require.NoError(t, err)
+	defer origin.Close()
+
+	res := probe(t, proxy.URL, origin.URL)
+	require.NoError(t, res.Err)
+	require.Equal(t, ErrorKindNone, res.ErrorKind)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "Hello from origin\n", string(res.Body))
+	require.NotNil(t, res.TLS)
+	require.NotEmpty(t, res.TLS.Version)
+	require.True(t, res.Timings.Connect > 0)
+	require.True(t, res.Timings.TLSHandshake > 0)
+	require.True(t, res.Timings.FirstByte > 0)
+	require.True(t, res.Timings.Total >= res.Timings.FirstByte)
+	require.Equal(t, "start", res.Events[0].Name)
+	require.Equal(t, "done", res.Events[len(res.Events)-1].Name)
+	require.True(t, res.BytesSent > 0)
+	require.True(t, res.BytesReceived > 0)
+}
+
+func TestProbeFailures(t *testing.T) {
+	origin, err := proxytest.NewOrigin(proxytest.Config{}, nil)
+	require.NoError(t, err)
+	defer origin.Close()
+
+	tlsOrigin, err := proxytest.NewTLSOrigin(proxytest.Config{}, nil)
+	require.NoError(t, err)
+	defer tlsOrigin.Close()
+
+	// failing past the tunnel
+	failingOrigin, err := proxytest.NewTLSOrigin(proxytest.Config{TLSFailure: proxytest.TLSFailureHandshake}, nil)
+	require.NoError(t, err)
+	defer failingOrigin.Close()
+
+	for _, tc := range []struct {
+		config proxytest.Config
+		target string
+		kind   ErrorKind
+	}{
+		{proxytest.Config{Auth: &proxytest.Auth{Scheme: proxytest.AuthBasic}}, origin.URL, ErrorKindProxyAuth},
+		{proxytest.Config{Auth: &proxytest.Auth{Scheme: proxytest.AuthNTLM}}, tlsOrigin.URL, ErrorKindProxyAuth},
+		{proxytest.Config{StatusCode: http.StatusBadGateway}, origin.URL, ErrorKindBadGateway},
+		{proxytest.Config{StatusCode: http.StatusInternalServerError}, origin.URL, ErrorKindNone},
+		{proxytest.Config{ResetOnConnect: true}, tlsOrigin.URL, ErrorKindProxyConnect},
+		{proxytest.Config{StatusCode: http.StatusBadGateway}, tlsOrigin.URL, ErrorKindBadGateway},
+		{proxytest.Config{StatusCode: http.StatusForbidden}, tlsOrigin.URL, ErrorKindOrigin},
+		{proxytest.Config{TLSFailure: proxytest.TLSFailureHandshake}, tlsOrigin.URL, ErrorKindProxyConnect},
+		{proxytest.Config{}, failingOrigin.URL, ErrorKindTLS},
+	} {
+		newProxy := proxytest.NewProxy
+		if tc.config.TLSFailure != "" {
+			newProxy = proxytest.NewTLSProxy
+		}
+		proxy, err := newProxy(tc.config)
+		require.NoError(t, err)
+		defer proxy.Close()
+
+		res := probe(t, proxy.URL, tc.target)
+		require.Equal(t, tc.kind, res.ErrorKind, "%+v: %v", tc.config, res.Err)
+	}
+
+	res := probe(t, "http://127.0.0.1:1", origin.URL)
+	require.Equal(t, ErrorKindProxyConnect, res.ErrorKind)
+	require.True(t, res.ConnectionFailure())
+
+	// timing out before the answer to the CONNECT request
+	slow, err := proxytest.NewProxy(proxytest.Config{Latency: proxytest.Latency{Connect: time.Minute}})
+	require.NoError(t, err)
+	defer slow.Close()
+	res, err = NewProber().Probe(context.Background(), ProbeSpec{RequestConfig: RequestConfig{
+		Target:   tlsOrigin.URL,
+		Proxy:    slow.URL,
+		Auth:     &AuthMethod{},
+		Insecure: true,
+		Timeout:  200 * time.Millisecond,
+	}})
+	require.NoError(t, err)
+	require.Equal(t, ErrorKindProxyConnect, res.ErrorKind, res.Err)
+}
+
+func TestProbeConnectStatus(t *testing.T) {
+	origin, err := proxytest.NewTLSOrigin(proxytest.Config{}, nil)
+	require.NoError(t, err)
+	defer origin.Close()
+
+	for _, useTLS := range []bool{false, true} {
+		newProxy := proxytest.NewProxy
+		if useTLS {
+			newProxy = proxytest.NewTLSProxy
+		}
+		proxy, err := newProxy(proxytest.Config{StatusCode: http.StatusForbidden, Reason: "Blocked by policy"})
+		require.NoError(t, err)
+		defer proxy.Close()
+
+		res := probe(t, proxy.URL, origin.URL)
+		require.Error(t, res.Err)
+		require.Equal(t, http.StatusForbidden, res.ConnectStatusCode, "proxy TLS %v", useTLS)
+
+		open, err := newProxy(proxytest.Config{})
+		require.NoError(t, err)
+		defer open.Close()
+
+		res = probe(t, open.URL, origin.URL)
+		require.NoError(t, res.Err)
+		require.Equal(t, http.StatusOK, res.ConnectStatusCode, "proxy TLS %v", useTLS)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	kind, _ := classify(nil, errors.New(`Get "https://a/": x509: certificate has expired or is not yet valid`))
+	require.Equal(t, ErrorKindTLS, kind)
+	require.True(t, kind.OriginFailure())
+
+	kind, err := classify(&http.Response{StatusCode: http.StatusProxyAuthRequired}, nil)
+	require.Equal(t, ErrorKindProxyAuth, kind)
+	require.Error(t, err)
+	require.True(t, kind.ConnectionFailure())
+}
+
+func TestProbeKeepAlive(t *testing.T) {
+	proxy, err := proxytest.NewProxy(proxytest.Config{})
+	require.NoError(t, err)
+	defer proxy.Close()
+
+	origin, err := proxytest.NewTLSOrigin(proxytest.Config{}, nil)
+	require.NoError(t, err)
+	defer origin.Close()
+
+	prober := NewProber()
+	defer prober.CloseIdleConnections()
+	for _, keepAlive := range []bool{false, true} {
+		spec := ProbeSpec{
+			RequestConfig: RequestConfig{
+				Target:    origin.URL + "/bytes/10000",
+				Proxy:     proxy.URL,
+				Auth:      &AuthMethod{},
+				Insecure:  true,
+				KeepAlive: keepAlive,
+			},
+			// without keepalive, the body is only read when kept
+			BodyLimit: 20000,
+		}
+
+		cold, err := prober.Probe(context.Background(), spec)
+		require.NoError(t, err)
+		require.NoError(t, cold.Err)
+		require.False(t, cold.Reused)
+		require.True(t, cold.BytesReceived > 10000)
+
+		warm, err := prober.Probe(context.Background(), spec)
+		require.NoError(t, err)
+		require.NoError(t, warm.Err)
+		require.Equal(t, keepAlive, warm.Reused)
+		if keepAlive {
+			require.Equal(t, time.Duration(0), warm.Timings.Connect)
+			require.Equal(t, time.Duration(0), warm.Timings.TLSHandshake)
+		}
+	}
+	require.Len(t, prober.transports, 2)
+}
+
+func TestProberTransportEviction(t *testing.T) {
+	origin, err := proxytest.NewOrigin(proxytest.Config{}, nil)
+	require.NoError(t, err)
+	defer origin.Close()
+
+	prober := NewProber()
+	for _, proxy := range []string{"http://127.0.0.1:1", "http://127.0.0.1:2", ""} {
+		_, err := prober.Probe(context.Background(), ProbeSpec{RequestConfig: RequestConfig{
+			Target:  origin.URL,
+			Proxy:   proxy,
+			Auth:    &AuthMethod{},
+			Timeout: 50 * time.Millisecond,
+		}})
+		require.NoError(t, err)
+	}
+	require.Len(t, prober.transports, 3)
+
+	// the transports unused for three timeouts are evicted
+	time.Sleep(200 * time.Millisecond)
+	_, err = prober.Probe(context.Background(), ProbeSpec{RequestConfig: RequestConfig{
+		Target:  origin.URL,
+		Proxy:   "",
+		Auth:    &AuthMethod{},
+		Timeout: 50 * time.Millisecond,
+	}})
+	require.NoError(t, err)
+	require.Len(t, prober.transports, 1)
+
+	require.NotEqual(t,
+		authParamsKey(map[string]string{"a": "b c:d"}),
+		authParamsKey(map[string]string{"a": "b", "c": "d"}),
+	)
+}
+
+func TestProbeTrace(t *testing.T) {
+	origin, err := proxytest.NewTLSOrigin(proxytest.Config{}, nil)
+	require.NoError(t, err)
+	defer origin.Close()
+
+	for _, useTLS := range []bool{false, true} {
+		newProxy := proxytest.NewProxy
+		if useTLS {
+			newProxy = proxytest.NewTLSProxy
+		}
+		proxy, err := newProxy(proxytest.Config{})
+		require.NoError(t, err)
+		defer proxy.Close()
+
+		var trace bytes.Buffer
+		res, err := NewProber().Probe(context.Background(), ProbeSpec{
+			RequestConfig: RequestConfig{
+				Target:   origin.URL + "/headers",
+				Proxy:    proxy.URL,
+				Auth:     &AuthMethod{Type: "basic", Params: map[string]string{"username": "user", "password": "secret"}},
+				Insecure: true,
+			},
+			Trace: &trace,
+		})
+		require.NoError(t, err)
+		require.NoError(t, res.Err)
+		require.True(t, res.Timings.TLSHandshake > 0)
+
+		out := trace.String()
+		require.Contains(t, out, "> CONNECT "+strings.TrimPrefix(origin.URL, "https://")+" HTTP/1.1\n")
+		require.Contains(t, out, "> Proxy-Authorization: Basic ***\n")
+		require.NotContains(t, out, basicAuth("user", "secret"))
+		require.Contains(t, out, "< HTTP/1.1 200 Connection established\n")
+		require.Contains(t, out, "* TLS with the origin: ")
+		require.Contains(t, out, "> GET /headers HTTP/1.1\n")
+		require.Contains(t, out, "< HTTP/1.1 200 OK\n")
+		require.Equal(t, useTLS, strings.Contains(out, "* TLS with the proxy: "), out)
+	}
+}
@@ -19,6 +19,8 @@ type RequestConfig struct {
 	SourceAddr string
 	Insecure   bool
 	Timeout    time.Duration
+	// KeepAlive keeps the connections open to reuse them across requests
+	KeepAlive bool
 }
 
 // AuthMethod represent a method to authenticate with a proxy
@@ -47,7 +49,7 @@ func proxifiedTransport(proxyURL *url.URL, targetScheme string, sourceAddr strin
 		}
 	}
 	if proxyURL.String() == "" {
-		// override to nil if no proxy has been set (will use system proxy)
+		// override to nil if no proxy has been set (direct connection)
 		proxyURL = nil
 	}
 
@@ -73,7 +75,8 @@ func proxifiedTransport(proxyURL *url.URL, targetScheme string, sourceAddr strin
 	return tr, nil
 }
 
-func clientByAuthType(scheme string, auth *AuthMethod, tr *http.Transport, timeout time.Duration) *http.Client {
+// setConnectAuth sets the credentials of the CONNECT requests of the transport
+func setConnectAuth(scheme string, auth *AuthMethod, tr *http.Transport) {
 	if auth.Type == "basic" {
 		if scheme == "https" {
 			// basicauth
@@ -82,10 +85,6 @@ func clientByAuthType(scheme string, auth *AuthMethod, tr *http.Transport, timeo
 			tr.ProxyConnectHeader.Set("Proxy-Authorization", auth)
 		}
 	}
-	return &http.Client{
-		Transport: tr,
-		Timeout:   timeout,
-	}
 }
 
 func requestByAuthType(target string, auth *AuthMethod) (*http.Request, error) {
@@ -111,8 +110,8 @@ func requestByAuthType(target string, auth *AuthMethod) (*http.Request, error) {
 	return nil, fmt.Errorf("unknown or unsupported authType: %s", auth.Type)
 }
 
-// MakeClientAndRequest prepares a client and a request
-func MakeClientAndRequest(rc RequestConfig) (*PreparedRequest, error) {
+// newTransport creates the transport of a request
+func newTransport(rc RequestConfig) (*http.Transport, error) {
 	// detect target URL scheme
 	scheme, err := GetURLScheme(rc.Target)
 	if err != nil {
@@ -128,12 +127,29 @@ func MakeClientAndRequest(rc RequestConfig) (*PreparedRequest, error) {
 	if err != nil {
 		return nil, err
 	}
+	if rc.KeepAlive {
+		tr.DisableKeepAlives = false
+	}
+	setConnectAuth(scheme, rc.Auth, tr)
+	return tr, nil
+}
+
+// MakeClientAndRequest prepares a client and a request
+func MakeClientAndRequest(rc RequestConfig) (*PreparedRequest, error) {
+	tr, err := newTransport(rc)
+	if err != nil {
+		return nil, err
+	}
 
 	// create the client and the actual request
-	client := clientByAuthType(scheme, rc.Auth, tr, rc.Timeout)
+	client := &http.Client{
+		Transport: tr,
+		Timeout:   rc.Timeout,
+	}
 	req, err := requestByAuthType(rc.Target, rc.Auth)
 	if err != nil {
 		return nil, fmt.Errorf("error during request creation: %s", err)
 	}
+	proxyURL, _ := url.Parse(rc.Proxy)
 	return &PreparedRequest{Client: client, Request: req, ProxyURL: proxyURL}, nil
 }
@@ -0,0 +1,215 @@
+package proxyclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTapSize bounds the bytes kept to find the end of the headers of a proxy exchange
+const maxTapSize = 64 * 1024
+
+// tracer writes a curl-like verbose trace of a probe: the "*" lines are
+// events, the ">" lines are sent and the "<" ones received
+type tracer struct {
+	mu sync.Mutex
+	w  io.Writer
+	// proxyTLS is whether the first TLS handshake is with the proxy
+	proxyTLS    bool
+	handshakes  int
+	requestLine string
+}
+
+func newTracer(w io.Writer, req *http.Request, proxyURL *url.URL) *tracer {
+	t := &tracer{w: w, proxyTLS: proxyURL.Scheme == "https"}
+	target := req.URL.RequestURI()
+	if req.URL.Scheme == "http" && proxyURL.Host != "" {
+		// requests to HTTP targets are sent to the proxy with the absolute URL
+		target = req.URL.String()
+	}
+	t.requestLine = fmt.Sprintf("%s %s HTTP/1.1", req.Method, target)
+	return t
+}
+
+func (t *tracer) printf(prefix, format string, args ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(t.w, prefix+" "+format+"\n", args...)
+}
+
+// headers traces a raw header block, without the credentials
+func (t *tracer) headers(prefix string, raw []byte) {
+	for n, line := range strings.Split(string(raw), "\r\n") {
+		// the first line is the request or the status line
+		if i := strings.Index(line, ":"); n > 0 && i > 0 {
+			line = line[:i] + ": " + redact(line[:i], strings.TrimSpace(line[i+1:]))
+		}
+		t.printf(prefix, "%s", line)
+	}
+}
+
+// response traces the status and the headers of a response
+func (t *tracer) response(resp *http.Response) {
+	t.printf("<", "%s %s", resp.Proto, resp.Status)
+	keys := make([]string, 0, len(resp.Header))
+	for k := range resp.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range resp.Header[k] {
+			t.printf("<", "%s: %s", k, v)
+		}
+	}
+}
+
+// redact hides the credentials of a header, keeping the scheme of authorization headers
+func redact(key, value string) string {
+	switch http.CanonicalHeaderKey(key) {
+	case "Authorization", "Proxy-Authorization":
+		return strings.SplitN(value, " ", 2)[0] + " ***"
+	case "Cookie", "Set-Cookie":
+		return "***"
+	}
+	return value
+}
+
+// RedactHeader returns a copy of the header without credentials
+func RedactHeader(h http.Header) http.Header {
+	redacted := make(http.Header, len(h))
+	for k, values := range h {
+		for _, v := range values {
+			redacted[k] = append(redacted[k], redact(k, v))
+		}
+	}
+	return redacted
+}
+
+func (t *tracer) tlsHandshake(state tls.ConnectionState, err error) {
+	t.mu.Lock()
+	hop := "origin"
+	if t.proxyTLS && t.handshakes == 0 {
+		hop = "proxy"
+	}
+	t.handshakes++
+	t.mu.Unlock()
+
+	if err != nil {
+		t.printf("*", "TLS handshake with the %s failed: %s", hop, err)
+		return
+	}
+	info := newTLSInfo(&state)
+	t.printf("*", "TLS with the %s: %s, %s", hop, info.Version, info.CipherSuite)
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		t.printf("*", "  certificate: subject %q, issuer %q, expires %s",
+			cert.Subject.String(), cert.Issuer.String(), cert.NotAfter.Format(time.RFC3339))
+	}
+}
+
+// wrap returns a client trace calling the hooks of trace, then tracing the events
+func (t *tracer) wrap(trace *httptrace.ClientTrace) *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			trace.DNSStart(info)
+			t.printf("*", "Resolving %s", info.Host)
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			trace.DNSDone(info)
+			if info.Err != nil {
+				t.printf("*", "Resolution failed: %s", info.Err)
+				return
+			}
+			t.printf("*", "Resolved to %v", info.Addrs)
+		},
+		ConnectStart: func(network, addr string) {
+			trace.ConnectStart(network, addr)
+			t.printf("*", "Connecting to %s", addr)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			trace.ConnectDone(network, addr, err)
+			if err != nil {
+				t.printf("*", "Connection to %s failed: %s", addr, err)
+				return
+			}
+			t.printf("*", "Connected to %s", addr)
+		},
+		TLSHandshakeStart: trace.TLSHandshakeStart,
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			trace.TLSHandshakeDone(state, err)
+			t.tlsHandshake(state, err)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			trace.GotConn(info)
+			if info.Reused {
+				t.printf("*", "Reusing connection to %s", info.Conn.RemoteAddr())
+			}
+			t.printf(">", "%s", t.requestLine)
+		},
+		WroteHeaderField: func(key string, values []string) {
+			for _, v := range values {
+				t.printf(">", "%s: %s", key, redact(key, v))
+			}
+		},
+		GotFirstResponseByte: trace.GotFirstResponseByte,
+	}
+}
+
+// tracedTransport returns a transport tracing the exchanges with the proxy,
+// which are the CONNECT requests with HTTPS targets
+func tracedTransport(rc RequestConfig, t *tracer) (*http.Transport, error) {
+	tr, err := newTransport(rc)
+	if err != nil {
+		return nil, err
+	}
+	countBytes(tr)
+	watchConnect(tr, rc)
+	wrapTunnelConns(tr, rc, func(_ context.Context, conn net.Conn) net.Conn {
+		return &tapConn{Conn: conn, t: t}
+	})
+	return tr, nil
+}
+
+// tapConn traces the headers of the first message sent and received on a connection
+type tapConn struct {
+	net.Conn
+	t                 *tracer
+	sent, received    []byte
+	sentDone, rcvDone bool
+}
+
+// tap accumulates the bytes of a message until the end of its headers, which are then traced
+func (c *tapConn) tap(prefix string, buf *[]byte, done *bool, b []byte) {
+	if *done {
+		return
+	}
+	*buf = append(*buf, b...)
+	if i := bytes.Index(*buf, []byte("\r\n\r\n")); i >= 0 {
+		c.t.headers(prefix, (*buf)[:i])
+		*done, *buf = true, nil
+	} else if len(*buf) > maxTapSize {
+		*done, *buf = true, nil
+	}
+}
+
+func (c *tapConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.tap("<", &c.received, &c.rcvDone, b[:n])
+	return n, err
+}
+
+func (c *tapConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.tap(">", &c.sent, &c.sentDone, b[:n])
+	return n, err
+}
@@ -0,0 +1,604 @@
+// Package proxytest provides fake forward proxies and origins with fault
+// injection, to test the probing of proxies.
+package proxytest
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/criteo/http-proxy-exporter/reflector"
+)
+
+// Authentication schemes of the 407 challenges
+const (
+	AuthBasic     = "Basic"
+	AuthDigest    = "Digest"
+	AuthNegotiate = "Negotiate"
+	AuthNTLM      = "NTLM"
+)
+
+// TLSFailure is a failure of the TLS handshakes of a server
+type TLSFailure string
+
+// TLS failures
+const (
+	// TLSFailureHandshake aborts the handshakes
+	TLSFailureHandshake TLSFailure = "handshake"
+	// TLSFailureExpired serves an expired certificate
+	TLSFailureExpired TLSFailure = "expired_certificate"
+)
+
+// Fault is a fault injected in a random share of the requests
+type Fault string
+
+// Faults
+const (
+	// FaultReset closes the connection without responding
+	FaultReset Fault = "reset"
+	// FaultBadGateway responds with a 502
+	FaultBadGateway Fault = "bad_gateway"
+	// FaultHang never responds, until the client gives up or the server is closed
+	FaultHang Fault = "hang"
+)
+
+// Latency is the delay injected before each phase of an exchange
+type Latency struct {
+	// Accept delays the first read of a connection, before any TLS handshake
+	Accept time.Duration
+	// Connect delays the answer to CONNECT requests
+	Connect time.Duration
+	// Response delays the response headers
+	Response time.Duration
+}
+
+// SlowBody throttles the response bodies, and the origin to client direction
+// of CONNECT tunnels
+type SlowBody struct {
+	// ChunkSize is the number of bytes written at once
+	ChunkSize int
+	// Interval is the delay between chunks
+	Interval time.Duration
+}
+
+// Auth requires the clients of a proxy to authenticate
+type Auth struct {
+	// Scheme is the scheme of the 407 challenges, such as Basic or NTLM
+	Scheme string
+	// Username and Password are checked by the Basic scheme, and the
+	// username by the Digest one. The Digest, NTLM and Negotiate schemes are
+	// stubs without handshake: the Digest response, the NTLM message and the
+	// Negotiate token are not verified, only recognized by their format.
+	Username string
+	Password string
+}
+
+// RandomFaults injects a fault in a share of the requests
+type RandomFaults struct {
+	// Rate is the probability of a request to fail, between 0 and 1
+	Rate float64
+	// Faults are the faults picked from, all of them when empty
+	Faults []Fault
+	// Seed makes the faults reproducible, the faults are random when zero
+	Seed int64
+}
+
+// Config configures the behaviour and the faults of a server
+type Config struct {
+	// StatusCode answers every request with this status instead of serving it
+	StatusCode int
+	// Reason replaces the standard reason phrase of the StatusCode answers to
+	// CONNECT requests, e.g. "Blocked by policy" (proxies only)
+	Reason string
+	// Auth answers 407 challenges to unauthenticated requests (proxies only)
+	Auth *Auth
+	// SetHeaders are set on the forwarded requests (proxies only)
+	SetHeaders map[string]string
+	Latency    Latency
+	// ResetOnConnect closes the connections after reading a CONNECT request,
+	// before answering it (proxies only)
+	ResetOnConnect bool
+	// TLSFailure is the failure of the handshakes (TLS servers only)
+	TLSFailure   TLSFailure
+	SlowBody     SlowBody
+	RandomFaults RandomFaults
+}
+
+// Server is a fake proxy or origin listening on the loopback interface
+type Server struct {
+	// URL is the base URL of the server, such as http://127.0.0.1:1234
+	URL      string
+	Listener net.Listener
+
+	config  Config
+	handler http.Handler
+	server  *http.Server
+	closed  chan struct{}
+	once    sync.Once
+
+	mu      sync.Mutex
+	rand    *rand.Rand
+	tunnels map[net.Conn]bool
+}
+
+// NewProxy starts a forward proxy, forwarding plain requests and tunneling CONNECT requests
+func NewProxy(c Config) (*Server, error) {
+	return newServer(c, nil, false)
+}
+
+// NewTLSProxy starts a forward proxy serving HTTPS
+func NewTLSProxy(c Config) (*Server, error) {
+	return newServer(c, nil, true)
+}
+
+// NewOrigin starts an origin serving the handler, or a reflector when nil
+func NewOrigin(c Config, handler http.Handler) (*Server, error) {
+	if handler == nil {
+		handler = reflector.NewHandler()
+	}
+	return newServer(c, handler, false)
+}
+
+// NewTLSOrigin starts an origin serving the handler over HTTPS, or a reflector when nil
+func NewTLSOrigin(c Config, handler http.Handler) (*Server, error) {
+	if handler == nil {
+		handler = reflector.NewHandler()
+	}
+	return newServer(c, handler, true)
+}
+
+func newServer(c Config, handler http.Handler, useTLS bool) (*Server, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	seed := c.RandomFaults.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	s := &Server{
+		URL:      fmt.Sprintf("http://%s", lis.Addr().String()),
+		Listener: lis,
+		config:   c,
+		handler:  handler,
+		closed:   make(chan struct{}),
+		rand:     rand.New(rand.NewSource(seed)),
+		tunnels:  make(map[net.Conn]bool),
+	}
+
+	var served net.Listener = lis
+	if c.Latency.Accept > 0 {
+		served = &delayedListener{Listener: served, delay: c.Latency.Accept}
+	}
+	if useTLS {
+		tlsConfig, err := s.tlsConfig()
+		if err != nil {
+			lis.Close()
+			return nil, err
+		}
+		served = tls.NewListener(served, tlsConfig)
+		s.URL = fmt.Sprintf("https://%s", lis.Addr().String())
+	}
+
+	s.server = &http.Server{Handler: s}
+	go s.server.Serve(served)
+	return s, nil
+}
+
+// tlsConfig returns the TLS configuration of the server, with its TLS failure
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	switch s.config.TLSFailure {
+	case "":
+		return NewTLSConfig()
+	case TLSFailureExpired:
+		certificate, err := newCertificate(time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour))
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{
+			NextProtos:   []string{"http/1.1"},
+			Certificates: []tls.Certificate{certificate},
+		}, nil
+	case TLSFailureHandshake:
+		return &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return nil, errors.New("injected handshake failure")
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown TLS failure %q", s.config.TLSFailure)
+}
+
+// Close stops the server and closes its tunnels
+func (s *Server) Close() error {
+	s.once.Do(func() { close(s.closed) })
+	err := s.server.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.tunnels {
+		conn.Close()
+	}
+	return err
+}
+
+// ServeHTTP injects the faults, then serves the request as a proxy or an origin
+func (s *Server) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	switch s.randomFault() {
+	case FaultReset:
+		s.reset(rw)
+		return
+	case FaultBadGateway:
+		http.Error(rw, "injected fault", http.StatusBadGateway)
+		return
+	case FaultHang:
+		select {
+		case <-r.Context().Done():
+		case <-s.closed:
+		}
+		return
+	}
+
+	if s.handler == nil && s.config.Auth != nil && !s.config.Auth.authenticated(r) {
+		rw.Header().Set("Proxy-Authenticate", s.config.Auth.challenge())
+		s.respond(rw, r, http.StatusProxyAuthRequired)
+		return
+	}
+
+	if s.handler == nil && r.Method == http.MethodConnect {
+		s.serveConnect(rw, r)
+		return
+	}
+
+	if s.config.StatusCode != 0 {
+		s.respond(rw, r, s.config.StatusCode)
+		return
+	}
+
+	if !s.sleep(r, s.config.Latency.Response) {
+		return
+	}
+	w := rw
+	if s.config.SlowBody.ChunkSize > 0 {
+		w = &slowResponseWriter{ResponseWriter: rw, body: s.config.SlowBody, closed: s.closed}
+	}
+	if s.handler != nil {
+		s.handler.ServeHTTP(w, r)
+		return
+	}
+	s.forward(w, r)
+}
+
+// respond writes a response with the status, after the response latency
+func (s *Server) respond(rw http.ResponseWriter, r *http.Request, code int) {
+	if !s.sleep(r, s.config.Latency.Response) {
+		return
+	}
+	http.Error(rw, http.StatusText(code), code)
+}
+
+// forward sends a plain request to its origin and copies back the response
+func (s *Server) forward(rw http.ResponseWriter, r *http.Request) {
+	if !r.URL.IsAbs() {
+		http.Error(rw, "this is a proxy, requests must have an absolute URL", http.StatusBadRequest)
+		return
+	}
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.Header.Del("Proxy-Authorization")
+	out.Header.Del("Proxy-Connection")
+	for k, v := range s.config.SetHeaders {
+		out.Header.Set(k, v)
+	}
+
+	resp, err := forwardTransport.RoundTrip(out)
+	if err != nil {
+		// like goproxy, unreachable origins are answered with a 500
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+
+	for k, values := range resp.Header {
+		for _, v := range values {
+			rw.Header().Add(k, v)
+		}
+	}
+	rw.WriteHeader(resp.StatusCode)
+	io.Copy(rw, resp.Body)
+}
+
+var forwardTransport = &http.Transport{
+	TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+	DisableKeepAlives: true,
+}
+
+// serveConnect tunnels a CONNECT request to its origin
+func (s *Server) serveConnect(rw http.ResponseWriter, r *http.Request) {
+	if !s.sleep(r, s.config.Latency.Connect) {
+		return
+	}
+	if s.config.ResetOnConnect {
+		s.reset(rw)
+		return
+	}
+	if s.config.StatusCode != 0 && s.config.Reason != "" {
+		s.refuseConnect(rw)
+		return
+	}
+	if s.config.StatusCode != 0 {
+		http.Error(rw, http.StatusText(s.config.StatusCode), s.config.StatusCode)
+		return
+	}
+
+	upstream, err := net.DialTimeout("tcp", r.Host, 10*time.Second)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(rw, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	if !s.track(conn, upstream) {
+		return
+	}
+	defer s.untrack(conn, upstream)
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+
+	var w io.Writer = conn
+	if s.config.SlowBody.ChunkSize > 0 {
+		w = &slowWriter{w: conn, body: s.config.SlowBody, closed: s.closed}
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, buf.Reader)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(w, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// refuseConnect answers a CONNECT request with the status and the reason
+// phrase of the configuration, which net/http cannot write
+func (s *Server) refuseConnect(rw http.ResponseWriter) {
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", s.config.StatusCode, s.config.Reason)
+}
+
+// track registers the connections of a tunnel, to close them along with the
+// server, and reports whether the server is still open
+func (s *Server) track(conns ...net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.closed:
+		for _, c := range conns {
+			c.Close()
+		}
+		return false
+	default:
+	}
+	for _, c := range conns {
+		s.tunnels[c] = true
+	}
+	return true
+}
+
+// untrack closes the connections of a tunnel
+func (s *Server) untrack(conns ...net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+		delete(s.tunnels, c)
+	}
+}
+
+// reset closes the connection of the request without responding, with a TCP
+// reset when possible
+func (s *Server) reset(rw http.ResponseWriter) {
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// randomFault picks the fault injected in a request, if any
+func (s *Server) randomFault() Fault {
+	rf := s.config.RandomFaults
+	if rf.Rate <= 0 {
+		return ""
+	}
+	faults := rf.Faults
+	if len(faults) == 0 {
+		faults = []Fault{FaultReset, FaultBadGateway, FaultHang}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rand.Float64() >= rf.Rate {
+		return ""
+	}
+	return faults[s.rand.Intn(len(faults))]
+}
+
+// sleep waits for the delay and reports whether the request is still alive
+func (s *Server) sleep(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-r.Context().Done():
+	case <-s.closed:
+	}
+	return false
+}
+
+// authenticated reports whether the request carries credentials of the scheme
+func (a *Auth) authenticated(r *http.Request) bool {
+	header := r.Header.Get("Proxy-Authorization")
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], a.Scheme) {
+		return false
+	}
+	switch {
+	case strings.EqualFold(a.Scheme, AuthBasic):
+		credentials, err := base64.StdEncoding.DecodeString(parts[1])
+		return err == nil && string(credentials) == a.Username+":"+a.Password
+	case strings.EqualFold(a.Scheme, AuthDigest):
+		return strings.Contains(parts[1], fmt.Sprintf("username=%q", a.Username)) && strings.Contains(parts[1], "response=")
+	case strings.EqualFold(a.Scheme, AuthNTLM):
+		return isNTLMMessage(parts[1])
+	case strings.EqualFold(a.Scheme, AuthNegotiate):
+		// a SPNEGO token, or an NTLM message for the clients falling back to NTLM
+		token, err := base64.StdEncoding.DecodeString(parts[1])
+		return err == nil && len(token) > 0 && token[0] == spnegoTokenTag || isNTLMMessage(parts[1])
+	}
+	return false
+}
+
+// spnegoTokenTag is the first byte of the GSS-API tokens of SPNEGO
+const spnegoTokenTag = 0x60
+
+// isNTLMMessage reports whether the base64 token is an NTLM message
+func isNTLMMessage(token string) bool {
+	message, err := base64.StdEncoding.DecodeString(token)
+	return err == nil && strings.HasPrefix(string(message), "NTLMSSP\x00")
+}
+
+// challenge returns the Proxy-Authenticate header of the scheme
+func (a *Auth) challenge() string {
+	switch a.Scheme {
+	case AuthBasic:
+		return `Basic realm="proxytest"`
+	case AuthDigest:
+		return `Digest realm="proxytest", qop="auth", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093"`
+	}
+	return a.Scheme
+}
+
+// delayedListener delays the first read of the accepted connections
+type delayedListener struct {
+	net.Listener
+	delay time.Duration
+}
+
+func (l *delayedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &delayedConn{Conn: conn, delay: l.delay}, nil
+}
+
+type delayedConn struct {
+	net.Conn
+	delay time.Duration
+	once  sync.Once
+}
+
+func (c *delayedConn) Read(b []byte) (int, error) {
+	c.once.Do(func() { time.Sleep(c.delay) })
+	return c.Conn.Read(b)
+}
+
+// slowWriter writes in chunks, waiting between them
+type slowWriter struct {
+	w      io.Writer
+	flush  func()
+	body   SlowBody
+	closed chan struct{}
+}
+
+func (w *slowWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		if written > 0 {
+			select {
+			case <-time.After(w.body.Interval):
+			case <-w.closed:
+				return written, io.ErrClosedPipe
+			}
+		}
+		size := w.body.ChunkSize
+		if size > len(b) {
+			size = len(b)
+		}
+		n, err := w.w.Write(b[:size])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if w.flush != nil {
+			w.flush()
+		}
+		b = b[size:]
+	}
+	return written, nil
+}
+
+// slowResponseWriter throttles the body of a response
+type slowResponseWriter struct {
+	http.ResponseWriter
+	body   SlowBody
+	closed chan struct{}
+	writer *slowWriter
+}
+
+func (w *slowResponseWriter) Write(b []byte) (int, error) {
+	if w.writer == nil {
+		w.writer = &slowWriter{w: w.ResponseWriter, body: w.body, closed: w.closed}
+		if f, ok := w.ResponseWriter.(http.Flusher); ok {
+			w.writer.flush = f.Flush
+		}
+	}
+	return w.writer.Write(b)
+}
+
+// Flush lets the handlers stream through the throttled writer
+func (w *slowResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,207 @@
+package proxytest
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func client(t *testing.T, proxy *Server) *http.Client {
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:             http.ProxyURL(proxyURL),
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		},
+		Timeout: 5 * time.Second,
+	}
+}
+
+func newProxy(t *testing.T, useTLS bool, c Config) *Server {
+	newFunc := NewProxy
+	if useTLS {
+		newFunc = NewTLSProxy
+	}
+	p, err := newFunc(c)
+	require.NoError(t, err)
+	return p
+}
+
+func newOrigin(t *testing.T, useTLS bool, c Config) *Server {
+	newFunc := NewOrigin
+	if useTLS {
+		newFunc = NewTLSOrigin
+	}
+	o, err := newFunc(c, nil)
+	require.NoError(t, err)
+	return o
+}
+
+func TestProxy(t *testing.T) {
+	for _, proxyTLS := range []bool{false, true} {
+		for _, originTLS := range []bool{false, true} {
+			p := newProxy(t, proxyTLS, Config{SetHeaders: map[string]string{"Via": "1.1 proxytest"}})
+			defer p.Close()
+			o := newOrigin(t, originTLS, Config{})
+			defer o.Close()
+
+			resp, err := client(t, p).Get(o.URL + "/headers")
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			if !originTLS {
+				require.Contains(t, string(body), "1.1 proxytest")
+			}
+		}
+	}
+}
+
+func TestStatusCode(t *testing.T) {
+	p := newProxy(t, false, Config{StatusCode: http.StatusForbidden})
+	defer p.Close()
+	o := newOrigin(t, false, Config{})
+	defer o.Close()
+	tlsOrigin := newOrigin(t, true, Config{})
+	defer tlsOrigin.Close()
+
+	resp, err := client(t, p).Get(o.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	_, err = client(t, p).Get(tlsOrigin.URL)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Forbidden")
+}
+
+func TestAuth(t *testing.T) {
+	o := newOrigin(t, false, Config{})
+	defer o.Close()
+
+	for _, scheme := range []string{AuthBasic, AuthDigest, AuthNegotiate, AuthNTLM} {
+		p := newProxy(t, false, Config{Auth: &Auth{Scheme: scheme, Username: "user", Password: "secret"}})
+		defer p.Close()
+
+		resp, err := client(t, p).Get(o.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+		require.Contains(t, resp.Header.Get("Proxy-Authenticate"), scheme)
+	}
+
+	p := newProxy(t, false, Config{Auth: &Auth{Scheme: AuthBasic, Username: "user", Password: "secret"}})
+	defer p.Close()
+	proxyURL, _ := url.Parse(p.URL)
+	proxyURL.User = url.UserPassword("user", "secret")
+	c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := c.Get(o.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestAuthCredentials(t *testing.T) {
+	ntlm := base64.StdEncoding.EncodeToString([]byte("NTLMSSP\x00\x03\x00\x00\x00"))
+	spnego := base64.StdEncoding.EncodeToString([]byte{spnegoTokenTag, 0x82, 0x01})
+	garbage := base64.StdEncoding.EncodeToString([]byte("garbage"))
+	for _, tc := range []struct {
+		scheme, header string
+		ok             bool
+	}{
+		{AuthBasic, "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret")), true},
+		{AuthBasic, "Basic " + base64.StdEncoding.EncodeToString([]byte("user:wrong")), false},
+		{AuthDigest, `Digest username="user", realm="proxytest", response="6629fae49393a05397450978507c4ef1"`, true},
+		{AuthDigest, `Digest username="other", realm="proxytest", response="6629fae49393a05397450978507c4ef1"`, false},
+		{AuthNTLM, "NTLM " + ntlm, true},
+		{AuthNTLM, "NTLM " + garbage, false},
+		{AuthNTLM, "Basic " + ntlm, false},
+		{AuthNegotiate, "Negotiate " + spnego, true},
+		{AuthNegotiate, "Negotiate " + ntlm, true},
+		{AuthNegotiate, "Negotiate " + garbage, false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://origin/", nil)
+		r.Header.Set("Proxy-Authorization", tc.header)
+		a := &Auth{Scheme: tc.scheme, Username: "user", Password: "secret"}
+		require.Equal(t, tc.ok, a.authenticated(r), tc.header)
+	}
+}
+
+func TestResetOnConnect(t *testing.T) {
+	p := newProxy(t, false, Config{ResetOnConnect: true})
+	defer p.Close()
+	o := newOrigin(t, true, Config{})
+	defer o.Close()
+
+	_, err := client(t, p).Get(o.URL)
+	require.Error(t, err)
+}
+
+func TestTLSFailures(t *testing.T) {
+	for _, failure := range []TLSFailure{TLSFailureHandshake, TLSFailureExpired} {
+		o := newOrigin(t, true, Config{TLSFailure: failure})
+		defer o.Close()
+
+		c := &http.Client{Timeout: 5 * time.Second}
+		_, err := c.Get(o.URL)
+		require.Error(t, err, failure)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	p := newProxy(t, false, Config{Latency: Latency{Accept: 50 * time.Millisecond, Connect: 50 * time.Millisecond}})
+	defer p.Close()
+	o := newOrigin(t, true, Config{Latency: Latency{Response: 50 * time.Millisecond}})
+	defer o.Close()
+
+	start := time.Now()
+	resp, err := client(t, p).Get(o.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.True(t, time.Since(start) >= 150*time.Millisecond)
+}
+
+func TestSlowBody(t *testing.T) {
+	o := newOrigin(t, false, Config{SlowBody: SlowBody{ChunkSize: 10, Interval: 20 * time.Millisecond}})
+	defer o.Close()
+
+	start := time.Now()
+	resp, err := http.Get(o.URL + "/bytes/50")
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Len(t, body, 50)
+	require.True(t, time.Since(start) >= 80*time.Millisecond)
+}
+
+func TestRandomFaults(t *testing.T) {
+	o := newOrigin(t, false, Config{RandomFaults: RandomFaults{Rate: 0.5, Faults: []Fault{FaultBadGateway}, Seed: 1}})
+	defer o.Close()
+
+	failures := 0
+	for i := 0; i < 20; i++ {
+		resp, err := http.Get(o.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusBadGateway {
+			failures++
+		}
+	}
+	require.True(t, failures > 0 && failures < 20, "%d failures", failures)
+
+	o = newOrigin(t, false, Config{RandomFaults: RandomFaults{Rate: 1, Faults: []Fault{FaultReset}}})
+	defer o.Close()
+	_, err := http.Get(o.URL)
+	require.Error(t, err)
+}
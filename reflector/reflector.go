@@ -0,0 +1,204 @@
+// Package reflector implements a test origin, echoing back what it receives
+// and serving configurable payloads, delays, streams, redirects and statuses.
+package reflector
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// MaxBytes is the maximum size of the payloads served by /bytes
+	MaxBytes = 100 * 1024 * 1024
+	// MaxDelay is the maximum delay of /delay and /stream
+	MaxDelay = time.Minute
+	// MaxChunks is the maximum number of chunks of /stream
+	MaxChunks = 10000
+	// MaxRedirects is the maximum length of the redirect chains served by /redirect
+	MaxRedirects = 20
+)
+
+// HeadersResponse is the document served by /headers
+type HeadersResponse struct {
+	Headers  http.Header `json:"headers"`
+	ClientIP string      `json:"client_ip"`
+	Host     string      `json:"host"`
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+}
+
+// NewHandler returns the handler of the reflector:
+//
+//	/headers          echoes the request headers and client IP as JSON
+//	/ip               echoes the client IP
+//	/bytes/{n}        serves n bytes
+//	/delay/{d}        responds after d (e.g. 500ms)
+//	/stream/{n}       streams n chunks, one every ?interval= (default 100ms)
+//	/redirect/{n}     redirects n times before responding
+//	/status/{code}    responds with the status code
+func NewHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/headers", handleHeaders)
+	mux.HandleFunc("/ip", handleIP)
+	mux.HandleFunc("/bytes/", handleBytes)
+	mux.HandleFunc("/delay/", handleDelay)
+	mux.HandleFunc("/stream/", handleStream)
+	mux.HandleFunc("/redirect/", handleRedirect)
+	mux.HandleFunc("/status/", handleStatus)
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(rw, r)
+			return
+		}
+		fmt.Fprintln(rw, "Hello from origin")
+	})
+	return mux
+}
+
+// clientIP returns the address of the client, which is the proxy egress IP
+// when the request went through a proxy
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// pathParam returns the path of the request after the prefix of its handler
+func pathParam(r *http.Request, prefix string) string {
+	return strings.TrimPrefix(r.URL.Path, prefix)
+}
+
+func handleHeaders(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(HeadersResponse{
+		Headers:  r.Header,
+		ClientIP: clientIP(r),
+		Host:     r.Host,
+		Method:   r.Method,
+		URL:      r.URL.String(),
+	})
+}
+
+func handleIP(rw http.ResponseWriter, r *http.Request) {
+	ip := clientIP(r)
+	rw.Header().Set("X-Client-IP", ip)
+	fmt.Fprintln(rw, ip)
+}
+
+func handleBytes(rw http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(pathParam(r, "/bytes/"))
+	if err != nil || n < 0 || n > MaxBytes {
+		http.Error(rw, fmt.Sprintf("size must be between 0 and %d", MaxBytes), http.StatusBadRequest)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Set("Content-Length", strconv.Itoa(n))
+	chunk := make([]byte, 32*1024)
+	for i := range chunk {
+		chunk[i] = 'x'
+	}
+	for n > 0 {
+		size := n
+		if size > len(chunk) {
+			size = len(chunk)
+		}
+		if _, err := rw.Write(chunk[:size]); err != nil {
+			return
+		}
+		n -= size
+	}
+}
+
+func parseDelay(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 || d > MaxDelay {
+		return 0, fmt.Errorf("delay must be between 0 and %s", MaxDelay)
+	}
+	return d, nil
+}
+
+func handleDelay(rw http.ResponseWriter, r *http.Request) {
+	d, err := parseDelay(pathParam(r, "/delay/"))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case <-time.After(d):
+	case <-r.Context().Done():
+		return
+	}
+	fmt.Fprintf(rw, "Responded after %s\n", d)
+}
+
+func handleStream(rw http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(pathParam(r, "/stream/"))
+	if err != nil || n < 0 || n > MaxChunks {
+		http.Error(rw, fmt.Sprintf("chunks must be between 0 and %d", MaxChunks), http.StatusBadRequest)
+		return
+	}
+	interval := 100 * time.Millisecond
+	if v := r.URL.Query().Get("interval"); v != "" {
+		interval, err = parseDelay(v)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	// compared before multiplying, which could overflow
+	if interval > 0 && int64(n) > int64(MaxDelay/interval) {
+		http.Error(rw, fmt.Sprintf("stream must last less than %s", MaxDelay), http.StatusBadRequest)
+		return
+	}
+
+	flusher, _ := rw.(http.Flusher)
+	rw.Header().Set("Content-Type", "text/plain")
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(interval):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		fmt.Fprintf(rw, "chunk %d\n", i)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+func handleRedirect(rw http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(pathParam(r, "/redirect/"))
+	if err != nil || n < 0 || n > MaxRedirects {
+		http.Error(rw, fmt.Sprintf("redirects must be between 0 and %d", MaxRedirects), http.StatusBadRequest)
+		return
+	}
+	if n == 0 {
+		fmt.Fprintln(rw, "End of redirect chain")
+		return
+	}
+	http.Redirect(rw, r, fmt.Sprintf("/redirect/%d", n-1), http.StatusFound)
+}
+
+func handleStatus(rw http.ResponseWriter, r *http.Request) {
+	code, err := strconv.Atoi(pathParam(r, "/status/"))
+	if err != nil || code < 200 || code > 599 {
+		http.Error(rw, "invalid status code", http.StatusBadRequest)
+		return
+	}
+	rw.WriteHeader(code)
+	fmt.Fprintln(rw, "Hello from origin")
+}
@@ -0,0 +1,86 @@
+package reflector
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, url string) (*http.Response, string) {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestHandler(t *testing.T) {
+	srv := httptest.NewServer(NewHandler())
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL+"/headers", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Test", "value")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	var headers HeadersResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&headers))
+	resp.Body.Close()
+	require.Equal(t, "value", headers.Headers.Get("X-Test"))
+	require.Equal(t, "127.0.0.1", headers.ClientIP)
+
+	resp, body := get(t, srv.URL+"/ip")
+	require.Equal(t, "127.0.0.1\n", body)
+	require.Equal(t, "127.0.0.1", resp.Header.Get("X-Client-IP"))
+
+	resp, body = get(t, srv.URL+"/bytes/100000")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, body, 100000)
+
+	resp, _ = get(t, srv.URL+"/bytes/-1")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	start := time.Now()
+	resp, _ = get(t, srv.URL+"/delay/50ms")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	resp, _ = get(t, srv.URL+"/delay/1h")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, body = get(t, srv.URL+"/stream/3?interval=10ms")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 3, strings.Count(body, "chunk"))
+
+	for _, path := range []string{
+		"/stream/9223372036854775807?interval=1s",
+		"/stream/1844674407370?interval=10s",
+		"/stream/100000?interval=0s",
+		"/stream/700?interval=100ms",
+	} {
+		resp, _ = get(t, srv.URL+path)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, path)
+	}
+
+	resp, body = get(t, srv.URL+"/redirect/3")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "/redirect/0", resp.Request.URL.Path)
+	require.Equal(t, "End of redirect chain\n", body)
+
+	resp, _ = get(t, srv.URL+"/status/503")
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	resp, _ = get(t, srv.URL+"/status/abc")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, _ = get(t, srv.URL+"/unknown")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/criteo/http-proxy-exporter/exporter"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// states of the proxies in the top table, by decreasing severity
+const (
+	topStatusDown     = "down"
+	topStatusDegraded = "degraded"
+	topStatusUp       = "up"
+	topStatusUnknown  = "unknown"
+)
+
+var topSeverity = map[string]int{topStatusDown: 3, topStatusDegraded: 2, topStatusUp: 1, topStatusUnknown: 0}
+
+// topColumns are the columns of the top table, which it can be sorted by
+var topColumns = []string{"proxy", "status", "p50", "p90", "p99", "success", "errors"}
+
+// topRow is the state of a proxy in the top table
+type topRow struct {
+	Proxy  string
+	Status string
+	// P50, P90 and P99 are the percentiles of the durations of the recent successful probes
+	P50, P90, P99 time.Duration
+	// Success is the ratio of successful probes in the recent ones
+	Success        float64
+	ConnFailures   int
+	OriginFailures int
+	// Causes are the numbers of recent errors by cause
+	Causes map[string]int
+	// Failing are the targets whose last probe failed
+	Failing []string
+}
+
+// topRows aggregates the results of the pairs by proxy
+func topRows(results *exporter.Results) []*topRow {
+	rows := make(map[string]*topRow)
+	latencies := make(map[string][]float64)
+	probes := make(map[string]int)
+	ok := make(map[string]int)
+	lastOK := make(map[string]int)
+	lastFailed := make(map[string]int)
+	for _, r := range results.Results {
+		row, found := rows[r.ProxyURL]
+		if !found {
+			row = &topRow{Proxy: r.ProxyURL, Causes: make(map[string]int)}
+			rows[r.ProxyURL] = row
+		}
+		latencies[r.ProxyURL] = append(latencies[r.ProxyURL], r.Latencies...)
+		for _, h := range r.History {
+			probes[r.ProxyURL]++
+			switch h {
+			case exporter.ResultOK:
+				ok[r.ProxyURL]++
+			case exporter.ResultConnectionFailure:
+				row.ConnFailures++
+			case exporter.ResultOriginFailure:
+				row.OriginFailures++
+			}
+		}
+		for _, c := range r.Causes {
+			if c != "" {
+				row.Causes[c]++
+			}
+		}
+		switch r.Result {
+		case exporter.ResultOK:
+			lastOK[r.ProxyURL]++
+		case exporter.ResultUnknown:
+		default:
+			lastFailed[r.ProxyURL]++
+			row.Failing = append(row.Failing, r.TargetURL)
+		}
+	}
+
+	var out []*topRow
+	for _, p := range results.Proxies {
+		row, found := rows[p]
+		if !found {
+			continue
+		}
+		switch {
+		case lastFailed[p] == 0 && lastOK[p] == 0:
+			row.Status = topStatusUnknown
+		case lastFailed[p] == 0:
+			row.Status = topStatusUp
+		case lastOK[p] == 0:
+			row.Status = topStatusDown
+		default:
+			row.Status = topStatusDegraded
+		}
+		if probes[p] > 0 {
+			row.Success = float64(ok[p]) / float64(probes[p])
+		}
+		l := latencies[p]
+		sort.Float64s(l)
+		row.P50, row.P90, row.P99 = percentile(l, 50), percentile(l, 90), percentile(l, 99)
+		out = append(out, row)
+	}
+	return out
+}
+
+// percentile returns the nearest-rank percentile of sorted durations in seconds
+func percentile(sorted []float64, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return time.Duration(sorted[rank-1] * float64(time.Second))
+}
+
+// sortTopRows sorts the rows by a column, the worst ones first, the proxies by name
+func sortTopRows(rows []*topRow, column string, reverse bool) {
+	less := func(a, b *topRow) bool {
+		switch column {
+		case "status":
+			return topSeverity[a.Status] > topSeverity[b.Status]
+		case "p50":
+			return a.P50 > b.P50
+		case "p90":
+			return a.P90 > b.P90
+		case "p99":
+			return a.P99 > b.P99
+		case "success":
+			return a.Success < b.Success
+		case "errors":
+			return a.ConnFailures+a.OriginFailures > b.ConnFailures+b.OriginFailures
+		}
+		return a.Proxy < b.Proxy
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if reverse {
+			return less(rows[j], rows[i])
+		}
+		return less(rows[i], rows[j])
+	})
+}
+
+// renderTop writes the top table
+func renderTop(w io.Writer, rows []*topRow, column string, reverse bool) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	var headers []string
+	for i, c := range topColumns {
+		header := fmt.Sprintf("%d:%s", i+1, strings.ToUpper(c))
+		if c == column {
+			header += map[bool]string{false: "▼", true: "▲"}[reverse]
+		}
+		headers = append(headers, header)
+	}
+	fmt.Fprintln(tw, strings.Join(headers, "\t")+"\tCAUSES\tFAILING TARGETS")
+	for _, r := range rows {
+		proxy := r.Proxy
+		if proxy == "" {
+			proxy = "DIRECT"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%.1f%%\tconn=%d origin=%d\t%s\t%s\n",
+			proxy, r.Status,
+			r.P50.Round(time.Millisecond), r.P90.Round(time.Millisecond), r.P99.Round(time.Millisecond),
+			100*r.Success, r.ConnFailures, r.OriginFailures, formatCauses(r.Causes), strings.Join(r.Failing, " "))
+	}
+	tw.Flush()
+}
+
+// formatCauses formats the numbers of errors by cause, the most frequent first
+func formatCauses(causes map[string]int) string {
+	var names []string
+	for c := range causes {
+		names = append(names, c)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if causes[names[i]] != causes[names[j]] {
+			return causes[names[i]] > causes[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	var parts []string
+	for _, c := range names {
+		parts = append(parts, fmt.Sprintf("%s=%d", c, causes[c]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// runTop renders a live table of the state of the proxies, probed with the
+// configuration or read from a running exporter
+func runTop(args []string) {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	configFile := fs.String("config_file", "config.yml", "Path to configuration file, to probe its proxies.")
+	exporterURL := fs.String("url", "", "URL of a running exporter to read its results from, instead of probing.")
+	refresh := fs.Duration("refresh", 2*time.Second, "Delay between each refresh of the table.")
+	column := fs.String("sort", "status", "Column to sort by: "+strings.Join(topColumns, ", ")+".")
+	reverse := fs.Bool("reverse", false, "Reverse the sort order.")
+	fs.Parse(args)
+
+	var fetch func() (*exporter.Results, error)
+	if *exporterURL != "" {
+		client := &http.Client{Timeout: 5 * time.Second}
+		resultsURL := strings.TrimSuffix(*exporterURL, "/") + "/api/v1/results"
+		fetch = func() (*exporter.Results, error) { return fetchResults(client, resultsURL) }
+	} else {
+		config, err := exporter.LoadConfig(*configFile, defaults)
+		if err != nil {
+			log.Fatalf("error while loading config: %s", err)
+		}
+		exp, err := exporter.New(localConfig(*config), exporter.Options{Registerer: prometheus.NewRegistry()})
+		if err != nil {
+			log.Fatal(err)
+		}
+		// the logs of the probes would garble the table
+		log.SetOutput(ioutil.Discard)
+		go exp.Run(context.Background())
+		fetch = func() (*exporter.Results, error) { return exp.Results(), nil }
+	}
+
+	// the keys are read once entered, the terminal is not switched to raw mode
+	keys := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			keys <- strings.TrimSpace(scanner.Text())
+		}
+	}()
+
+	ticker := time.NewTicker(*refresh)
+	defer ticker.Stop()
+	for {
+		results, err := fetch()
+		// clear the screen
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("http-proxy-exporter top - %s - sort: 1-%d + enter, reverse: r, quit: q\n\n",
+			time.Now().Format("15:04:05"), len(topColumns))
+		if err != nil {
+			fmt.Printf("could not get results: %s\n", err)
+		} else {
+			rows := topRows(results)
+			sortTopRows(rows, *column, *reverse)
+			renderTop(os.Stdout, rows, *column, *reverse)
+		}
+
+		select {
+		case <-ticker.C:
+		case key := <-keys:
+			switch key {
+			case "q":
+				return
+			case "r":
+				*reverse = !*reverse
+			default:
+				var i int
+				if _, err := fmt.Sscan(key, &i); err == nil && i >= 1 && i <= len(topColumns) {
+					*column = topColumns[i-1]
+				}
+			}
+		}
+	}
+}
+
+// localConfig returns a copy of the configuration to probe from the command
+// line, without the webhooks, sinks, HAR files and OTLP exports, which are
+// meant for the exporter in production
+func localConfig(config exporter.Config) *exporter.Config {
+	config.Webhooks = nil
+	config.Sinks = nil
+	config.HAR = exporter.HARConfig{}
+	config.OTLP = exporter.OTLPConfig{}
+	config.Tracing = exporter.OTLPConfig{}
+	return &config
+}
+
+// fetchResults reads the results of a running exporter
+func fetchResults(client *http.Client, resultsURL string) (*exporter.Results, error) {
+	resp, err := client.Get(resultsURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	results := &exporter.Results{}
+	if err := json.NewDecoder(resp.Body).Decode(results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
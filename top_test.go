@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/criteo/http-proxy-exporter/exporter"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopRows(t *testing.T) {
+	ok, conn, origin := exporter.ResultOK, exporter.ResultConnectionFailure, exporter.ResultOriginFailure
+	results := &exporter.Results{
+		Proxies: []string{"http://a:3128", "http://b:3128", "http://c:3128"},
+		Targets: []string{"https://x/", "https://y/"},
+		Results: []*exporter.PairResult{
+			{ProxyURL: "http://a:3128", TargetURL: "https://x/", Result: ok, History: []string{ok, ok}, Latencies: []float64{0.1, 0.2}},
+			{ProxyURL: "http://a:3128", TargetURL: "https://y/", Result: ok, History: []string{ok}, Latencies: []float64{0.3}},
+			{ProxyURL: "http://b:3128", TargetURL: "https://x/", Result: ok, History: []string{conn, ok}, Causes: []string{"proxy_connect", ""}, Latencies: []float64{1}},
+			{ProxyURL: "http://b:3128", TargetURL: "https://y/", Result: origin, History: []string{origin}, Causes: []string{"timeout"}},
+			{ProxyURL: "http://c:3128", TargetURL: "https://x/", Result: exporter.ResultUnknown},
+		},
+	}
+
+	rows := topRows(results)
+	require.Len(t, rows, 3)
+	a, b, c := rows[0], rows[1], rows[2]
+	require.Equal(t, topStatusUp, a.Status)
+	require.Equal(t, 200*time.Millisecond, a.P50)
+	require.Equal(t, 300*time.Millisecond, a.P99)
+	require.Equal(t, 1.0, a.Success)
+	require.Empty(t, a.Failing)
+
+	require.Equal(t, topStatusDegraded, b.Status)
+	require.Equal(t, 1, b.ConnFailures)
+	require.Equal(t, 1, b.OriginFailures)
+	require.InDelta(t, 1.0/3, b.Success, 1e-9)
+	require.Equal(t, map[string]int{"proxy_connect": 1, "timeout": 1}, b.Causes)
+	require.Equal(t, []string{"https://y/"}, b.Failing)
+
+	require.Equal(t, topStatusUnknown, c.Status)
+
+	sortTopRows(rows, "status", false)
+	require.Equal(t, []*topRow{b, a, c}, rows)
+	sortTopRows(rows, "p50", false)
+	require.Equal(t, []*topRow{b, a, c}, rows)
+	sortTopRows(rows, "proxy", true)
+	require.Equal(t, []*topRow{c, b, a}, rows)
+
+	var out bytes.Buffer
+	renderTop(&out, rows, "proxy", true)
+	require.Contains(t, out.String(), "1:PROXY▲")
+	require.Contains(t, out.String(), "conn=1 origin=1")
+	require.Contains(t, out.String(), "proxy_connect=1 timeout=1")
+}
+
+func TestLocalConfig(t *testing.T) {
+	config := exporter.Config{
+		Targets:  []exporter.Target{{URL: "https://x/"}},
+		Webhooks: []exporter.WebhookConfig{{URL: "http://hooks/"}},
+		Sinks:    []exporter.SinkConfig{{Type: "jsonl"}},
+		HAR:      exporter.HARConfig{Dir: "har"},
+		OTLP:     exporter.OTLPConfig{Endpoint: "http://collector:4318"},
+		Tracing:  exporter.OTLPConfig{Endpoint: "http://collector:4318"},
+	}
+	local := localConfig(config)
+	require.Equal(t, config.Targets, local.Targets)
+	require.Empty(t, local.Webhooks)
+	require.Empty(t, local.Sinks)
+	require.Empty(t, local.HAR)
+	require.Empty(t, local.OTLP)
+	require.Empty(t, local.Tracing)
+	// the configuration itself is left untouched
+	require.Len(t, config.Webhooks, 1)
+}